@@ -0,0 +1,198 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+////////////////////Interface//////////////////////////////
+
+type AclAccess byte
+
+const (
+	ACL_READ      AclAccess = 1 << iota //subscribe
+	ACL_WRITE                           //publish
+	ACL_READWRITE = ACL_READ | ACL_WRITE
+)
+
+//Authorizer decides which topics a session may publish to and which topic
+//filters it may subscribe to. A denied subscription gets the 0x80 return
+//code, a denied PUBLISH is acknowledged and dropped
+type Authorizer interface {
+	Authorize(s Session, topic string, access AclAccess) bool
+}
+
+////////////////////Implementation////////////////////////
+
+type acl_rule struct {
+	access AclAccess
+	topic  string
+}
+
+//acl_file_authorizer reads a mosquitto style ACL file:
+//
+//	# rules before any user line apply to clients without username
+//	topic read public/#
+//	user alice
+//	topic readwrite sensors/#
+//	client device-1
+//	topic write devices/1/#
+//	# patterns apply to everyone, %u is the username and %c the client id
+//	pattern readwrite clients/%c/#
+//
+//The access defaults to readwrite when omitted
+type acl_file_authorizer struct {
+	anonymous []acl_rule
+	users     map[string][]acl_rule
+	clients   map[string][]acl_rule
+	patterns  []acl_rule
+}
+
+func NewAclFileAuthorizer(path string) (Authorizer, error) {
+	this := &acl_file_authorizer{}
+
+	this.users = make(map[string][]acl_rule)
+	this.clients = make(map[string][]acl_rule)
+	if err := this.load(path); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *acl_file_authorizer) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	//the section the topic lines belong to
+	var section map[string][]acl_rule
+	var name string
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid ACL File %s Line %d\n", path, line)
+		}
+		keyword, value := fields[0], strings.TrimSpace(fields[1])
+		switch keyword {
+		case "user":
+			section, name = this.users, value
+		case "client":
+			section, name = this.clients, value
+		case "topic", "pattern":
+			rule, err := parseAclRule(value)
+			if err != nil {
+				return fmt.Errorf("Invalid ACL File %s Line %d %s", path, line, err.Error())
+			}
+			if keyword == "pattern" {
+				this.patterns = append(this.patterns, rule)
+			} else if section == nil {
+				this.anonymous = append(this.anonymous, rule)
+			} else {
+				section[name] = append(section[name], rule)
+			}
+		default:
+			return fmt.Errorf("Invalid ACL File %s Line %d Keyword %s\n", path, line, keyword)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func parseAclRule(value string) (acl_rule, error) {
+	access := ACL_READWRITE
+	topic := value
+	if fields := strings.SplitN(value, " ", 2); len(fields) == 2 {
+		switch fields[0] {
+		case "read":
+			access = ACL_READ
+		case "write":
+			access = ACL_WRITE
+		case "readwrite":
+			access = ACL_READWRITE
+		default:
+			return acl_rule{}, fmt.Errorf("Invalid Access %s\n", fields[0])
+		}
+		topic = strings.TrimSpace(fields[1])
+	}
+	if topic == "" {
+		return acl_rule{}, errors.New("Missing Topic\n")
+	}
+	return acl_rule{access: access, topic: topic}, nil
+}
+
+func (this *acl_file_authorizer) Authorize(s Session, topic string, access AclAccess) bool {
+	userName, clientId := s.GetUserName(), s.GetClientId()
+
+	rules := this.anonymous
+	if userName != "" {
+		rules = this.users[userName]
+	}
+	rules = append(append([]acl_rule(nil), rules...), this.clients[clientId]...)
+	for _, rule := range rules {
+		if rule.access&access == access && aclMatch(rule.topic, topic) {
+			return true
+		}
+	}
+
+	for _, rule := range this.patterns {
+		if rule.access&access != access {
+			continue
+		}
+		//a username or client id can't widen a pattern with wildcards or levels
+		if strings.Contains(rule.topic, "%u") && (userName == "" || strings.ContainsAny(userName, "+#/")) {
+			continue
+		}
+		if strings.Contains(rule.topic, "%c") && (clientId == "" || strings.ContainsAny(clientId, "+#/")) {
+			continue
+		}
+		pattern := strings.Replace(strings.Replace(rule.topic, "%u", userName, -1), "%c", clientId, -1)
+		if aclMatch(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//aclMatch tells whether a rule covers a topic, or every topic of a filter
+func aclMatch(rule, filter string) bool {
+	rules := strings.Split(rule, "/")
+	filters := strings.Split(filter, "/")
+
+	//wildcards at the first level don't cover topics beginning with '$'
+	if strings.HasPrefix(filters[0], "$") && (rules[0] == "+" || rules[0] == "#") {
+		return false
+	}
+
+	for i, r := range rules {
+		if r == "#" {
+			return true
+		}
+		if i == len(filters) {
+			return false
+		}
+		switch {
+		case r == "+":
+			if filters[i] == "#" {
+				return false
+			}
+		case r != filters[i]:
+			return false
+		}
+	}
+
+	return len(rules) == len(filters)
+}
@@ -0,0 +1,98 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+////////////////////Interface//////////////////////////////
+
+//Authenticator is consulted before the listeners' ProcessConnect, a CONNECT
+//it doesn't accept is refused with the returned CONNACK return code
+type Authenticator interface {
+	Authenticate(eventConnect EventConnect) CONNACK_RETURNCODE
+}
+
+//ExtendedAuthenticator runs the MQTT 5 enhanced authentication of a CONNECT
+//carrying an AUTHENTICATION_METHOD, and the re-authentications which follow.
+//Each step gets the client's authentication data and returns the reason code
+//with the data for the client: REASON_CONTINUE_AUTHENTICATION for another
+//step, REASON_SUCCESS, or a failure reason code. Authenticate is still
+//consulted once the enhanced authentication succeeded
+type ExtendedAuthenticator interface {
+	Authenticator
+	AuthenticateExtended(s Session, method string, data []byte) (ReasonCode, []byte)
+}
+
+////////////////////Implementation////////////////////////
+
+//password_file_authenticator checks the credentials against a file of
+//"username:bcrypt hash" lines, empty lines and lines starting with '#' are
+//skipped
+type password_file_authenticator struct {
+	path           string
+	allowAnonymous bool
+	passwords      map[string][]byte
+}
+
+func NewPasswordFileAuthenticator(path string, allowAnonymous bool) (Authenticator, error) {
+	this := &password_file_authenticator{}
+
+	this.path = path
+	this.allowAnonymous = allowAnonymous
+	if err := this.load(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *password_file_authenticator) load() error {
+	file, err := os.Open(this.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	passwords := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return fmt.Errorf("Invalid Password File %s Line %d\n", this.path, line)
+		}
+		passwords[text[:i]] = []byte(text[i+1:])
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	this.passwords = passwords
+
+	return nil
+}
+
+func (this *password_file_authenticator) Authenticate(eventConnect EventConnect) CONNACK_RETURNCODE {
+	if eventConnect.GetConnectFlags()&CONNECT_FLAG_USERNAME_FLAG == 0 {
+		if this.allowAnonymous {
+			return CONNACK_RETURNCODE_ACCEPTED
+		}
+		return CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED
+	}
+
+	hash, ok := this.passwords[eventConnect.GetUserName()]
+
+	if !ok || bcrypt.CompareHashAndPassword(hash, eventConnect.GetPassword()) != nil {
+		return CONNACK_RETURNCODE_REFUSED_BAD_USERNAME_OR_PASSWORD
+	}
+
+	return CONNACK_RETURNCODE_ACCEPTED
+}
@@ -0,0 +1,868 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+////////////////////Interface//////////////////////////////
+
+const (
+	CLIENT_TIMEOUT = 30 //seconds to wait for an acknowledgement
+
+	CLIENT_BACKOFF_MIN = time.Second
+	CLIENT_BACKOFF_MAX = 2 * time.Minute
+)
+
+type ClientState int
+
+const (
+	CLIENT_STATE_DISCONNECTED ClientState = iota
+	CLIENT_STATE_CONNECTED
+	CLIENT_STATE_RECONNECTING
+)
+
+var CLIENT_STATE_STRINGS = []string{
+	"DISCONNECTED",
+	"CONNECTED",
+	"RECONNECTING",
+}
+
+type Client interface {
+	GetTransport() Transport
+	GetClientId() string
+
+	SetCleanSession(cleanSession bool)
+	SetKeepAlive(keepAlive uint16) //seconds, 0 disables keep-alive
+	SetUserName(userName string)
+	SetPassword(password []byte)
+	SetWill(will Message)
+	SetTimeout(timeout int) //seconds
+
+	//after the connection is lost, redial with a jittered exponential backoff
+	//between min and max, resuming the session with CleanSession=0
+	SetAutoReconnect(autoReconnect bool)
+	SetReconnectBackoff(min, max time.Duration)
+
+	AddListener(l ClientListener)
+	RemoveListener(l ClientListener)
+
+	Connect() error
+	IsConnected() bool
+	IsSessionPresent() bool
+	Publish(msg Message) error
+	Subscribe(topics []string, qos []QOS) ([]byte, error)
+	Unsubscribe(topics []string) error
+	Disconnect() error
+}
+
+type ClientListener interface {
+	ProcessMessage(client Client, msg Message)
+	ProcessConnectionLost(client Client, err error)
+	ProcessStateChanged(eventState EventClientState)
+}
+
+type EventClientState interface {
+	GetClient() Client
+	GetState() ClientState
+	GetAttempt() int //reconnect attempt, starting at 1
+	GetSessionPresent() bool
+	GetError() error
+}
+
+////////////////////Implementation////////////////////////
+
+type client struct {
+	transport Transport
+	clientId  string
+	listeners map[ClientListener]ClientListener
+
+	//Connect
+	cleanSession bool
+	keepAlive    uint16
+	userName     string
+	password     []byte
+	will         Message
+	timeout      int
+
+	//Reconnect
+	autoReconnect bool
+	backoffMin    time.Duration
+	backoffMax    time.Duration
+	reconnecting  bool
+	stop          chan bool //closed by Disconnect, guarded by mutex
+
+	conn           net.Conn
+	connected      bool
+	sessionPresent bool
+	lastSent       time.Time
+	pingSent       time.Time //guarded by mutex
+
+	packetId      uint16
+	sequence      uint64
+	pendings      map[uint16]*pending //acknowledgements waited for by packet identifier
+	inbounds      map[uint16]bool     //QoS 2 packet identifiers received, waiting for PUBREL, guarded by mutex
+	subscriptions map[string]QOS
+
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+	quit       chan bool
+	waitGroup  *sync.WaitGroup
+}
+
+//pending is a request waiting for its acknowledgements, a publish is kept
+//across reconnects and resent with DUP set
+type pending struct {
+	ack      chan Packet
+	msg      Message
+	released bool
+	sequence uint64
+}
+
+func newClient(t Transport, clientId string) *client {
+	this := &client{}
+
+	this.transport = t
+	this.clientId = clientId
+	this.listeners = make(map[ClientListener]ClientListener)
+
+	this.cleanSession = true
+	this.keepAlive = 60
+	this.timeout = CLIENT_TIMEOUT
+
+	this.backoffMin = CLIENT_BACKOFF_MIN
+	this.backoffMax = CLIENT_BACKOFF_MAX
+
+	this.packetId = 1
+	this.pendings = make(map[uint16]*pending)
+	this.inbounds = make(map[uint16]bool)
+	this.subscriptions = make(map[string]QOS)
+
+	this.waitGroup = &sync.WaitGroup{}
+
+	return this
+}
+
+func (this *client) GetTransport() Transport {
+	return this.transport
+}
+
+func (this *client) GetClientId() string {
+	return this.clientId
+}
+
+func (this *client) SetCleanSession(cleanSession bool) {
+	this.cleanSession = cleanSession
+}
+
+func (this *client) SetKeepAlive(keepAlive uint16) {
+	this.keepAlive = keepAlive
+}
+
+func (this *client) SetUserName(userName string) {
+	this.userName = userName
+}
+
+func (this *client) SetPassword(password []byte) {
+	this.password = password
+}
+
+func (this *client) SetWill(will Message) {
+	this.will = will
+}
+
+func (this *client) SetTimeout(timeout int) {
+	this.timeout = timeout
+}
+
+func (this *client) SetAutoReconnect(autoReconnect bool) {
+	this.autoReconnect = autoReconnect
+}
+
+func (this *client) SetReconnectBackoff(min, max time.Duration) {
+	this.backoffMin = min
+	this.backoffMax = max
+}
+
+func (this *client) AddListener(l ClientListener) {
+	this.listeners[l] = l
+}
+
+func (this *client) RemoveListener(l ClientListener) {
+	delete(this.listeners, l)
+}
+
+func (this *client) IsConnected() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.connected
+}
+
+func (this *client) IsSessionPresent() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.sessionPresent
+}
+
+func (this *client) Connect() error {
+	this.mutex.Lock()
+	if this.connected || this.reconnecting {
+		this.mutex.Unlock()
+		return errors.New("Client Already Connected\n")
+	}
+	stop := make(chan bool)
+	this.stop = stop
+	this.mutex.Unlock()
+
+	if err := this.dial(this.cleanSession, stop); err != nil {
+		return err
+	}
+	this.changeState(CLIENT_STATE_CONNECTED, 0, nil)
+
+	return nil
+}
+
+//dial connects and starts the read loop, unless stop was closed by a
+//Disconnect in the meantime
+func (this *client) dial(cleanSession bool, stop chan bool) error {
+	conn, err := this.transport.Dial()
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		return fmt.Errorf("Unsupported Network %s\n", this.transport.GetNetwork())
+	}
+
+	pktconn := NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(0x04)
+	pktconn.SetKeepAlive(this.keepAlive)
+	pktconn.SetClientId(this.clientId)
+
+	var connectFlags byte
+	if cleanSession {
+		connectFlags |= CONNECT_FLAG_CLEAN_SESSION
+	}
+	if this.will != nil {
+		connectFlags |= CONNECT_FLAG_WILL_FLAG | (byte(this.will.GetQos()) << 3)
+		if this.will.GetRetain() {
+			connectFlags |= CONNECT_FLAG_WILL_RETAIN
+		}
+		pktconn.SetWillTopic(this.will.GetTopic())
+		pktconn.SetWillPayload(this.will.GetPayload())
+	}
+	if this.userName != "" {
+		connectFlags |= CONNECT_FLAG_USERNAME_FLAG
+		pktconn.SetUserName(this.userName)
+	}
+	if this.password != nil {
+		connectFlags |= CONNECT_FLAG_PASSWORD_FLAG
+		pktconn.SetPassword(this.password)
+	}
+	pktconn.SetConnectFlags(connectFlags)
+
+	if _, err = conn.Write(pktconn.Bytes()); err != nil {
+		conn.Close()
+		return err
+	}
+
+	//CONNACK is read synchronously, before the read loop is started
+	var buf []byte
+	reader := NewPacketReader(conn, 0)
+	deadline := time.Now().Add(time.Duration(this.timeout) * time.Second)
+	for {
+		conn.SetReadDeadline(time.Now().Add(1e9))
+		if buf, err = reader.ReadPacket(); err == nil {
+			break
+		}
+		if opErr, ok := err.(net.Error); !ok || !opErr.Timeout() || time.Now().After(deadline) {
+			conn.Close()
+			return err
+		}
+	}
+	pkt, err := Packetize(buf)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	pktconnack, ok := pkt.(PacketConnack)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("Unexpected %s Packet Received instead of CONNACK\n", PACKET_TYPE_STRINGS[pkt.GetType()])
+	}
+	if pktconnack.GetReturnCode() != CONNACK_RETURNCODE_ACCEPTED {
+		conn.Close()
+		return fmt.Errorf("Server Refused Connection with Return Code %x\n", pktconnack.GetReturnCode())
+	}
+
+	this.writeMutex.Lock()
+	this.lastSent = time.Now()
+	this.writeMutex.Unlock()
+
+	//checked under the lock Disconnect closes stop with, so either the
+	//connection is registered and closed by Disconnect, or it isn't started
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	select {
+	case <-stop:
+		conn.Close()
+		return errors.New("Client Disconnected\n")
+	default:
+	}
+	this.conn = conn
+	this.connected = true
+	this.sessionPresent = pktconnack.GetSPFlag()
+	if !this.sessionPresent {
+		this.inbounds = make(map[uint16]bool)
+	}
+	this.pingSent = time.Time{}
+	this.quit = make(chan bool)
+	this.waitGroup.Add(1)
+	go this.ServeConn(conn, reader, this.quit)
+
+	return nil
+}
+
+func (this *client) Publish(msg Message) error {
+	if msg.GetQos() == QOS_ZERO {
+		return this.write(msg.Packetize(0))
+	}
+
+	packetId, ack := this.expect(2, msg)
+	defer this.forget(packetId)
+
+	//while reconnecting, the publish is resent once the session is resumed
+	if err := this.write(msg.Packetize(packetId)); err != nil && !this.isReconnecting() {
+		return err
+	}
+
+	pkt, err := this.wait(ack)
+	if err != nil {
+		return err
+	}
+	if msg.GetQos() == QOS_ONE {
+		if pkt.GetType() != PACKET_PUBACK {
+			return fmt.Errorf("Unexpected %s Packet Received instead of PUBACK\n", PACKET_TYPE_STRINGS[pkt.GetType()])
+		}
+		return nil
+	}
+
+	if pkt.GetType() != PACKET_PUBREC {
+		return fmt.Errorf("Unexpected %s Packet Received instead of PUBREC\n", PACKET_TYPE_STRINGS[pkt.GetType()])
+	}
+	this.release(packetId)
+	pktpubrel := NewPacketAcks(PACKET_PUBREL)
+	pktpubrel.SetPacketId(packetId)
+	if err = this.write(pktpubrel); err != nil && !this.isReconnecting() {
+		return err
+	}
+	if pkt, err = this.wait(ack); err != nil {
+		return err
+	}
+	if pkt.GetType() != PACKET_PUBCOMP {
+		return fmt.Errorf("Unexpected %s Packet Received instead of PUBCOMP\n", PACKET_TYPE_STRINGS[pkt.GetType()])
+	}
+
+	return nil
+}
+
+func (this *client) Subscribe(topics []string, qos []QOS) ([]byte, error) {
+	if len(topics) == 0 || len(topics) != len(qos) {
+		return nil, errors.New("Invalid Subscribe Topics and QoSs\n")
+	}
+
+	packetId, ack := this.expect(1, nil)
+	defer this.forget(packetId)
+
+	pktsub := NewPacketSubscribe()
+	pktsub.SetPacketId(packetId)
+	pktsub.SetSubscribeTopics(topics)
+	pktsub.SetQoSs(qos)
+	if err := this.write(pktsub); err != nil {
+		return nil, err
+	}
+
+	pkt, err := this.wait(ack)
+	if err != nil {
+		return nil, err
+	}
+	pktsuback, ok := pkt.(PacketSuback)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected %s Packet Received instead of SUBACK\n", PACKET_TYPE_STRINGS[pkt.GetType()])
+	}
+	if len(pktsuback.GetReturnCodes()) != len(topics) {
+		return nil, errors.New("Invalid Return Codes Length in PacketSuback\n")
+	}
+
+	//kept to resubscribe when a reconnect finds no session present
+	this.mutex.Lock()
+	for i, returnCode := range pktsuback.GetReturnCodes() {
+		if returnCode != 0x80 {
+			this.subscriptions[topics[i]] = qos[i]
+		}
+	}
+	this.mutex.Unlock()
+
+	return pktsuback.GetReturnCodes(), nil
+}
+
+func (this *client) Unsubscribe(topics []string) error {
+	if len(topics) == 0 {
+		return errors.New("Invalid Unsubscribe Topics\n")
+	}
+
+	packetId, ack := this.expect(1, nil)
+	defer this.forget(packetId)
+
+	pktunsub := NewPacketUnsubscribe()
+	pktunsub.SetPacketId(packetId)
+	pktunsub.SetUnsubscribeTopics(topics)
+	if err := this.write(pktunsub); err != nil {
+		return err
+	}
+
+	pkt, err := this.wait(ack)
+	if err != nil {
+		return err
+	}
+	if pkt.GetType() != PACKET_UNSUBACK {
+		return fmt.Errorf("Unexpected %s Packet Received instead of UNSUBACK\n", PACKET_TYPE_STRINGS[pkt.GetType()])
+	}
+
+	this.mutex.Lock()
+	for _, topic := range topics {
+		delete(this.subscriptions, topic)
+	}
+	this.mutex.Unlock()
+
+	return nil
+}
+
+func (this *client) Disconnect() error {
+	this.mutex.Lock()
+	connected, reconnecting := this.connected, this.reconnecting
+	if !connected && !reconnecting {
+		this.mutex.Unlock()
+		return errors.New("Client Not Connected\n")
+	}
+	select {
+	case <-this.stop:
+		//already disconnecting
+		this.mutex.Unlock()
+		return errors.New("Client Not Connected\n")
+	default:
+	}
+	close(this.stop)
+	this.mutex.Unlock()
+
+	var err error
+	if connected {
+		err = this.write(NewPacket(PACKET_DISCONNECT))
+	}
+	this.close(false)
+	this.waitGroup.Wait()
+	this.changeState(CLIENT_STATE_DISCONNECTED, 0, nil)
+
+	return err
+}
+
+//close tears down the connection and fails the pending acknowledgements,
+//except the publishes kept for a reconnect. It returns whether a connection
+//was closed, and whether a reconnect has to be started
+func (this *client) close(reconnect bool) (bool, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	closed := false
+	if this.connected {
+		this.connected = false
+		close(this.quit)
+		this.conn.Close()
+		closed = true
+	}
+
+	for packetId, p := range this.pendings {
+		if !reconnect || p.msg == nil {
+			close(p.ack)
+			delete(this.pendings, packetId)
+		}
+	}
+
+	restart := false
+	if !reconnect {
+		this.reconnecting = false
+	} else if closed && !this.reconnecting {
+		this.reconnecting = true
+		restart = true
+	}
+
+	return closed, restart
+}
+
+func (this *client) isReconnecting() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.reconnecting
+}
+
+func (this *client) reconnect(stop chan bool, err error) {
+	backoff := this.backoffMin
+	for attempt := 1; ; attempt++ {
+		this.changeState(CLIENT_STATE_RECONNECTING, attempt, err)
+
+		//jittered over the upper half of the backoff
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > this.backoffMax {
+			backoff = this.backoffMax
+		}
+
+		if err = this.dial(false, stop); err != nil {
+			log.Println("Reconnect", err)
+			continue
+		}
+		select {
+		case <-stop:
+			this.close(false)
+			return
+		default:
+		}
+		if err = this.resume(); err != nil {
+			log.Println("Resume", err)
+			this.close(true)
+			continue
+		}
+
+		this.mutex.Lock()
+		connected := this.connected
+		if connected {
+			this.reconnecting = false
+		}
+		this.mutex.Unlock()
+
+		if connected {
+			this.changeState(CLIENT_STATE_CONNECTED, attempt, nil)
+			return
+		}
+		err = errors.New("Connection Lost while Resuming\n")
+	}
+}
+
+//resume resubscribes when the server has no session present, and resends
+//the unacknowledged publishes in their original order
+func (this *client) resume() error {
+	this.mutex.Lock()
+	sessionPresent := this.sessionPresent
+	topics := make([]string, 0, len(this.subscriptions))
+	qos := make([]QOS, 0, len(this.subscriptions))
+	for topic, q := range this.subscriptions {
+		topics = append(topics, topic)
+		qos = append(qos, q)
+	}
+	packetIds := make([]uint16, 0, len(this.pendings))
+	for packetId, p := range this.pendings {
+		if p.msg != nil {
+			packetIds = append(packetIds, packetId)
+		}
+	}
+	sort.Slice(packetIds, func(i, j int) bool {
+		return this.pendings[packetIds[i]].sequence < this.pendings[packetIds[j]].sequence
+	})
+	pendings := make([]*pending, len(packetIds))
+	for i, packetId := range packetIds {
+		pendings[i] = this.pendings[packetId]
+	}
+	this.mutex.Unlock()
+
+	if !sessionPresent && len(topics) != 0 {
+		if _, err := this.Subscribe(topics, qos); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range pendings {
+		var pkt Packet
+		this.mutex.Lock()
+		released := p.released
+		this.mutex.Unlock()
+		if released {
+			pktpubrel := NewPacketAcks(PACKET_PUBREL)
+			pktpubrel.SetPacketId(packetIds[i])
+			pkt = pktpubrel
+		} else {
+			pkt = NewMessagePayload(true, p.msg.GetQos(), p.msg.GetRetain(), p.msg.GetTopic(), p.msg.GetPayload()).Packetize(packetIds[i])
+		}
+		if err := this.write(pkt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *client) changeState(state ClientState, attempt int, err error) {
+	evt := newEventClientState(this, state, attempt, err)
+	for _, l := range this.listeners {
+		l.ProcessStateChanged(evt)
+	}
+}
+
+func (this *client) write(pkt Packet) error {
+	this.mutex.Lock()
+	conn := this.conn
+	connected := this.connected
+	this.mutex.Unlock()
+
+	if !connected {
+		return errors.New("Client Not Connected\n")
+	}
+
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+
+	if _, err := conn.Write(pkt.Bytes()); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+	this.lastSent = time.Now()
+
+	return nil
+}
+
+//expect allocates a packet identifier and the channel its acknowledgements
+//are delivered to
+func (this *client) expect(size int, msg Message) (uint16, chan Packet) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for {
+		packetId := this.packetId
+		if this.packetId++; this.packetId == 0 {
+			this.packetId++
+		}
+		if _, ok := this.pendings[packetId]; !ok {
+			this.sequence++
+			p := &pending{ack: make(chan Packet, size), msg: msg, sequence: this.sequence}
+			this.pendings[packetId] = p
+			return packetId, p.ack
+		}
+	}
+}
+
+func (this *client) release(packetId uint16) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if p, ok := this.pendings[packetId]; ok {
+		p.released = true
+	}
+}
+
+func (this *client) forget(packetId uint16) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	delete(this.pendings, packetId)
+}
+
+func (this *client) wait(ack chan Packet) (Packet, error) {
+	select {
+	case pkt, ok := <-ack:
+		if !ok {
+			return nil, errors.New("Connection Lost\n")
+		}
+		return pkt, nil
+	case <-time.After(time.Duration(this.timeout) * time.Second):
+		return nil, errors.New("Acknowledgement Timeout\n")
+	}
+}
+
+func (this *client) acknowledge(packetId uint16, pkt Packet) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if p, ok := this.pendings[packetId]; ok {
+		select {
+		case p.ack <- pkt:
+		default:
+		}
+	} else {
+		log.Printf("Unexpected %s PacketId %x Received\n", PACKET_TYPE_STRINGS[pkt.GetType()], packetId)
+	}
+}
+
+func (this *client) ServeConn(conn net.Conn, reader PacketReader, quit chan bool) {
+	defer this.waitGroup.Done()
+
+	for {
+		select {
+		case <-quit:
+			return
+		default:
+			//can't delete default, otherwise blocking call
+		}
+
+		if this.keepAlive != 0 {
+			keepAlive := time.Duration(this.keepAlive) * time.Second
+			this.mutex.Lock()
+			pingSent := this.pingSent
+			this.mutex.Unlock()
+			if !pingSent.IsZero() && time.Since(pingSent) > keepAlive {
+				this.lost(errors.New("PINGRESP Timeout\n"))
+				return
+			}
+			this.writeMutex.Lock()
+			idle := time.Since(this.lastSent)
+			this.writeMutex.Unlock()
+			if pingSent.IsZero() && idle >= keepAlive {
+				this.mutex.Lock()
+				this.pingSent = time.Now()
+				this.mutex.Unlock()
+				this.write(NewPacket(PACKET_PINGREQ))
+			}
+		}
+
+		conn.SetReadDeadline(time.Now().Add(1e9)) //wait for 1 second
+		buf, err := reader.ReadPacket()
+		if err != nil {
+			if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+				continue
+			}
+			this.lost(err)
+			return
+		}
+
+		pkt, err := Packetize(buf)
+		if err != nil {
+			this.lost(err)
+			return
+		}
+		if err = this.Process(pkt); err != nil {
+			this.lost(err)
+			return
+		}
+	}
+}
+
+func (this *client) lost(err error) {
+	closed, restart := this.close(this.autoReconnect)
+	if !closed {
+		return
+	}
+
+	log.Println("Connection Lost", err)
+	for _, l := range this.listeners {
+		l.ProcessConnectionLost(this, err)
+	}
+	if restart {
+		this.mutex.Lock()
+		stop := this.stop
+		this.mutex.Unlock()
+		go this.reconnect(stop, err)
+	} else if !this.autoReconnect {
+		this.changeState(CLIENT_STATE_DISCONNECTED, 0, err)
+	}
+}
+
+func (this *client) Process(pkt Packet) error {
+	switch pkt.GetType() {
+	case PACKET_PUBLISH:
+		pktpub := pkt.(PacketPublish)
+		msg := pktpub.GetMessage()
+		switch msg.GetQos() {
+		case QOS_ONE:
+			pktpuback := NewPacketAcks(PACKET_PUBACK)
+			pktpuback.SetPacketId(pktpub.GetPacketId())
+			this.write(pktpuback)
+		case QOS_TWO:
+			pktpubrec := NewPacketAcks(PACKET_PUBREC)
+			pktpubrec.SetPacketId(pktpub.GetPacketId())
+			this.write(pktpubrec)
+			//the message has already been delivered until PUBREL is received
+			this.mutex.Lock()
+			received := this.inbounds[pktpub.GetPacketId()]
+			this.inbounds[pktpub.GetPacketId()] = true
+			this.mutex.Unlock()
+			if received {
+				return nil
+			}
+		}
+		for _, l := range this.listeners {
+			l.ProcessMessage(this, msg)
+		}
+	case PACKET_PUBREL:
+		packetId := pkt.(PacketPubrel).GetPacketId()
+		this.mutex.Lock()
+		delete(this.inbounds, packetId)
+		this.mutex.Unlock()
+		pktpubcomp := NewPacketAcks(PACKET_PUBCOMP)
+		pktpubcomp.SetPacketId(packetId)
+		this.write(pktpubcomp)
+	case PACKET_PUBACK, PACKET_PUBREC, PACKET_PUBCOMP, PACKET_UNSUBACK:
+		this.acknowledge(pkt.(PacketAck).GetPacketId(), pkt)
+	case PACKET_SUBACK:
+		this.acknowledge(pkt.(PacketSuback).GetPacketId(), pkt)
+	case PACKET_PINGRESP:
+		this.mutex.Lock()
+		this.pingSent = time.Time{}
+		this.mutex.Unlock()
+	default:
+		return fmt.Errorf("Unexpected %s Packet Received\n", PACKET_TYPE_STRINGS[pkt.GetType()])
+	}
+
+	return nil
+}
+
+type event_client_state struct {
+	client         Client
+	state          ClientState
+	attempt        int
+	sessionPresent bool
+	err            error
+}
+
+func newEventClientState(c *client, state ClientState, attempt int, err error) *event_client_state {
+	this := &event_client_state{}
+
+	this.client = c
+	this.state = state
+	this.attempt = attempt
+	this.sessionPresent = c.IsSessionPresent()
+	this.err = err
+
+	return this
+}
+
+func (this *event_client_state) GetClient() Client {
+	return this.client
+}
+
+func (this *event_client_state) GetState() ClientState {
+	return this.state
+}
+
+func (this *event_client_state) GetAttempt() int {
+	return this.attempt
+}
+
+func (this *event_client_state) GetSessionPresent() bool {
+	return this.sessionPresent
+}
+
+func (this *event_client_state) GetError() error {
+	return this.err
+}
@@ -37,8 +37,12 @@ type EventConnect interface {
 	GetClientId() string
 	GetWillTopic() string
 	GetWillMessage() string
+	GetWillPayload() []byte
 	GetUserName() string
 	GetPassword() []byte
+
+	//MQTT 5 CONNECT properties, empty before MQTT 5
+	GetProperties() Properties
 }
 
 type EventPublish interface {
@@ -106,9 +110,10 @@ type event_connect struct {
 	keepAlive    uint16
 	clientId     string
 	willTopic    string
-	willMessage  string
+	willMessage  []byte
 	userName     string
 	password     []byte
+	properties   Properties
 }
 
 func newEventConnect(s Session, p PacketConnect) *event_connect {
@@ -119,11 +124,12 @@ func newEventConnect(s Session, p PacketConnect) *event_connect {
 
 	this.connectFlags = p.GetConnectFlags()
 	this.keepAlive = p.GetKeepAlive()
-	this.clientId = p.GetClientId()
+	this.clientId = s.GetClientId() //the assigned one for a zero-length identifier
 	this.willTopic = p.GetWillTopic()
-	this.willMessage = p.GetWillMessage()
+	this.willMessage = p.GetWillPayload()
 	this.userName = p.GetUserName()
 	this.password = p.GetPassword()
+	this.properties = p.GetProperties()
 
 	return this
 }
@@ -145,6 +151,10 @@ func (this *event_connect) GetWillTopic() string {
 }
 
 func (this *event_connect) GetWillMessage() string {
+	return string(this.willMessage)
+}
+
+func (this *event_connect) GetWillPayload() []byte {
 	return this.willMessage
 }
 
@@ -156,6 +166,10 @@ func (this *event_connect) GetPassword() []byte {
 	return this.password
 }
 
+func (this *event_connect) GetProperties() Properties {
+	return this.properties
+}
+
 type event_publish struct {
 	event
 
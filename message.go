@@ -1,5 +1,9 @@
 package mqtt
 
+import (
+	"time"
+)
+
 ////////////////////Interface//////////////////////////////
 
 type QOS byte
@@ -25,9 +29,23 @@ type Message interface {
 	GetTopic() string
 	SetTopic(topic string)
 
+	//GetContent and SetContent convert the payload to and from a string
 	GetContent() string
 	SetContent(content string)
 
+	//the payload is shared from parsing to forwarding, it must not be
+	//modified once the message is handed over
+	GetPayload() []byte
+	SetPayload(payload []byte)
+
+	//MQTT 5 PUBLISH properties, nil when there are none
+	GetProperties() Properties
+	SetProperties(p Properties)
+
+	//the time the MESSAGE_EXPIRY_INTERVAL runs out, zero if it never expires
+	GetExpiry() time.Time
+	SetExpiry(t time.Time)
+
 	//GetClientId() string
 	//SetClientId(clientId string)
 
@@ -37,20 +55,26 @@ type Message interface {
 ////////////////////Implementation////////////////////////
 
 type message struct {
-	dup      bool
-	qos      QOS
-	retain   bool
-	topic    string
-	content  string
-	clientId string
+	dup        bool
+	qos        QOS
+	retain     bool
+	topic      string
+	payload    []byte
+	clientId   string //the publishing client, for the No Local option
+	properties Properties
+	expiry     time.Time
 }
 
 func NewMessage(dup bool, qos QOS, retain bool, topic string, content string) Message {
+	return NewMessagePayload(dup, qos, retain, topic, []byte(content))
+}
+
+func NewMessagePayload(dup bool, qos QOS, retain bool, topic string, payload []byte) Message {
 	return &message{dup: dup,
 		qos:     qos,
 		retain:  retain,
 		topic:   topic,
-		content: content}
+		payload: payload}
 }
 
 func (this *message) GetDup() bool {
@@ -82,10 +106,17 @@ func (this *message) SetTopic(topic string) {
 }
 
 func (this *message) GetContent() string {
-	return this.content
+	return string(this.payload)
 }
 func (this *message) SetContent(content string) {
-	this.content = content
+	this.payload = []byte(content)
+}
+
+func (this *message) GetPayload() []byte {
+	return this.payload
+}
+func (this *message) SetPayload(payload []byte) {
+	this.payload = payload
 }
 func (this *message) GetClientId() string {
 	return this.clientId
@@ -94,6 +125,20 @@ func (this *message) SetClientId(clientId string) {
 	this.clientId = clientId
 }
 
+func (this *message) GetProperties() Properties {
+	return this.properties
+}
+func (this *message) SetProperties(p Properties) {
+	this.properties = p
+}
+
+func (this *message) GetExpiry() time.Time {
+	return this.expiry
+}
+func (this *message) SetExpiry(t time.Time) {
+	this.expiry = t
+}
+
 func (this *message) Packetize(packetId uint16) PacketPublish {
 	pkt := NewPacketPublish()
 	pkt.SetPacketId(packetId)
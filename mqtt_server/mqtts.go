@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
 	"log"
 	"mqtt"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 func main() {
-	if len(os.Args) < 4 {
-		print("Usage: mqtt_server tcp localhost 1883")
+	certFile := flag.String("cert", "", "server certificate file (PEM)")
+	keyFile := flag.String("key", "", "server private key file (PEM)")
+	caFile := flag.String("ca", "", "CA file (PEM) to require and verify client certificates")
+	certIdentity := flag.Bool("certid", false, "only accept client ids matching the client certificate CN or SANs")
+	passwdFile := flag.String("passwd", "", "password file of username:bcrypt hash lines")
+	allowAnonymous := flag.Bool("anonymous", false, "with -passwd, also accept clients without username")
+	aclFile := flag.String("acl", "", "ACL file restricting the topics clients publish and subscribe to")
+	drain := flag.Duration("drain", 10*time.Second, "time given on shutdown to in-flight messages and queued packets")
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		print("Usage: mqtt_server [-cert server.pem -key server.key [-ca ca.pem [-certid]]] [-passwd file [-anonymous]] [-acl file] [-drain 10s] tcp localhost 1883")
 		return
 	}
 
@@ -22,21 +37,43 @@ func main() {
 	var tlsc *tls.Config
 	var err error
 
-	network = os.Args[1]
-	address = os.Args[2]
-	if port, err = strconv.Atoi(os.Args[3]); err != nil {
+	network = flag.Arg(0)
+	address = flag.Arg(1)
+	if port, err = strconv.Atoi(flag.Arg(2)); err != nil {
 		print("Invalid port number")
 		return
 	}
-	tlsc = nil
+	if tlsc, err = loadTLSConfig(*certFile, *keyFile, *caFile); err != nil {
+		log.Println(err)
+		return
+	}
 
 	stack := mqtt.GetStack()
 	provider := stack.CreateProvider()
 
+	if *passwdFile != "" {
+		authenticator, err := mqtt.NewPasswordFileAuthenticator(*passwdFile, *allowAnonymous)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		provider.SetAuthenticator(authenticator)
+	}
+
+	if *aclFile != "" {
+		authorizer, err := mqtt.NewAclFileAuthorizer(*aclFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		provider.SetAuthorizer(authorizer)
+	}
+
 	transport := stack.CreateTransport(network, address, port, tlsc)
 	provider.AddTransport(transport)
 
 	listener := newListener(provider)
+	listener.certIdentity = *certIdentity
 	provider.AddListener(listener)
 
 	stack.Run()
@@ -46,5 +83,36 @@ func main() {
 	log.Println(<-ch)
 
 	// Stop the service gracefully.
-	stack.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), *drain)
+	defer cancel()
+	if err := stack.Stop(ctx); err != nil {
+		log.Println(err)
+	}
+}
+
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsc := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No Certificates Found in %s\n", caFile)
+		}
+		tlsc.ClientCAs = pool
+		tlsc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsc, nil
 }
@@ -1,19 +1,19 @@
 package main
 
 import (
+	"crypto/x509"
+	"errors"
 	"log"
 	"mqtt"
 )
 
 type mqtts_listener struct {
-	provider mqtt.Provider
-
-	retainedMessages map[string]mqtt.Message
+	provider     mqtt.Provider
+	certIdentity bool
 }
 
 func newListener(provider mqtt.Provider) *mqtts_listener {
-	return &mqtts_listener{provider: provider,
-		retainedMessages: make(map[string]mqtt.Message)}
+	return &mqtts_listener{provider: provider}
 }
 func (this *mqtts_listener) ProcessConnect(eventConnect mqtt.EventConnect) {
 	log.Println("Received CONNECT")
@@ -22,9 +22,44 @@ func (this *mqtts_listener) ProcessConnect(eventConnect mqtt.EventConnect) {
 	pktconnack := mqtt.NewPacketConnack()
 	pktconnack.SetSPFlag(false)
 	pktconnack.SetReturnCode(mqtt.CONNACK_RETURNCODE_ACCEPTED)
+	if this.certIdentity && !matchCertificate(s.GetPeerCertificate(), eventConnect.GetClientId()) {
+		log.Printf("Client Id %s Doesn't Match the Client Certificate\n", eventConnect.GetClientId())
+		pktconnack.SetReturnCode(mqtt.CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED)
+	}
 
 	s.AcknowledgeConnect(pktconnack)
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED {
+		//the connection is closed once the CONNACK is written
+		s.Terminate(errors.New(s.Error()))
+	}
+}
+
+//the client id must be the certificate's subject CN or one of its SANs
+func matchCertificate(cert *x509.Certificate, clientId string) bool {
+	if cert == nil {
+		return false
+	}
+	if cert.Subject.CommonName == clientId {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if name == clientId {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == clientId {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == clientId {
+			return true
+		}
+	}
+	return false
 }
+
 func (this *mqtts_listener) ProcessPublish(eventPublish mqtt.EventPublish) {
 	log.Printf("Received Publish with DUP %v QoS %v RETAIN %v Topic: %v Content: %v\n",
 		eventPublish.GetMessage().GetDup(),
@@ -33,19 +68,7 @@ func (this *mqtts_listener) ProcessPublish(eventPublish mqtt.EventPublish) {
 		eventPublish.GetMessage().GetTopic(),
 		eventPublish.GetMessage().GetContent())
 
-	this.provider.Forward(mqtt.NewMessage(eventPublish.GetMessage().GetDup(),
-		eventPublish.GetMessage().GetQos(),
-		false,
-		eventPublish.GetMessage().GetTopic(),
-		eventPublish.GetMessage().GetContent()))
-
-	if eventPublish.GetMessage().GetRetain() {
-		if eventPublish.GetMessage().GetContent() == "" {
-			delete(this.retainedMessages, eventPublish.GetMessage().GetTopic())
-		} else {
-			this.retainedMessages[eventPublish.GetMessage().GetTopic()] = eventPublish.GetMessage()
-		}
-	}
+	this.provider.Forward(eventPublish.GetMessage())
 }
 func (this *mqtts_listener) ProcessSubscribe(eventSubscribe mqtt.EventSubscribe) {
 	log.Printf("Received SUBSCRIBE with %v", eventSubscribe.GetSubscribeTopics())
@@ -66,10 +89,6 @@ func (this *mqtts_listener) ProcessSubscribe(eventSubscribe mqtt.EventSubscribe)
 	pktsuback.SetReturnCodes(retCodes)
 
 	s.AcknowledgeSubscribe(pktsuback)
-
-	for _, msg := range this.retainedMessages {
-		s.Forward(msg)
-	}
 }
 func (this *mqtts_listener) ProcessUnsubscribe(eventUnsubscribe mqtt.EventUnsubscribe) {
 	log.Printf("Received UNSUBSCRIBE with %v", eventUnsubscribe.GetUnsubscribeTopics())
@@ -0,0 +1,107 @@
+package mqtt_test
+
+import (
+	"mqtt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const test_acl = `# anonymous clients
+topic read public/#
+
+user alice
+topic readwrite sensors/#
+topic write alerts
+
+pattern readwrite clients/%c/#
+pattern read users/%u/inbox
+`
+
+func TestAclFileAuthorizer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acl")
+	if err = os.WriteFile(path, []byte(test_acl), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authorizer, err := mqtt.NewAclFileAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := startProvider(t, 18849)
+	defer stopProvider(p)
+	p.SetAuthorizer(authorizer)
+
+	alicel := newTestClientListener()
+	alice := createClient(18849, "dev1", alicel)
+	defer mqtt.GetStack().DeleteClient(alice)
+	alice.SetUserName("alice")
+	if err := alice.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Disconnect()
+
+	anonl := newTestClientListener()
+	anon := createClient(18849, "anon", anonl)
+	defer mqtt.GetStack().DeleteClient(anon)
+	if err := anon.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Disconnect()
+
+	subscriptions := []struct {
+		client      mqtt.Client
+		topics      []string
+		returnCodes []byte
+	}{
+		{alice,
+			[]string{"sensors/#", "public/#", "alerts", "clients/dev1/#", "clients/other/#", "users/alice/inbox", "#", "sensors"},
+			[]byte{0x01, 0x80, 0x80, 0x01, 0x80, 0x01, 0x80, 0x01}},
+		{anon,
+			[]string{"public/#", "public/+/x", "sensors/#", "+"},
+			[]byte{0x01, 0x01, 0x80, 0x80}},
+	}
+	for _, sub := range subscriptions {
+		qos := make([]mqtt.QOS, len(sub.topics))
+		for i := range qos {
+			qos[i] = mqtt.QOS_ONE
+		}
+		returnCodes, err := sub.client.Subscribe(sub.topics, qos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range returnCodes {
+			if returnCodes[i] != sub.returnCodes[i] {
+				t.Errorf("Unexpected Return Code %02x for %s\n", returnCodes[i], sub.topics[i])
+			}
+		}
+	}
+
+	//denied publishes are acknowledged and dropped
+	for _, pub := range []struct {
+		client mqtt.Client
+		topic  string
+	}{{alice, "public/news"}, {anon, "public/news"}, {anon, "sensors/temperature"}} {
+		if err := pub.client.Publish(mqtt.NewMessage(false, mqtt.QOS_ONE, false, pub.topic, "denied")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.Publish(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "sensors/temperature", "allowed")); err != nil {
+		t.Fatal(err)
+	}
+	alicel.expect(t, "sensors/temperature", mqtt.QOS_ONE, "allowed")
+
+	select {
+	case msg := <-anonl.messages:
+		t.Fatalf("Unexpected Message %s\n", msg.GetTopic())
+	case msg := <-alicel.messages:
+		t.Fatalf("Unexpected Message %s\n", msg.GetTopic())
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,166 @@
+package mqtt_test
+
+import (
+	"io"
+	"mqtt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func connectWithCredentials(t *testing.T, port int, userName string, password []byte) mqtt.PacketConnack {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(4)
+	flags := mqtt.CONNECT_FLAG_CLEAN_SESSION
+	if userName != "" {
+		flags |= mqtt.CONNECT_FLAG_USERNAME_FLAG
+		pktconn.SetUserName(userName)
+	}
+	if password != nil {
+		flags |= mqtt.CONNECT_FLAG_PASSWORD_FLAG
+		pktconn.SetPassword(password)
+	}
+	pktconn.SetConnectFlags(flags)
+	pktconn.SetClientId("auth")
+	conn.Write(pktconn.Bytes())
+
+	pktconnack, ok := readPacket(t, conn).(mqtt.PacketConnack)
+	if !ok {
+		t.Fatal("Expected CONNACK")
+	}
+	//a refused client is disconnected, keep alive 0 never times out
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected EOF after Refused CONNACK %v\n", err)
+		}
+	}
+	return pktconnack
+}
+
+func TestPasswordFileAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd")
+	if err = os.WriteFile(path, []byte("# users\n\nalice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := startProvider(t, 18848)
+	defer stopProvider(p)
+
+	for _, allowAnonymous := range []bool{false, true} {
+		authenticator, err := mqtt.NewPasswordFileAuthenticator(path, allowAnonymous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SetAuthenticator(authenticator)
+
+		anonymous := mqtt.CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED
+		if allowAnonymous {
+			anonymous = mqtt.CONNACK_RETURNCODE_ACCEPTED
+		}
+		cases := []struct {
+			userName   string
+			password   []byte
+			returnCode mqtt.CONNACK_RETURNCODE
+		}{
+			{"alice", []byte("secret"), mqtt.CONNACK_RETURNCODE_ACCEPTED},
+			{"alice", []byte("wrong"), mqtt.CONNACK_RETURNCODE_REFUSED_BAD_USERNAME_OR_PASSWORD},
+			{"alice", nil, mqtt.CONNACK_RETURNCODE_REFUSED_BAD_USERNAME_OR_PASSWORD},
+			{"bob", []byte("secret"), mqtt.CONNACK_RETURNCODE_REFUSED_BAD_USERNAME_OR_PASSWORD},
+			{"", nil, anonymous},
+		}
+		for _, c := range cases {
+			if returnCode := connectWithCredentials(t, 18848, c.userName, c.password).GetReturnCode(); returnCode != c.returnCode {
+				t.Errorf("Unexpected Return Code %x for %q with Anonymous %v\n", returnCode, c.userName, allowAnonymous)
+			}
+		}
+	}
+
+	if _, err := mqtt.NewPasswordFileAuthenticator(filepath.Join(dir, "missing"), false); err == nil {
+		t.Fatal("Missing Password File Accepted")
+	}
+}
+
+//challenge_authenticator answers "hello" with a challenge to which
+//"response" is the right answer
+type challenge_authenticator struct{}
+
+func (this *challenge_authenticator) Authenticate(eventConnect mqtt.EventConnect) mqtt.CONNACK_RETURNCODE {
+	return mqtt.CONNACK_RETURNCODE_ACCEPTED
+}
+
+func (this *challenge_authenticator) AuthenticateExtended(s mqtt.Session, method string, data []byte) (mqtt.ReasonCode, []byte) {
+	switch string(data) {
+	case "hello":
+		return mqtt.REASON_CONTINUE_AUTHENTICATION, []byte("challenge")
+	case "response":
+		return mqtt.REASON_SUCCESS, []byte("welcome")
+	}
+	return mqtt.REASON_NOT_AUTHORIZED, nil
+}
+
+func TestEnhancedAuthentication(t *testing.T) {
+	p := startProvider(t, 18856)
+	defer stopProvider(p)
+	p.SetAuthenticator(&challenge_authenticator{})
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", "18856"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pktconn := newConnect5("ext", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	pktconn.GetProperties().SetString(mqtt.PROPERTY_AUTHENTICATION_METHOD, "challenge")
+	pktconn.GetProperties().SetBinary(mqtt.PROPERTY_AUTHENTICATION_DATA, []byte("hello"))
+	conn.Write(pktconn.Bytes())
+
+	pktauth, ok := readPacketLevel(t, conn, 5).(mqtt.PacketAuth)
+	if !ok || pktauth.GetReasonCode() != mqtt.REASON_CONTINUE_AUTHENTICATION ||
+		string(pktauth.GetProperties().GetBinary(mqtt.PROPERTY_AUTHENTICATION_DATA)) != "challenge" {
+		t.Fatal("Expected AUTH Challenge")
+	}
+
+	pktauth = mqtt.NewPacketAuth()
+	pktauth.SetReasonCode(mqtt.REASON_CONTINUE_AUTHENTICATION)
+	pktauth.GetProperties().SetString(mqtt.PROPERTY_AUTHENTICATION_METHOD, "challenge")
+	pktauth.GetProperties().SetBinary(mqtt.PROPERTY_AUTHENTICATION_DATA, []byte("response"))
+	conn.Write(pktauth.Bytes())
+
+	pktconnack, ok := readPacketLevel(t, conn, 5).(mqtt.PacketConnack)
+	if !ok || pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED ||
+		string(pktconnack.GetProperties().GetBinary(mqtt.PROPERTY_AUTHENTICATION_DATA)) != "welcome" {
+		t.Fatal("Expected CONNACK after Authentication")
+	}
+
+	//a failed authentication refuses the connection
+	pktconn = newConnect5("ext2", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	pktconn.GetProperties().SetString(mqtt.PROPERTY_AUTHENTICATION_METHOD, "challenge")
+	pktconn.GetProperties().SetBinary(mqtt.PROPERTY_AUTHENTICATION_DATA, []byte("wrong"))
+	conn2, pktconnack := connectWith(t, 18856, pktconn)
+	conn2.Close()
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED {
+		t.Fatal("Failed Authentication Accepted")
+	}
+}
@@ -0,0 +1,303 @@
+package mqtt_test
+
+import (
+	"mqtt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type test_client_listener struct {
+	messages chan mqtt.Message
+	lost     chan error
+	states   chan mqtt.EventClientState
+}
+
+func newTestClientListener() *test_client_listener {
+	return &test_client_listener{messages: make(chan mqtt.Message, 16), lost: make(chan error, 16), states: make(chan mqtt.EventClientState, 16)}
+}
+
+func (this *test_client_listener) ProcessMessage(client mqtt.Client, msg mqtt.Message) {
+	this.messages <- msg
+}
+func (this *test_client_listener) ProcessConnectionLost(client mqtt.Client, err error) {
+	this.lost <- err
+}
+func (this *test_client_listener) ProcessStateChanged(eventState mqtt.EventClientState) {
+	this.states <- eventState
+}
+
+func (this *test_client_listener) expectState(t *testing.T, state mqtt.ClientState) mqtt.EventClientState {
+	for {
+		select {
+		case evt := <-this.states:
+			if evt.GetState() == state {
+				return evt
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("State %s Not Reached\n", mqtt.CLIENT_STATE_STRINGS[state])
+			return nil
+		}
+	}
+}
+
+func (this *test_client_listener) expect(t *testing.T, topic string, qos mqtt.QOS, content string) {
+	select {
+	case msg := <-this.messages:
+		if msg.GetTopic() != topic || msg.GetQos() != qos || msg.GetContent() != content {
+			t.Fatalf("Unexpected Message %s %d %s\n", msg.GetTopic(), msg.GetQos(), msg.GetContent())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Message %s Not Received\n", topic)
+	}
+}
+
+func createClient(port int, clientId string, l mqtt.ClientListener) mqtt.Client {
+	stack := mqtt.GetStack()
+	c := stack.CreateClient(stack.CreateTransport(mqtt.TCP, "127.0.0.1", port, nil), clientId)
+	c.AddListener(l)
+	return c
+}
+
+func TestClient(t *testing.T) {
+	p := startProvider(t, 18840)
+	stopped := false
+	defer func() {
+		if !stopped {
+			stopProvider(p)
+		}
+	}()
+
+	sl := newTestClientListener()
+	subscriber := createClient(18840, "subscriber", sl)
+	defer mqtt.GetStack().DeleteClient(subscriber)
+	if err := subscriber.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	returnCodes, err := subscriber.Subscribe([]string{"client/+"}, []mqtt.QOS{mqtt.QOS_TWO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(returnCodes) != 1 || returnCodes[0] != byte(mqtt.QOS_TWO) {
+		t.Fatalf("Unexpected Return Codes %v\n", returnCodes)
+	}
+
+	pl := newTestClientListener()
+	publisher := createClient(18840, "publisher", pl)
+	defer mqtt.GetStack().DeleteClient(publisher)
+	if err := publisher.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for qos, content := range []string{"zero", "one", "two"} {
+		if err := publisher.Publish(mqtt.NewMessage(false, mqtt.QOS(qos), false, "client/"+content, content)); err != nil {
+			t.Fatal(err)
+		}
+		sl.expect(t, "client/"+content, mqtt.QOS(qos), content)
+	}
+
+	if err := subscriber.Unsubscribe([]string{"client/+"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "client/one", "one")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-sl.messages:
+		t.Fatalf("Unexpected Message %s after Unsubscribe\n", msg.GetTopic())
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if err := publisher.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if publisher.IsConnected() {
+		t.Fatal("Publisher Still Connected after Disconnect")
+	}
+
+	//the subscriber is told when the broker goes away
+	stopProvider(p)
+	stopped = true
+	select {
+	case <-sl.lost:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Connection Lost Not Reported")
+	}
+	if _, err := subscriber.Subscribe([]string{"client/+"}, []mqtt.QOS{mqtt.QOS_ONE}); err == nil {
+		t.Fatal("Subscribe Succeeded on Lost Connection")
+	}
+}
+
+func TestClientConnect(t *testing.T) {
+	lner, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(18841)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lner.Close()
+
+	connects := make(chan mqtt.PacketConnect, 1)
+	go func() {
+		conn, err := lner.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		pkt := readPacket(t, conn)
+		connects <- pkt.(mqtt.PacketConnect)
+		pktconnack := mqtt.NewPacketConnack()
+		pktconnack.SetReturnCode(mqtt.CONNACK_RETURNCODE_REFUSED_BAD_USERNAME_OR_PASSWORD)
+		conn.Write(pktconnack.Bytes())
+	}()
+
+	c := createClient(18841, "will", newTestClientListener())
+	defer mqtt.GetStack().DeleteClient(c)
+	c.SetKeepAlive(10)
+	c.SetUserName("user")
+	c.SetPassword([]byte("password"))
+	c.SetWill(mqtt.NewMessage(false, mqtt.QOS_ONE, true, "will/topic", "gone"))
+	if err := c.Connect(); err == nil {
+		t.Fatal("Refused Connection Accepted")
+	}
+
+	pktconn := <-connects
+	flags := pktconn.GetConnectFlags()
+	if pktconn.GetClientId() != "will" || pktconn.GetKeepAlive() != 10 {
+		t.Fatalf("Unexpected ClientId %s or KeepAlive %d\n", pktconn.GetClientId(), pktconn.GetKeepAlive())
+	}
+	if flags&mqtt.CONNECT_FLAG_WILL_FLAG == 0 || flags&mqtt.CONNECT_FLAG_WILL_RETAIN == 0 || flags&mqtt.CONNECT_FLAG_WILL_QOS_BIT3 == 0 {
+		t.Fatalf("Unexpected Will Flags %x\n", flags)
+	}
+	if pktconn.GetWillTopic() != "will/topic" || pktconn.GetWillMessage() != "gone" {
+		t.Fatalf("Unexpected Will %s %s\n", pktconn.GetWillTopic(), pktconn.GetWillMessage())
+	}
+	if pktconn.GetUserName() != "user" || string(pktconn.GetPassword()) != "password" {
+		t.Fatalf("Unexpected Credentials %s %s\n", pktconn.GetUserName(), pktconn.GetPassword())
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	p := startProvider(t, 18842)
+
+	l := newTestClientListener()
+	c := createClient(18842, "reconnect", l)
+	defer mqtt.GetStack().DeleteClient(c)
+	c.SetAutoReconnect(true)
+	c.SetReconnectBackoff(50*time.Millisecond, 200*time.Millisecond)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Subscribe([]string{"reconnect/#"}, []mqtt.QOS{mqtt.QOS_ONE}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restarted broker has no session, so the subscription is sent again
+	stopProvider(p)
+	if evt := l.expectState(t, mqtt.CLIENT_STATE_RECONNECTING); evt.GetAttempt() != 1 || evt.GetError() == nil {
+		t.Fatalf("Unexpected Reconnect Attempt %d\n", evt.GetAttempt())
+	}
+	p = startProvider(t, 18842)
+	defer stopProvider(p)
+	if evt := l.expectState(t, mqtt.CLIENT_STATE_CONNECTED); evt.GetSessionPresent() {
+		t.Fatal("Session Present after Broker Restart")
+	}
+
+	conn, _ := connect(t, 18842, "publisher", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer conn.Close()
+	publish(conn, 1, mqtt.NewMessage(false, mqtt.QOS_ONE, false, "reconnect/topic", "again"))
+	l.expect(t, "reconnect/topic", mqtt.QOS_ONE, "again")
+
+	if err := c.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	l.expectState(t, mqtt.CLIENT_STATE_DISCONNECTED)
+}
+
+func TestClientDisconnectWhileReconnecting(t *testing.T) {
+	p := startProvider(t, 18867)
+
+	l := newTestClientListener()
+	c := createClient(18867, "stopping", l)
+	defer mqtt.GetStack().DeleteClient(c)
+	c.SetAutoReconnect(true)
+	c.SetReconnectBackoff(time.Millisecond, 4*time.Millisecond)
+
+	//a Disconnect racing a redial leaves no connection behind
+	for i := 0; i < 8; i++ {
+		if err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		stopProvider(p)
+		l.expectState(t, mqtt.CLIENT_STATE_RECONNECTING)
+		p = startProvider(t, 18867)
+		time.Sleep(time.Duration(i) * time.Millisecond)
+		if err := c.Disconnect(); err != nil {
+			t.Fatal(err)
+		}
+		l.expectState(t, mqtt.CLIENT_STATE_DISCONNECTED)
+		time.Sleep(20 * time.Millisecond)
+		if c.IsConnected() {
+			t.Fatal("Connected after Disconnect")
+		}
+	}
+	stopProvider(p)
+}
+
+func TestClientResendOnReconnect(t *testing.T) {
+	lner, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(18843)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lner.Close()
+
+	//the first connection drops the publish, the second acknowledges it
+	connects := make(chan mqtt.PacketConnect, 2)
+	publishes := make(chan mqtt.PacketPublish, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := lner.Accept()
+			if err != nil {
+				return
+			}
+			connects <- readPacket(t, conn).(mqtt.PacketConnect)
+			pktconnack := mqtt.NewPacketConnack()
+			pktconnack.SetSPFlag(i == 1)
+			pktconnack.SetReturnCode(mqtt.CONNACK_RETURNCODE_ACCEPTED)
+			conn.Write(pktconnack.Bytes())
+
+			pktpub := readPacket(t, conn).(mqtt.PacketPublish)
+			publishes <- pktpub
+			if i == 1 {
+				pktpuback := mqtt.NewPacketAcks(mqtt.PACKET_PUBACK)
+				pktpuback.SetPacketId(pktpub.GetPacketId())
+				conn.Write(pktpuback.Bytes())
+				defer conn.Close()
+			} else {
+				conn.Close()
+			}
+		}
+	}()
+
+	c := createClient(18843, "resend", newTestClientListener())
+	defer mqtt.GetStack().DeleteClient(c)
+	c.SetAutoReconnect(true)
+	c.SetReconnectBackoff(50*time.Millisecond, 200*time.Millisecond)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	if err := c.Publish(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "resend/topic", "once")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := <-publishes, <-publishes
+	if first.GetMessage().GetDup() || !second.GetMessage().GetDup() {
+		t.Fatal("DUP Flag Not Set Only on the Resent Publish")
+	}
+	if first.GetPacketId() != second.GetPacketId() || second.GetMessage().GetContent() != "once" {
+		t.Fatalf("Unexpected Resent Publish %x %s\n", second.GetPacketId(), second.GetMessage().GetContent())
+	}
+	<-connects
+	if pktconn := <-connects; pktconn.GetConnectFlags()&mqtt.CONNECT_FLAG_CLEAN_SESSION != 0 {
+		t.Fatal("Reconnect with CleanSession=1")
+	}
+}
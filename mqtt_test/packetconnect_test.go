@@ -42,3 +42,19 @@ func TestPacketConnect(t *testing.T) {
 		}
 	}
 }
+
+func TestPacketConnectLengthOverflow(t *testing.T) {
+	//a password length of 0xFFFF must not wrap around the bounds check
+	input := []byte{0x10, 0x12, 0x00, 0x04, 0x4D, 0x51, 0x54, 0x54, 0x04, 0xC0, 0x00, 0x00,
+		0x00, 0x01, 0x61, 0x00, 0x01, 0x75, 0xFF, 0xFF}
+	if pkt, err := mqtt.PacketizeLevel(input, 4); err == nil {
+		t.Fatalf("Unexpected Packet %v\n", pkt)
+	}
+
+	//so must a user property length of 0xFFFF in an MQTT 5 CONNECT
+	input = []byte{0x10, 0x11, 0x00, 0x04, 0x4D, 0x51, 0x54, 0x54, 0x05, 0x02, 0x00, 0x00,
+		0x05, 0x26, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x01, 0x61}
+	if pkt, err := mqtt.PacketizeLevel(input, 5); err == nil {
+		t.Fatalf("Unexpected Packet %v\n", pkt)
+	}
+}
@@ -1,6 +1,7 @@
 package mqtt_test
 
 import (
+	"bytes"
 	"mqtt"
 	"testing"
 )
@@ -48,3 +49,43 @@ func TestPacketPublish(t *testing.T) {
 		}
 	}
 }
+
+func TestPacketPublishRemainingLength(t *testing.T) {
+	//remaining lengths of 1, 2, 3 and 4 bytes
+	for _, size := range []int{100, 200, 70000, 2100000} {
+		msg := mqtt.NewMessage(false, mqtt.QOS_ONE, false, "a/b", string(make([]byte, size)))
+		pkt, err := mqtt.Packetize(msg.Packetize(1).Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content := pkt.(mqtt.PacketPublish).GetMessage().GetContent(); len(content) != size {
+			t.Errorf("Mismatch content length %d vs %d\n", len(content), size)
+		}
+	}
+}
+
+func TestPacketPublishPayload(t *testing.T) {
+	//not valid UTF-8
+	payload := []byte{0x00, 0xFF, 0xFE, 0x80}
+	input := mqtt.NewMessagePayload(false, mqtt.QOS_ZERO, false, "a/b", payload).Packetize(0).Bytes()
+
+	//followed by the next packet in the buffer
+	buf := append(input, 0xC0, 0x00)
+	pkt, err := mqtt.Packetize(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := pkt.(mqtt.PacketPublish).GetMessage().GetPayload()
+	if !bytes.Equal(output, payload) {
+		t.Fatalf("Mismatch payload % x vs % x\n", output, payload)
+	}
+
+	//the parsed payload isn't copied out of the buffer, and can't be
+	//appended to over the next packet
+	if &output[0] != &buf[len(input)-len(payload)] {
+		t.Fatal("Payload Copied")
+	}
+	if output = append(output, 0x01); buf[len(input)] != 0xC0 {
+		t.Fatal("Next Packet Overwritten by Append to Payload")
+	}
+}
@@ -0,0 +1,53 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"mqtt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketReader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	pkt := mqtt.NewMessage(false, mqtt.QOS_ONE, false, "a/b", "payload").Packetize(1).Bytes()
+	reader := mqtt.NewPacketReader(server, 0)
+
+	//a packet interrupted by a deadline is resumed by the next read
+	go client.Write(pkt[:4])
+	server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := reader.ReadPacket(); err == nil {
+		t.Fatal("Partial Packet Read")
+	} else if opErr, ok := err.(net.Error); !ok || !opErr.Timeout() {
+		t.Fatal(err)
+	}
+
+	go client.Write(append(pkt[4:], pkt...))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		buf, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, pkt) {
+			t.Fatalf("Mismatch % x vs % x\n", buf, pkt)
+		}
+	}
+}
+
+func TestPacketReaderInvalid(t *testing.T) {
+	//a packet larger than the maximum is refused from its fixed header
+	reader := mqtt.NewPacketReader(bytes.NewReader([]byte{0x30, 0x80, 0x80, 0x01}), 1024)
+	if _, err := reader.ReadPacket(); err == nil {
+		t.Fatal("Packet Exceeding Maximum Packet Size Read")
+	}
+
+	//the remaining length has at most 4 bytes
+	reader = mqtt.NewPacketReader(bytes.NewReader([]byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}), 0)
+	if _, err := reader.ReadPacket(); err == nil {
+		t.Fatal("Remaining Length of 5 Bytes Read")
+	}
+}
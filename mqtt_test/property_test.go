@@ -0,0 +1,106 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"mqtt"
+	"testing"
+)
+
+func TestPacketConnect5(t *testing.T) {
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(5)
+	pktconn.SetConnectFlags(mqtt.CONNECT_FLAG_CLEAN_SESSION | mqtt.CONNECT_FLAG_WILL_FLAG)
+	pktconn.SetClientId("c5")
+	pktconn.SetWillTopic("will")
+	pktconn.SetWillMessage("gone")
+	pktconn.GetProperties().SetInt(mqtt.PROPERTY_SESSION_EXPIRY_INTERVAL, 300)
+	pktconn.GetProperties().SetInt(mqtt.PROPERTY_RECEIVE_MAXIMUM, 10)
+	pktconn.GetProperties().AddUserProperty("k", "v")
+	pktconn.GetProperties().AddUserProperty("k", "w")
+	pktconn.GetWillProperties().SetString(mqtt.PROPERTY_CONTENT_TYPE, "text/plain")
+	input := pktconn.Bytes()
+
+	pkt, err := mqtt.Packetize(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	parsed := pkt.(mqtt.PacketConnect)
+	if parsed.GetProtocolLevel() != 5 || parsed.GetClientId() != "c5" || parsed.GetWillMessage() != "gone" {
+		t.Fatal("Unexpected CONNECT Fields")
+	}
+	properties := parsed.GetProperties()
+	if properties.GetInt(mqtt.PROPERTY_SESSION_EXPIRY_INTERVAL) != 300 || properties.GetInt(mqtt.PROPERTY_RECEIVE_MAXIMUM) != 10 {
+		t.Fatal("Unexpected CONNECT Properties")
+	}
+	if users := properties.GetUserProperties(); len(users) != 2 || users[1].Value != "w" {
+		t.Fatalf("Unexpected User Properties %v\n", users)
+	}
+	if parsed.GetWillProperties().GetString(mqtt.PROPERTY_CONTENT_TYPE) != "text/plain" {
+		t.Fatal("Unexpected Will Properties")
+	}
+	if output := parsed.Bytes(); !bytes.Equal(input, output) {
+		t.Fatalf("Mismatch % x vs % x\n", input, output)
+	}
+
+	//a property other than the user property may not be repeated
+	invalid := []byte{0x10, 0x13, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x00,
+		0x06, 0x21, 0x00, 0x01, 0x21, 0x00, 0x02, 0x00, 0x00}
+	if _, err := mqtt.Packetize(invalid); err == nil {
+		t.Fatal("Duplicate Property Accepted")
+	} else {
+		t.Log(err.Error())
+	}
+}
+
+func TestPacketAuth(t *testing.T) {
+	input := []byte{0xF0, 0x09, 0x18, 0x07, 0x15, 0x00, 0x04, 't', 'e', 's', 't'}
+
+	if _, err := mqtt.Packetize(input); err == nil {
+		t.Fatal("AUTH Accepted before MQTT 5")
+	}
+	pkt, err := mqtt.PacketizeLevel(input, 5)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pktauth := pkt.(mqtt.PacketAuth)
+	if pktauth.GetReasonCode() != mqtt.REASON_CONTINUE_AUTHENTICATION ||
+		pktauth.GetProperties().GetString(mqtt.PROPERTY_AUTHENTICATION_METHOD) != "test" {
+		t.Fatal("Unexpected AUTH Fields")
+	}
+	if output := pktauth.Bytes(); !bytes.Equal(input, output) {
+		t.Fatalf("Mismatch % x vs % x\n", input, output)
+	}
+
+	//a success without properties is sent without reason code
+	success := mqtt.NewPacketAuth()
+	if output := success.Bytes(); !bytes.Equal(output, []byte{0xF0, 0x00}) {
+		t.Fatalf("Unexpected AUTH % x\n", output)
+	}
+}
+
+func TestPacketAcks5(t *testing.T) {
+	inputs := [][]byte{{0x40, 0x03, 0x00, 0x01, 0x87},
+		{0x50, 0x02, 0x00, 0x01},
+		{0xB0, 0x05, 0x00, 0x01, 0x00, 0x00, 0x11},
+		{0x90, 0x05, 0x00, 0x01, 0x00, 0x01, 0x9E},
+		{0x20, 0x03, 0x00, 0x8C, 0x00}}
+	for i := 0; i < len(inputs); i++ {
+		pkt, err := mqtt.PacketizeLevel(inputs[i], 5)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if output := pkt.Bytes(); !bytes.Equal(inputs[i], output) {
+			t.Errorf("Mismatch % x vs % x\n", inputs[i], output)
+		}
+	}
+
+	pkt, _ := mqtt.PacketizeLevel(inputs[4], 5)
+	if pkt.(mqtt.PacketConnack).GetReturnCode() != mqtt.CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED {
+		t.Fatal("Unexpected CONNACK Return Code")
+	}
+	pkt, _ = mqtt.PacketizeLevel(inputs[2], 5)
+	if codes := pkt.(mqtt.PacketUnsuback).GetReasonCodes(); len(codes) != 2 || codes[1] != mqtt.REASON_NO_SUBSCRIPTION_EXISTED {
+		t.Fatalf("Unexpected UNSUBACK Reason Codes %v\n", codes)
+	}
+}
@@ -0,0 +1,1409 @@
+package mqtt_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mqtt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type test_listener struct {
+	provider mqtt.Provider
+
+	retransmitTimer int
+	timeouts        chan mqtt.TimeoutType
+	terminations    chan mqtt.EventSessionTerminated
+	connects        chan mqtt.EventConnect
+}
+
+func (this *test_listener) ProcessConnect(eventConnect mqtt.EventConnect) {
+	if this.retransmitTimer != 0 {
+		eventConnect.GetSession().SetRetransmitTimer(this.retransmitTimer)
+		eventConnect.GetSession().SetMaxRetransmits(2)
+	}
+	if this.connects != nil {
+		this.connects <- eventConnect
+	}
+	pktconnack := mqtt.NewPacketConnack()
+	pktconnack.SetReturnCode(mqtt.CONNACK_RETURNCODE_ACCEPTED)
+	eventConnect.GetSession().AcknowledgeConnect(pktconnack)
+}
+func (this *test_listener) ProcessPublish(eventPublish mqtt.EventPublish) {
+	this.provider.Forward(eventPublish.GetMessage())
+}
+func (this *test_listener) ProcessSubscribe(eventSubscribe mqtt.EventSubscribe) {
+	pktsuback := mqtt.NewPacketSuback()
+	pktsuback.SetPacketId(eventSubscribe.GetPacketId())
+	qos := eventSubscribe.GetQoSs()
+	retCodes := make([]byte, len(qos))
+	for i := 0; i < len(qos); i++ {
+		retCodes[i] = byte(qos[i])
+	}
+	pktsuback.SetReturnCodes(retCodes)
+	eventSubscribe.GetSession().AcknowledgeSubscribe(pktsuback)
+}
+func (this *test_listener) ProcessUnsubscribe(eventUnsubscribe mqtt.EventUnsubscribe) {}
+func (this *test_listener) ProcessTimeout(eventTimeout mqtt.EventTimeout) {
+	if this.timeouts != nil {
+		this.timeouts <- eventTimeout.GetTimeoutType()
+	}
+}
+func (this *test_listener) ProcessIOException(eventIOException mqtt.EventIOException) {}
+func (this *test_listener) ProcessSessionTerminated(eventSessionTerminated mqtt.EventSessionTerminated) {
+	if this.terminations != nil {
+		this.terminations <- eventSessionTerminated
+	}
+	if will := eventSessionTerminated.GetWillMessage(); will != nil {
+		this.provider.Forward(will)
+	}
+}
+
+func startProvider(t *testing.T, port int) mqtt.Provider {
+	return startProviderWithListener(t, port, &test_listener{})
+}
+
+func startProviderWithStore(t *testing.T, port int, store mqtt.Store) mqtt.Provider {
+	return startProviderWith(t, port, &test_listener{}, store)
+}
+
+func startProviderWithListener(t *testing.T, port int, l *test_listener) mqtt.Provider {
+	return startProviderWith(t, port, l, nil)
+}
+
+func startProviderWith(t *testing.T, port int, l *test_listener, store mqtt.Store) mqtt.Provider {
+	p := mqtt.GetStack().CreateProvider()
+	if store != nil {
+		p.SetStore(store)
+	}
+	return runProvider(t, p, port, l)
+}
+
+//runProvider runs a provider configured by the caller
+func runProvider(t *testing.T, p mqtt.Provider, port int, l *test_listener) mqtt.Provider {
+	stack := mqtt.GetStack()
+	p.AddTransport(stack.CreateTransport(mqtt.TCP, "127.0.0.1", port, nil))
+	l.provider = p
+	p.AddListener(l)
+	go p.Run()
+
+	//wait for the transport to listen
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+			conn.Close()
+			return p
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Provider on port %d not listening\n", port)
+	return nil
+}
+
+//stopProvider gives what a test left in flight little time to drain
+func stopProvider(p mqtt.Provider) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	p.Stop(ctx)
+	mqtt.GetStack().DeleteProvider(p)
+}
+
+func readPacket(t *testing.T, conn net.Conn) mqtt.Packet {
+	return readPacketLevel(t, conn, 4)
+}
+
+func readPacketLevel(t *testing.T, conn net.Conn, level byte) mqtt.Packet {
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Reading Packet %s\n", err.Error())
+	}
+	var remainingLength, multiplier uint32 = 0, 1
+	for {
+		var b [1]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			t.Fatalf("Reading Packet %s\n", err.Error())
+		}
+		buf = append(buf, b[0])
+		remainingLength += uint32(b[0]&127) * multiplier
+		if b[0]&128 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	data := make([]byte, remainingLength)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("Reading Packet %s\n", err.Error())
+	}
+
+	pkt, err := mqtt.PacketizeLevel(append(buf, data...), level)
+	if err != nil {
+		t.Fatalf("Parsing Packet %s\n", err.Error())
+	}
+	return pkt
+}
+
+func expectNoPacket(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	var b [1]byte
+	if n, _ := conn.Read(b[:]); n != 0 {
+		t.Fatalf("Unexpected Packet Type %x\n", b[0]>>4)
+	}
+}
+
+func connect(t *testing.T, port int, clientId string, flags byte) (net.Conn, mqtt.PacketConnack) {
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(4)
+	pktconn.SetConnectFlags(flags)
+	pktconn.SetClientId(clientId)
+	return connectWith(t, port, pktconn)
+}
+
+func connectWith(t *testing.T, port int, pktconn mqtt.PacketConnect) (net.Conn, mqtt.PacketConnack) {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Dialing %s\n", err.Error())
+	}
+	conn.Write(pktconn.Bytes())
+
+	pktconnack, ok := readPacketLevel(t, conn, pktconn.GetProtocolLevel()).(mqtt.PacketConnack)
+	if !ok {
+		t.Fatalf("Expected CONNACK\n")
+	}
+	return conn, pktconnack
+}
+
+func subscribe(t *testing.T, conn net.Conn, topics []string, qos []mqtt.QOS) mqtt.PacketSuback {
+	pktsub := mqtt.NewPacketSubscribe()
+	pktsub.SetPacketId(1)
+	pktsub.SetSubscribeTopics(topics)
+	pktsub.SetQoSs(qos)
+	conn.Write(pktsub.Bytes())
+
+	pktsuback, ok := readPacket(t, conn).(mqtt.PacketSuback)
+	if !ok {
+		t.Fatalf("Expected SUBACK\n")
+	}
+	return pktsuback
+}
+
+func disconnect(conn net.Conn) {
+	conn.Write(mqtt.NewPacket(mqtt.PACKET_DISCONNECT).Bytes())
+	conn.Close()
+	//let the provider notice the session termination
+	time.Sleep(1500 * time.Millisecond)
+}
+
+func TestPersistentSession(t *testing.T) {
+	port := 18831
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	conn, pktconnack := connect(t, port, "persistent", 0)
+	if pktconnack.GetSPFlag() {
+		t.Errorf("Session Present for new session\n")
+	}
+	subscribe(t, conn, []string{"persistent/+"}, []mqtt.QOS{mqtt.QOS_ONE})
+	disconnect(conn)
+
+	conn, pktconnack = connect(t, port, "persistent", 0)
+	defer conn.Close()
+	if !pktconnack.GetSPFlag() {
+		t.Fatalf("Session Present not set for resumed session\n")
+	}
+
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "persistent/a", "hello"))
+	pktpub, ok := readPacket(t, conn).(mqtt.PacketPublish)
+	if !ok {
+		t.Fatalf("Expected PUBLISH on resumed subscription\n")
+	}
+	if pktpub.GetMessage().GetContent() != "hello" {
+		t.Errorf("Mismatch content %s\n", pktpub.GetMessage().GetContent())
+	}
+
+	clean, pktconnack := connect(t, port, "persistent2", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer clean.Close()
+	if pktconnack.GetSPFlag() {
+		t.Errorf("Session Present for clean session\n")
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	port := 18832
+	p := startProvider(t, port)
+	defer stopProvider(p)
+	p.SetQueueLimits(2, 0)
+	p.SetQueuePolicy(mqtt.QUEUE_DROP_OLDEST)
+
+	conn, _ := connect(t, port, "offline", 0)
+	subscribe(t, conn, []string{"offline/#"}, []mqtt.QOS{mqtt.QOS_TWO})
+	disconnect(conn)
+
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ZERO, false, "offline/a", "0"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "offline/a", "1"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_TWO, false, "offline/b", "2"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "offline/c", "3"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "other", "4"))
+
+	conn, _ = connect(t, port, "offline", 0)
+	defer conn.Close()
+	for _, content := range []string{"2", "3"} {
+		pktpub, ok := readPacket(t, conn).(mqtt.PacketPublish)
+		if !ok {
+			t.Fatalf("Expected queued PUBLISH\n")
+		}
+		if pktpub.GetMessage().GetContent() != content {
+			t.Errorf("Mismatch content %s vs %s\n", pktpub.GetMessage().GetContent(), content)
+		}
+	}
+	expectNoPacket(t, conn)
+}
+
+func TestOfflineQueueDropNewest(t *testing.T) {
+	port := 18868
+	p := startProvider(t, port)
+	defer stopProvider(p)
+	p.SetQueueLimits(2, 0)
+	p.SetQueuePolicy(mqtt.QUEUE_DROP_NEWEST)
+
+	conn, _ := connect(t, port, "offline", 0)
+	subscribe(t, conn, []string{"offline/#"}, []mqtt.QOS{mqtt.QOS_TWO})
+	disconnect(conn)
+
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "offline/a", "1"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_TWO, false, "offline/b", "2"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "offline/c", "3"))
+
+	conn, _ = connect(t, port, "offline", 0)
+	defer conn.Close()
+	for _, content := range []string{"1", "2"} {
+		pktpub, ok := readPacket(t, conn).(mqtt.PacketPublish)
+		if !ok {
+			t.Fatalf("Expected queued PUBLISH\n")
+		}
+		if pktpub.GetMessage().GetContent() != content {
+			t.Errorf("Mismatch content %s vs %s\n", pktpub.GetMessage().GetContent(), content)
+		}
+	}
+	expectNoPacket(t, conn)
+}
+
+//test_log collects the log output written by the dispatch workers
+type test_log struct {
+	mutex sync.Mutex
+	buf   strings.Builder
+}
+
+func (this *test_log) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.buf.Write(p)
+}
+
+func (this *test_log) Contains(s string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return strings.Contains(this.buf.String(), s)
+}
+
+func TestOfflineQueueReject(t *testing.T) {
+	out := &test_log{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	port := 18869
+	p := startProvider(t, port)
+	defer stopProvider(p)
+	p.SetQueueLimits(2, 0)
+	p.SetQueuePolicy(mqtt.QUEUE_REJECT)
+
+	conn, _ := connect(t, port, "offline", 0)
+	subscribe(t, conn, []string{"offline/#"}, []mqtt.QOS{mqtt.QOS_TWO})
+	disconnect(conn)
+
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "offline/a", "1"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_TWO, false, "offline/b", "2"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "offline/c", "3"))
+
+	conn, _ = connect(t, port, "offline", 0)
+	defer conn.Close()
+	for _, content := range []string{"1", "2"} {
+		pktpub, ok := readPacket(t, conn).(mqtt.PacketPublish)
+		if !ok {
+			t.Fatalf("Expected queued PUBLISH\n")
+		}
+		if pktpub.GetMessage().GetContent() != content {
+			t.Errorf("Mismatch content %s vs %s\n", pktpub.GetMessage().GetContent(), content)
+		}
+	}
+	expectNoPacket(t, conn)
+
+	//the rejected message is reported by the dispatch worker
+	for i := 0; !out.Contains("Message Queue Full"); i++ {
+		if i == 100 {
+			t.Fatalf("Queue Full Not Reported\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedeliveryOnReconnect(t *testing.T) {
+	port := 18833
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	conn, _ := connect(t, port, "redelivery", 0)
+	subscribe(t, conn, []string{"redelivery"}, []mqtt.QOS{mqtt.QOS_TWO})
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "redelivery", "1"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_TWO, false, "redelivery", "2"))
+	first := readPacket(t, conn).(mqtt.PacketPublish)
+	second := readPacket(t, conn).(mqtt.PacketPublish)
+	if first.GetMessage().GetDup() || second.GetMessage().GetDup() {
+		t.Errorf("DUP set on first delivery\n")
+	}
+
+	//acknowledge the QoS 2 message up to PUBREC only
+	pktpubrec := mqtt.NewPacketAcks(mqtt.PACKET_PUBREC)
+	pktpubrec.SetPacketId(second.GetPacketId())
+	conn.Write(pktpubrec.Bytes())
+	if _, ok := readPacket(t, conn).(mqtt.PacketPubrel); !ok {
+		t.Fatalf("Expected PUBREL\n")
+	}
+	disconnect(conn)
+
+	conn, _ = connect(t, port, "redelivery", 0)
+	defer conn.Close()
+	pktpub, ok := readPacket(t, conn).(mqtt.PacketPublish)
+	if !ok || !pktpub.GetMessage().GetDup() || pktpub.GetPacketId() != first.GetPacketId() {
+		t.Fatalf("Expected PUBLISH with DUP for unacknowledged message\n")
+	}
+	pktpubrel, ok := readPacket(t, conn).(mqtt.PacketPubrel)
+	if !ok || pktpubrel.GetPacketId() != second.GetPacketId() {
+		t.Fatalf("Expected PUBREL for released message\n")
+	}
+}
+
+func TestRetransmitTimer(t *testing.T) {
+	port := 18834
+	l := &test_listener{retransmitTimer: 1, timeouts: make(chan mqtt.TimeoutType, 1)}
+	p := startProviderWithListener(t, port, l)
+	defer stopProvider(p)
+
+	conn, _ := connect(t, port, "retransmit", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer conn.Close()
+	subscribe(t, conn, []string{"retransmit"}, []mqtt.QOS{mqtt.QOS_ONE})
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "retransmit", "1"))
+
+	for i := 0; i < 3; i++ {
+		pktpub, ok := readPacket(t, conn).(mqtt.PacketPublish)
+		if !ok || pktpub.GetMessage().GetDup() != (i > 0) {
+			t.Fatalf("Expected PUBLISH with DUP %v\n", i > 0)
+		}
+	}
+
+	select {
+	case timeoutType := <-l.timeouts:
+		if timeoutType != mqtt.TIMEOUT_RETRANSMIT {
+			t.Errorf("Mismatch timeout type %v\n", timeoutType)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Expected TIMEOUT_RETRANSMIT\n")
+	}
+}
+
+func TestRetransmitTimer5(t *testing.T) {
+	port := 18862
+	l := &test_listener{retransmitTimer: 1}
+	p := startProviderWithListener(t, port, l)
+	defer stopProvider(p)
+
+	pktconn := newConnect5("retransmit5", 0)
+	pktconn.GetProperties().SetInt(mqtt.PROPERTY_SESSION_EXPIRY_INTERVAL, 60)
+	conn, _ := connectWith(t, port, pktconn)
+	pktsub := mqtt.NewPacketSubscribe()
+	pktsub.SetPacketId(1)
+	pktsub.SetSubscribeTopics([]string{"retransmit5"})
+	pktsub.SetQoSs([]mqtt.QOS{mqtt.QOS_ONE})
+	write5(conn, pktsub)
+	readPacketLevel(t, conn, 5)
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "retransmit5", "1"))
+	if pktpub, ok := readPacketLevel(t, conn, 5).(mqtt.PacketPublish); !ok || pktpub.GetMessage().GetDup() {
+		t.Fatal("Expected PUBLISH without DUP")
+	}
+
+	//no resend while connected, however long the message is unacknowledged
+	conn.SetReadDeadline(time.Now().Add(2500 * time.Millisecond))
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("Unexpected Retransmission")
+	}
+	conn.Close()
+	time.Sleep(1500 * time.Millisecond)
+
+	//the message is resent with DUP on reconnection with Clean Start=0
+	conn, _ = connectWith(t, port, newConnect5("retransmit5", 0))
+	defer conn.Close()
+	if pktpub, ok := readPacketLevel(t, conn, 5).(mqtt.PacketPublish); !ok || !pktpub.GetMessage().GetDup() {
+		t.Fatal("Expected PUBLISH with DUP")
+	}
+}
+
+func publish(conn net.Conn, packetId uint16, msg mqtt.Message) {
+	conn.Write(msg.Packetize(packetId).Bytes())
+}
+
+func TestQos2ExactlyOnce(t *testing.T) {
+	port := 18835
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	for _, mode := range []mqtt.Qos2Delivery{mqtt.QOS2_DELIVERY_ON_PUBLISH, mqtt.QOS2_DELIVERY_ON_PUBREL} {
+		p.SetQos2Delivery(mode)
+
+		sub, _ := connect(t, port, "qos2sub", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+		subscribe(t, sub, []string{"qos2"}, []mqtt.QOS{mqtt.QOS_ZERO})
+		pub, _ := connect(t, port, "qos2pub", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+
+		publish(pub, 7, mqtt.NewMessage(false, mqtt.QOS_TWO, false, "qos2", "once"))
+		if _, ok := readPacket(t, pub).(mqtt.PacketPubrec); !ok {
+			t.Fatalf("Expected PUBREC\n")
+		}
+		publish(pub, 7, mqtt.NewMessage(true, mqtt.QOS_TWO, false, "qos2", "once"))
+		if _, ok := readPacket(t, pub).(mqtt.PacketPubrec); !ok {
+			t.Fatalf("Expected PUBREC for redelivered PUBLISH\n")
+		}
+
+		if mode == mqtt.QOS2_DELIVERY_ON_PUBLISH {
+			readPacket(t, sub)
+		}
+		expectNoPacket(t, sub)
+
+		pktpubrel := mqtt.NewPacketAcks(mqtt.PACKET_PUBREL)
+		pktpubrel.SetPacketId(7)
+		pub.Write(pktpubrel.Bytes())
+		if _, ok := readPacket(t, pub).(mqtt.PacketPubcomp); !ok {
+			t.Fatalf("Expected PUBCOMP\n")
+		}
+
+		if mode == mqtt.QOS2_DELIVERY_ON_PUBREL {
+			readPacket(t, sub)
+		}
+		expectNoPacket(t, sub)
+
+		pub.Close()
+		sub.Close()
+	}
+}
+
+func TestQosDowngrade(t *testing.T) {
+	port := 18836
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	low, _ := connect(t, port, "downgrade0", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer low.Close()
+	subscribe(t, low, []string{"downgrade"}, []mqtt.QOS{mqtt.QOS_ZERO})
+	high, _ := connect(t, port, "downgrade2", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer high.Close()
+	subscribe(t, high, []string{"downgrade"}, []mqtt.QOS{mqtt.QOS_TWO})
+
+	msg := mqtt.NewMessage(false, mqtt.QOS_ONE, false, "downgrade", "1")
+	p.Forward(msg)
+
+	pktpub := readPacket(t, low).(mqtt.PacketPublish)
+	if pktpub.GetMessage().GetQos() != mqtt.QOS_ZERO || pktpub.GetPacketId() != 0 {
+		t.Errorf("Expected QoS 0 without packet identifier\n")
+	}
+	pktpub = readPacket(t, high).(mqtt.PacketPublish)
+	if pktpub.GetMessage().GetQos() != mqtt.QOS_ONE || pktpub.GetPacketId() == 0 {
+		t.Errorf("Expected QoS 1 with packet identifier\n")
+	}
+	if msg.GetQos() != mqtt.QOS_ONE {
+		t.Errorf("Forwarded message modified\n")
+	}
+}
+
+func TestOverlappingSubscriptions(t *testing.T) {
+	port := 18837
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	topics := []string{"overlap/#", "overlap/+", "overlap/a"}
+	qos := []mqtt.QOS{mqtt.QOS_ZERO, mqtt.QOS_TWO, mqtt.QOS_ONE}
+
+	p.SetOverlapDelivery(mqtt.OVERLAP_DELIVERY_MAX_QOS)
+	conn, _ := connect(t, port, "overlapmax", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	subscribe(t, conn, topics, qos)
+	for i := 0; i < 5; i++ {
+		p.Forward(mqtt.NewMessage(false, mqtt.QOS_TWO, false, "overlap/a", "max"))
+		if pktpub := readPacket(t, conn).(mqtt.PacketPublish); pktpub.GetMessage().GetQos() != mqtt.QOS_TWO {
+			t.Errorf("Expected maximum QoS 2, got %v\n", pktpub.GetMessage().GetQos())
+		}
+	}
+	expectNoPacket(t, conn)
+	conn.Close()
+
+	p.SetOverlapDelivery(mqtt.OVERLAP_DELIVERY_EACH)
+	conn, _ = connect(t, port, "overlapeach", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer conn.Close()
+	subscribe(t, conn, topics, qos)
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_TWO, false, "overlap/a", "each"))
+	received := make(map[mqtt.QOS]int)
+	for i := 0; i < len(topics); i++ {
+		received[readPacket(t, conn).(mqtt.PacketPublish).GetMessage().GetQos()]++
+	}
+	for i := 0; i < len(qos); i++ {
+		if received[qos[i]] != 1 {
+			t.Errorf("Expected one copy with QoS %v, got %d\n", qos[i], received[qos[i]])
+		}
+	}
+	expectNoPacket(t, conn)
+}
+
+func TestRetainedMessages(t *testing.T) {
+	port := 18838
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	existing, _ := connect(t, port, "retainedold", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer existing.Close()
+	subscribe(t, existing, []string{"retained/#"}, []mqtt.QOS{mqtt.QOS_ZERO})
+
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ZERO, true, "retained/a", "a"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ZERO, true, "retained/b", "b"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ZERO, true, "retained/c", "c"))
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ZERO, true, "retained/c", ""))
+	for i := 0; i < 4; i++ {
+		if readPacket(t, existing).(mqtt.PacketPublish).GetMessage().GetRetain() {
+			t.Errorf("RETAIN set for existing subscription\n")
+		}
+	}
+
+	conn, _ := connect(t, port, "retainednew", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer conn.Close()
+	subscribe(t, conn, []string{"retained/a"}, []mqtt.QOS{mqtt.QOS_ONE})
+	pktpub := readPacket(t, conn).(mqtt.PacketPublish)
+	if !pktpub.GetMessage().GetRetain() || pktpub.GetMessage().GetContent() != "a" {
+		t.Errorf("Expected retained message for retained/a\n")
+	}
+	subscribe(t, conn, []string{"retained/c"}, []mqtt.QOS{mqtt.QOS_ONE})
+	expectNoPacket(t, conn)
+
+	if msgs := p.GetRetainedStore().GetRetained("retained/+"); len(msgs) != 2 {
+		t.Errorf("Expected 2 retained messages, got %d\n", len(msgs))
+	}
+	if err := p.SetRetainedStore(mqtt.NewRetainedStore()); err == nil {
+		t.Errorf("Retained Store Replaced after Run\n")
+	}
+}
+
+func TestRetainedExpiry5(t *testing.T) {
+	port := 18866
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	pub, _ := connectWith(t, port, newConnect5("retainedpub5", mqtt.CONNECT_FLAG_CLEAN_SESSION))
+	defer pub.Close()
+	msg := mqtt.NewMessage(false, mqtt.QOS_ONE, true, "retained5", "r")
+	msg.SetProperties(mqtt.NewProperties())
+	msg.GetProperties().SetInt(mqtt.PROPERTY_MESSAGE_EXPIRY_INTERVAL, 1)
+	msg.GetProperties().SetString(mqtt.PROPERTY_CONTENT_TYPE, "text/plain")
+	write5(pub, msg.Packetize(1))
+	readPacketLevel(t, pub, 5)
+
+	subscribe5 := func(clientId string) net.Conn {
+		conn, _ := connectWith(t, port, newConnect5(clientId, mqtt.CONNECT_FLAG_CLEAN_SESSION))
+		pktsub := mqtt.NewPacketSubscribe()
+		pktsub.SetPacketId(1)
+		pktsub.SetSubscribeTopics([]string{"retained5"})
+		pktsub.SetQoSs([]mqtt.QOS{mqtt.QOS_ONE})
+		pktsub.SetOptions([]byte{0})
+		write5(conn, pktsub)
+		readPacketLevel(t, conn, 5)
+		return conn
+	}
+
+	//the retained message keeps its properties
+	conn := subscribe5("retainedsub5")
+	defer conn.Close()
+	pktpub, ok := readPacketLevel(t, conn, 5).(mqtt.PacketPublish)
+	if !ok || !pktpub.GetMessage().GetRetain() ||
+		pktpub.GetMessage().GetProperties().GetString(mqtt.PROPERTY_CONTENT_TYPE) != "text/plain" ||
+		pktpub.GetMessage().GetProperties().GetInt(mqtt.PROPERTY_MESSAGE_EXPIRY_INTERVAL) != 1 {
+		t.Fatal("Expected Retained Message with Properties")
+	}
+
+	//and isn't sent anymore once expired
+	time.Sleep(1100 * time.Millisecond)
+	conn = subscribe5("retainedlate5")
+	defer conn.Close()
+	expectNoPacket(t, conn)
+}
+
+func TestStoreRestart(t *testing.T) {
+	port := 18839
+	path := filepath.Join(t.TempDir(), "mqtt.log")
+
+	store, err := mqtt.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := startProviderWithStore(t, port, store)
+	if err := p.SetStore(mqtt.NewMemoryStore()); err == nil {
+		t.Errorf("Store Replaced after Run\n")
+	}
+	conn, _ := connect(t, port, "restart", 0)
+	subscribe(t, conn, []string{"restart/#"}, []mqtt.QOS{mqtt.QOS_ONE})
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "restart/a", "inflight"))
+	readPacket(t, conn)
+	disconnect(conn)
+	stopProvider(p)
+	store.Close()
+
+	if store, err = mqtt.NewFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	p = startProviderWithStore(t, port, store)
+	defer stopProvider(p)
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "restart/b", "queued"))
+
+	conn, pktconnack := connect(t, port, "restart", 0)
+	defer conn.Close()
+	if !pktconnack.GetSPFlag() {
+		t.Fatalf("Session Present not set after restart\n")
+	}
+	for _, content := range []string{"inflight", "queued"} {
+		pktpub := readPacket(t, conn).(mqtt.PacketPublish)
+		if pktpub.GetMessage().GetContent() != content {
+			t.Errorf("Mismatch content %s vs %s\n", pktpub.GetMessage().GetContent(), content)
+		}
+	}
+}
+
+func TestConcurrentTakeover(t *testing.T) {
+	port := 18864
+	p := startProvider(t, port)
+	defer stopProvider(p)
+
+	conn, _ := connect(t, port, "concurrent", 0)
+	defer conn.Close()
+	subscribe(t, conn, []string{"concurrent/#"}, []mqtt.QOS{mqtt.QOS_ONE})
+
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(4)
+	pktconn.SetClientId("concurrent")
+	conns := []net.Conn{conn}
+	for i := 0; i < 4; i++ {
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	var wg sync.WaitGroup
+	for _, c := range conns[1:] {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			c.Write(pktconn.Bytes())
+		}(c)
+	}
+	wg.Wait()
+
+	//the CONNECTs take each other over, only the last one stays connected
+	time.Sleep(time.Second)
+	var connected []net.Conn
+	for _, c := range conns {
+		c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err := io.Copy(io.Discard, c); err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				connected = append(connected, c)
+			}
+		}
+	}
+	if len(connected) != 1 {
+		t.Fatalf("%d Sessions Connected with the Same Client Identifier\n", len(connected))
+	}
+
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "concurrent/a", "a"))
+	if pktpub, ok := readPacket(t, connected[0]).(mqtt.PacketPublish); !ok || pktpub.GetMessage().GetContent() != "a" {
+		t.Fatal("Expected PUBLISH to the Connected Session")
+	}
+}
+
+func TestStoreRestart5(t *testing.T) {
+	port := 18863
+	path := filepath.Join(t.TempDir(), "mqtt.log")
+
+	connectExpiry := func(clientId string, expiry uint32) (net.Conn, mqtt.PacketConnack) {
+		pktconn := newConnect5(clientId, 0)
+		pktconn.GetProperties().SetInt(mqtt.PROPERTY_SESSION_EXPIRY_INTERVAL, expiry)
+		return connectWith(t, port, pktconn)
+	}
+
+	store, err := mqtt.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := startProviderWithStore(t, port, store)
+	conn, _ := connectExpiry("restart5", 3600)
+	pktsub := mqtt.NewPacketSubscribe()
+	pktsub.SetPacketId(1)
+	pktsub.SetSubscribeTopics([]string{"restart5/#"})
+	pktsub.SetQoSs([]mqtt.QOS{mqtt.QOS_ONE})
+	pktsub.SetOptions([]byte{mqtt.SUBSCRIBE_OPTION_NO_LOCAL})
+	write5(conn, pktsub)
+	readPacketLevel(t, conn, 5)
+	short, _ := connectExpiry("short5", 1)
+	short.Close()
+	disconnect(conn)
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "restart5/a", "queued"))
+	stopProvider(p)
+	store.Close()
+
+	if store, err = mqtt.NewFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	p = startProviderWithStore(t, port, store)
+	defer stopProvider(p)
+
+	//the offline queue is kept over the restart
+	conn, pktconnack := connectExpiry("restart5", 3600)
+	defer conn.Close()
+	if !pktconnack.GetSPFlag() {
+		t.Fatalf("Session Present not set after restart\n")
+	}
+	pktpub, ok := readPacketLevel(t, conn, 5).(mqtt.PacketPublish)
+	if !ok || pktpub.GetMessage().GetContent() != "queued" {
+		t.Fatal("Expected queued message after restart")
+	}
+	pktpuback := mqtt.NewPacketAcks(mqtt.PACKET_PUBACK)
+	pktpuback.SetPacketId(pktpub.GetPacketId())
+	write5(conn, pktpuback)
+
+	//so are the subscription options
+	write5(conn, mqtt.NewMessage(false, mqtt.QOS_ONE, false, "restart5/self", "me").Packetize(1))
+	if pkt := readPacketLevel(t, conn, 5); pkt.GetType() != mqtt.PACKET_PUBACK {
+		t.Fatal("Expected PUBACK")
+	}
+	expectNoPacket(t, conn)
+
+	//and the session expiry interval, which elapsed before the next check
+	time.Sleep(time.Second)
+	short, pktconnack = connectExpiry("short5", 0)
+	short.Close()
+	if pktconnack.GetSPFlag() {
+		t.Fatal("Session Kept after Expiry Interval")
+	}
+}
+
+func TestSessionTakeover(t *testing.T) {
+	l := &test_listener{terminations: make(chan mqtt.EventSessionTerminated, 4)}
+	p := startProviderWithListener(t, 18850, l)
+	defer stopProvider(p)
+
+	watcher, _ := connect(t, 18850, "watcher", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer watcher.Close()
+	subscribe(t, watcher, []string{"will/#"}, []mqtt.QOS{mqtt.QOS_ONE})
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(18850)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(4)
+	pktconn.SetConnectFlags(mqtt.CONNECT_FLAG_CLEAN_SESSION | mqtt.CONNECT_FLAG_WILL_FLAG)
+	pktconn.SetClientId("dup")
+	pktconn.SetWillTopic("will/dup")
+	pktconn.SetWillMessage("taken over")
+	conn.Write(pktconn.Bytes())
+	if pktconnack := readPacket(t, conn).(mqtt.PacketConnack); pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED {
+		t.Fatal("First Connection Refused")
+	}
+
+	//the second CONNECT closes the first connection and publishes its will
+	conn2, pktconnack := connect(t, 18850, "dup", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer conn2.Close()
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED {
+		t.Fatal("Second Connection Refused")
+	}
+
+	for terminated := false; !terminated; {
+		select {
+		case evt := <-l.terminations:
+			if evt.GetSession().GetClientId() != "dup" {
+				continue
+			}
+			if evt.GetReason() != "Session Taken Over\n" || evt.GetWillMessage() == nil {
+				t.Fatalf("Unexpected Termination %q\n", evt.GetReason())
+			}
+			terminated = true
+		case <-time.After(3 * time.Second):
+			t.Fatal("Taken Over Session Not Terminated")
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var b [1]byte
+	if _, err := conn.Read(b[:]); err == nil {
+		t.Fatal("Taken Over Connection Still Open")
+	}
+
+	pktpub, ok := readPacket(t, watcher).(mqtt.PacketPublish)
+	if !ok || pktpub.GetMessage().GetTopic() != "will/dup" {
+		t.Fatal("Will Not Published on Takeover")
+	}
+
+	//the new connection is served
+	subscribe(t, conn2, []string{"a"}, []mqtt.QOS{mqtt.QOS_ZERO})
+}
+
+func TestAssignedClientId(t *testing.T) {
+	l := &test_listener{connects: make(chan mqtt.EventConnect, 4)}
+	p := startProviderWithListener(t, 18851, l)
+	defer stopProvider(p)
+	p.SetClientIdPrefix("anon-")
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		conn, pktconnack := connect(t, 18851, "", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+		defer conn.Close()
+		if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED {
+			t.Fatal("Zero-length Client Identifier Refused")
+		}
+
+		evt := <-l.connects
+		clientId := evt.GetSession().GetClientId()
+		if !strings.HasPrefix(clientId, "anon-") || evt.GetClientId() != clientId {
+			t.Fatalf("Unexpected Assigned Client Identifier %q\n", clientId)
+		}
+		ids[clientId] = true
+	}
+	if len(ids) != 2 {
+		t.Fatal("Assigned Client Identifiers Not Unique")
+	}
+}
+
+func TestSessionMetadata(t *testing.T) {
+	l := &test_listener{connects: make(chan mqtt.EventConnect, 4)}
+	p := startProviderWithListener(t, 18852, l)
+	defer stopProvider(p)
+
+	before := time.Now()
+	conn, _ := connect(t, 18852, "meta", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer conn.Close()
+	subscribe(t, conn, []string{"a/+", "b/#"}, []mqtt.QOS{mqtt.QOS_ZERO, mqtt.QOS_ONE})
+
+	s := (<-l.connects).GetSession()
+	if s.GetClientId() != "meta" || s.GetProtocolLevel() != 4 {
+		t.Fatal("Unexpected Client Identifier or Protocol Level")
+	}
+	if s.GetRemoteAddr() == nil || s.GetRemoteAddr().String() != conn.LocalAddr().String() {
+		t.Fatal("Unexpected Remote Address")
+	}
+	if s.GetConnectTime().Before(before) || s.GetConnectTime().After(time.Now()) {
+		t.Fatal("Unexpected Connect Time")
+	}
+	subs := s.GetSubscriptions()
+	if len(subs) != 2 || subs["a/+"] != mqtt.QOS_ZERO || subs["b/#"] != mqtt.QOS_ONE {
+		t.Fatalf("Unexpected Subscriptions %v\n", subs)
+	}
+}
+
+func newConnect5(clientId string, flags byte) mqtt.PacketConnect {
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(5)
+	pktconn.SetConnectFlags(flags)
+	pktconn.SetClientId(clientId)
+	return pktconn
+}
+
+func write5(conn net.Conn, pkt mqtt.Packet) {
+	pkt.SetProtocolLevel(5)
+	conn.Write(pkt.Bytes())
+}
+
+func TestMqtt5(t *testing.T) {
+	p := startProvider(t, 18853)
+	defer stopProvider(p)
+
+	//a zero-length client identifier is assigned and returned in CONNACK
+	pktconn := newConnect5("", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	pktconn.GetProperties().SetInt(mqtt.PROPERTY_RECEIVE_MAXIMUM, 1)
+	sub, pktconnack := connectWith(t, 18853, pktconn)
+	defer sub.Close()
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED ||
+		!strings.HasPrefix(pktconnack.GetProperties().GetString(mqtt.PROPERTY_ASSIGNED_CLIENT_IDENTIFIER), mqtt.CLIENT_ID_PREFIX) {
+		t.Fatal("Unexpected CONNACK")
+	}
+
+	pktsub := mqtt.NewPacketSubscribe()
+	pktsub.SetPacketId(1)
+	pktsub.SetSubscribeTopics([]string{"self", "r", "$share/g/r"})
+	pktsub.SetQoSs([]mqtt.QOS{mqtt.QOS_ONE, mqtt.QOS_ONE, mqtt.QOS_ONE})
+	pktsub.SetOptions([]byte{mqtt.SUBSCRIBE_OPTION_NO_LOCAL, 0, 0})
+	write5(sub, pktsub)
+	codes := readPacketLevel(t, sub, 5).(mqtt.PacketSuback).GetReturnCodes()
+	if len(codes) != 3 || codes[0] != 1 || codes[1] != 1 || codes[2] != byte(mqtt.REASON_SHARED_SUBSCRIPTIONS_NOT_SUPPORTED) {
+		t.Fatalf("Unexpected SUBACK Reason Codes %v\n", codes)
+	}
+
+	//No Local subscriptions don't receive the client's own messages
+	write5(sub, mqtt.NewMessage(false, mqtt.QOS_ONE, false, "self", "me").Packetize(1))
+	if pkt := readPacketLevel(t, sub, 5); pkt.GetType() != mqtt.PACKET_PUBACK {
+		t.Fatal("Expected PUBACK")
+	}
+	expectNoPacket(t, sub)
+
+	pub, _ := connectWith(t, 18853, newConnect5("pub5", mqtt.CONNECT_FLAG_CLEAN_SESSION))
+	defer pub.Close()
+	for i := 1; i <= 2; i++ {
+		msg := mqtt.NewMessage(false, mqtt.QOS_ONE, false, "r", strconv.Itoa(i))
+		msg.SetProperties(mqtt.NewProperties())
+		msg.GetProperties().SetInt(mqtt.PROPERTY_MESSAGE_EXPIRY_INTERVAL, 60)
+		write5(pub, msg.Packetize(uint16(i)))
+		readPacketLevel(t, pub, 5)
+	}
+
+	//the receive maximum of 1 holds the second message until the first is
+	//acknowledged, and the expiry interval sent is what remains of it
+	pktpub := readPacketLevel(t, sub, 5).(mqtt.PacketPublish)
+	if pktpub.GetMessage().GetContent() != "1" {
+		t.Fatal("Unexpected First Message")
+	}
+	if expiry := pktpub.GetMessage().GetProperties().GetInt(mqtt.PROPERTY_MESSAGE_EXPIRY_INTERVAL); expiry == 0 || expiry > 60 {
+		t.Fatalf("Unexpected Message Expiry Interval %d\n", expiry)
+	}
+	expectNoPacket(t, sub)
+	pktpuback := mqtt.NewPacketAcks(mqtt.PACKET_PUBACK)
+	pktpuback.SetPacketId(pktpub.GetPacketId())
+	write5(sub, pktpuback)
+	if pktpub := readPacketLevel(t, sub, 5).(mqtt.PacketPublish); pktpub.GetMessage().GetContent() != "2" {
+		t.Fatal("Unexpected Second Message")
+	}
+
+	//UNSUBACK carries a reason code per topic filter
+	pktunsub := mqtt.NewPacketUnsubscribe()
+	pktunsub.SetPacketId(2)
+	pktunsub.SetUnsubscribeTopics([]string{"r", "none"})
+	write5(sub, pktunsub)
+	reasonCodes := readPacketLevel(t, sub, 5).(mqtt.PacketUnsuback).GetReasonCodes()
+	if len(reasonCodes) != 2 || reasonCodes[0] != mqtt.REASON_SUCCESS || reasonCodes[1] != mqtt.REASON_NO_SUBSCRIPTION_EXISTED {
+		t.Fatalf("Unexpected UNSUBACK Reason Codes %v\n", reasonCodes)
+	}
+
+	//no topic alias is available, using one is answered with DISCONNECT
+	msg := mqtt.NewMessage(false, mqtt.QOS_ZERO, false, "t", "alias")
+	msg.SetProperties(mqtt.NewProperties())
+	msg.GetProperties().SetInt(mqtt.PROPERTY_TOPIC_ALIAS, 1)
+	write5(pub, msg.Packetize(0))
+	if pktdisconnect, ok := readPacketLevel(t, pub, 5).(mqtt.PacketDisconnect); !ok || pktdisconnect.GetReasonCode() != mqtt.REASON_TOPIC_ALIAS_INVALID {
+		t.Fatal("Expected DISCONNECT Topic Alias Invalid")
+	}
+}
+
+func newConnect31(clientId string) mqtt.PacketConnect {
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQIsdp")
+	pktconn.SetProtocolLevel(3)
+	pktconn.SetConnectFlags(mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	pktconn.SetClientId(clientId)
+	return pktconn
+}
+
+type deny_authorizer struct{}
+
+func (this *deny_authorizer) Authorize(s mqtt.Session, topic string, access mqtt.AclAccess) bool {
+	return topic != "denied"
+}
+
+func TestMqtt31(t *testing.T) {
+	l := &test_listener{connects: make(chan mqtt.EventConnect, 4)}
+	p := startProviderWithListener(t, 18854, l)
+	defer stopProvider(p)
+	p.SetAuthorizer(&deny_authorizer{})
+
+	//MQTT 3.1 client identifiers have at most 23 characters
+	conn, pktconnack := connectWith(t, 18854, newConnect31(strings.Repeat("x", 24)))
+	conn.Close()
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_REFUSED_IDENTIFIER_REJECTED {
+		t.Fatal("Client Identifier of 24 Characters Accepted")
+	}
+
+	//the protocol name of MQTT 3.1 is MQIsdp
+	pktconn := newConnect31("c31")
+	pktconn.SetProtocolName("MQTT")
+	conn, pktconnack = connectWith(t, 18854, pktconn)
+	conn.Close()
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_REFUSED_UNACCEPTABLE_PROTOCOL_VERSION {
+		t.Fatal("Protocol Level 3 Accepted with Protocol Name MQTT")
+	}
+
+	conn, pktconnack = connectWith(t, 18854, newConnect31("c31"))
+	defer conn.Close()
+	if pktconnack.GetReturnCode() != mqtt.CONNACK_RETURNCODE_ACCEPTED {
+		t.Fatal("MQTT 3.1 Refused")
+	}
+	s := (<-l.connects).GetSession()
+	if s.GetProtocolLevel() != 3 {
+		t.Fatalf("Unexpected Protocol Level %d\n", s.GetProtocolLevel())
+	}
+
+	//MQTT 3.1 has no failure return code, a refused subscription is
+	//acknowledged with QoS 0 but not added
+	codes := subscribe(t, conn, []string{"denied", "a"}, []mqtt.QOS{mqtt.QOS_ONE, mqtt.QOS_ONE}).GetReturnCodes()
+	if len(codes) != 2 || codes[0] != 0 || codes[1] != 1 {
+		t.Fatalf("Unexpected SUBACK Return Codes %v\n", codes)
+	}
+	if subs := s.GetSubscriptions(); len(subs) != 1 {
+		t.Fatalf("Unexpected Subscriptions %v\n", subs)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	p := startProvider(t, 18855)
+	defer stopProvider(p)
+
+	connectExpiry := func(flags byte, expiry uint32) mqtt.PacketConnack {
+		pktconn := newConnect5("expiry", flags)
+		pktconn.GetProperties().SetInt(mqtt.PROPERTY_SESSION_EXPIRY_INTERVAL, expiry)
+		conn, pktconnack := connectWith(t, 18855, pktconn)
+		disconnect(conn)
+		return pktconnack
+	}
+
+	//Clean Start discards the previous session, the session expiry interval
+	//keeps this one
+	connectExpiry(mqtt.CONNECT_FLAG_CLEAN_SESSION, 60)
+	if !connectExpiry(0, 1).GetSPFlag() {
+		t.Fatal("Session Not Kept within Expiry Interval")
+	}
+
+	//the session is forgotten once its expiry interval elapsed
+	time.Sleep(time.Second)
+	if connectExpiry(0, 0).GetSPFlag() {
+		t.Fatal("Session Kept after Expiry Interval")
+	}
+
+	//a session expiry interval of 0 ends the session with the connection
+	if connectExpiry(0, 0).GetSPFlag() {
+		t.Fatal("Session Kept with Expiry Interval 0")
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	p := startProvider(t, 18857)
+	defer stopProvider(p)
+	p.SetMaxPacketSize(256)
+
+	//the maximum packet size is announced to MQTT 5 clients
+	conn, pktconnack := connectWith(t, 18857, newConnect5("large", mqtt.CONNECT_FLAG_CLEAN_SESSION))
+	defer conn.Close()
+	if pktconnack.GetProperties().GetInt(mqtt.PROPERTY_MAXIMUM_PACKET_SIZE) != 256 {
+		t.Fatal("Maximum Packet Size Not Announced")
+	}
+
+	write5(conn, mqtt.NewMessage(false, mqtt.QOS_ZERO, false, "a", strings.Repeat("x", 300)).Packetize(0))
+	if pktdisconnect, ok := readPacketLevel(t, conn, 5).(mqtt.PacketDisconnect); !ok || pktdisconnect.GetReasonCode() != mqtt.REASON_PACKET_TOO_LARGE {
+		t.Fatal("Expected DISCONNECT Packet Too Large")
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Connection Not Closed")
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	l := &test_listener{terminations: make(chan mqtt.EventSessionTerminated, 8)}
+	p := startProviderWithListener(t, 18858, l)
+	defer stopProvider(p)
+	p.SetOutboundQueueSize(4)
+
+	//neither subscriber reads, one is sent QoS 0 messages which are dropped,
+	//the other QoS 1 messages which end its session once its queue is full
+	slow0, _ := connect(t, 18858, "slow0", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer slow0.Close()
+	subscribe(t, slow0, []string{"s"}, []mqtt.QOS{mqtt.QOS_ZERO})
+	slow1, _ := connect(t, 18858, "slow1", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer slow1.Close()
+	subscribe(t, slow1, []string{"s"}, []mqtt.QOS{mqtt.QOS_ONE})
+
+	//the publisher isn't held up by them
+	pub, _ := connect(t, 18858, "fast", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer pub.Close()
+	payload := strings.Repeat("x", 256*1024)
+	for i := 1; i <= 64; i++ {
+		publish(pub, uint16(i), mqtt.NewMessage(false, mqtt.QOS_ONE, false, "s", payload))
+		if _, ok := readPacket(t, pub).(mqtt.PacketPuback); !ok {
+			t.Fatal("Expected PUBACK")
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case evt := <-l.terminations:
+			if evt.GetSession().GetClientId() == "slow0" {
+				t.Fatalf("QoS 0 Subscriber Terminated %s\n", evt.GetReason())
+			}
+			if evt.GetSession().GetClientId() == "slow1" {
+				if evt.GetReason() != "Outbound Queue Overflow\n" {
+					t.Fatalf("Unexpected Termination Reason %s\n", evt.GetReason())
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("Slow Consumer Not Disconnected")
+		}
+	}
+}
+
+func TestDispatchWorkers(t *testing.T) {
+	port := 18859
+	p := mqtt.GetStack().CreateProvider()
+	if err := p.SetDispatchWorkers(4); err != nil || p.GetDispatchWorkers() != 4 {
+		t.Fatalf("Unexpected Dispatch Workers %d\n", p.GetDispatchWorkers())
+	}
+	runProvider(t, p, port, &test_listener{})
+	defer stopProvider(p)
+
+	//the sessions keep their worker, which can't change once running
+	if err := p.SetDispatchWorkers(1); err == nil || p.GetDispatchWorkers() != 4 {
+		t.Fatal("Dispatch Workers Changed after Run")
+	}
+
+	//the subscribers are shared by the workers, each receives the messages
+	//in the order they were published
+	subs := make([]net.Conn, 6)
+	for i := range subs {
+		subs[i], _ = connect(t, port, fmt.Sprintf("worker%d", i), mqtt.CONNECT_FLAG_CLEAN_SESSION)
+		defer subs[i].Close()
+		subscribe(t, subs[i], []string{"order/#"}, []mqtt.QOS{mqtt.QOS_ONE})
+	}
+
+	pub, _ := connect(t, port, "orderer", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer pub.Close()
+	for i := 1; i <= 50; i++ {
+		publish(pub, uint16(i), mqtt.NewMessage(false, mqtt.QOS_ONE, false, "order/"+strconv.Itoa(i%3), strconv.Itoa(i)))
+		if _, ok := readPacket(t, pub).(mqtt.PacketPuback); !ok {
+			t.Fatal("Expected PUBACK")
+		}
+	}
+
+	for i, sub := range subs {
+		for j := 1; j <= 50; j++ {
+			pktpub, ok := readPacket(t, sub).(mqtt.PacketPublish)
+			if !ok {
+				t.Fatal("Expected PUBLISH")
+			}
+			if content := pktpub.GetMessage().GetContent(); content != strconv.Itoa(j) {
+				t.Fatalf("Subscriber %d Received %s instead of %d\n", i, content, j)
+			}
+		}
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	port := 18860
+	p := startProvider(t, port)
+	defer mqtt.GetStack().DeleteProvider(p)
+
+	sub, _ := connectWith(t, port, newConnect5("drain", mqtt.CONNECT_FLAG_CLEAN_SESSION))
+	defer sub.Close()
+	pktsub := mqtt.NewPacketSubscribe()
+	pktsub.SetPacketId(1)
+	pktsub.SetSubscribeTopics([]string{"drain"})
+	pktsub.SetQoSs([]mqtt.QOS{mqtt.QOS_ONE})
+	write5(sub, pktsub)
+	readPacketLevel(t, sub, 5)
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "drain", "inflight"))
+	pktpub := readPacketLevel(t, sub, 5).(mqtt.PacketPublish)
+
+	stopped := make(chan error)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		stopped <- p.Stop(ctx)
+	}()
+
+	//no more connections are accepted while the message is in flight
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i == 100 {
+			t.Fatal("Connection Accepted while Stopping")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stopped before PUBACK %v\n", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	pktpuback := mqtt.NewPacketAcks(mqtt.PACKET_PUBACK)
+	pktpuback.SetPacketId(pktpub.GetPacketId())
+	write5(sub, pktpuback)
+	if pktdisconnect, ok := readPacketLevel(t, sub, 5).(mqtt.PacketDisconnect); !ok || pktdisconnect.GetReasonCode() != mqtt.REASON_SERVER_SHUTTING_DOWN {
+		t.Fatal("Expected DISCONNECT Server Shutting Down")
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Unexpected Stop Error %v\n", err)
+	}
+	//stopping again returns the result of the first Stop
+	if err := p.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected Second Stop Error %v\n", err)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	port := 18861
+	p := startProvider(t, port)
+	defer mqtt.GetStack().DeleteProvider(p)
+
+	sub, _ := connect(t, port, "abandoned", mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	defer sub.Close()
+	subscribe(t, sub, []string{"abandoned"}, []mqtt.QOS{mqtt.QOS_ONE})
+	p.Forward(mqtt.NewMessage(false, mqtt.QOS_ONE, false, "abandoned", "never acknowledged"))
+	readPacket(t, sub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := p.Stop(ctx)
+	shutdownErr, ok := err.(*mqtt.ShutdownError)
+	if !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Unexpected Stop Error %v\n", err)
+	}
+	if len(shutdownErr.Inflights) != 1 || shutdownErr.Inflights["abandoned"] != 1 {
+		t.Fatalf("Unexpected Abandoned Inflights %v\n", shutdownErr.Inflights)
+	}
+	if again := p.Stop(context.Background()); again != err {
+		t.Fatalf("Unexpected Second Stop Error %v\n", again)
+	}
+
+	//the connection is closed once the provider stopped
+	sub.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := sub.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected EOF %v\n", err)
+	}
+}
+
+const BENCH_SUBSCRIBERS = 10000
+
+func benchConnect(b *testing.B, tr mqtt.Transport, clientId string) (net.Conn, mqtt.PacketReader) {
+	conn, err := tr.Dial()
+	if err != nil {
+		b.Fatal(err)
+	}
+	reader := mqtt.NewPacketReader(conn, 0)
+
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(4)
+	pktconn.SetConnectFlags(mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	pktconn.SetClientId(clientId)
+	conn.Write(pktconn.Bytes())
+	if buf, err := reader.ReadPacket(); err != nil || mqtt.PacketType(buf[0]>>4) != mqtt.PACKET_CONNACK {
+		b.Fatalf("Expected CONNACK %v\n", err)
+	}
+	return conn, reader
+}
+
+//BenchmarkForward publishes QoS 1 messages to BENCH_SUBSCRIBERS sessions
+//subscribed with QoS 0 over the pipe transport. ns/publish is how long the
+//publisher waits for each PUBACK, deliveries/s counts the PUBLISH packets
+//read by all subscribers
+func BenchmarkForward(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	stack := mqtt.GetStack()
+	p := stack.CreateProvider()
+	tr := stack.CreateTransport(mqtt.PIPE, "bench", 1883, nil)
+	defer stack.DeleteTransport(tr)
+	p.AddTransport(tr)
+	p.AddListener(&test_listener{provider: p})
+	//bounds the memory taken by the outbound queues
+	p.SetOutboundQueueSize(256)
+	go p.Run()
+	defer stopProvider(p)
+
+	for i := 0; i < 100; i++ {
+		if conn, err := tr.Dial(); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var delivered int64
+	for i := 0; i < BENCH_SUBSCRIBERS; i++ {
+		conn, reader := benchConnect(b, tr, fmt.Sprintf("bench%d", i))
+		defer conn.Close()
+		pktsub := mqtt.NewPacketSubscribe()
+		pktsub.SetPacketId(1)
+		pktsub.SetSubscribeTopics([]string{"bench/+"})
+		pktsub.SetQoSs([]mqtt.QOS{mqtt.QOS_ZERO})
+		conn.Write(pktsub.Bytes())
+		if buf, err := reader.ReadPacket(); err != nil || mqtt.PacketType(buf[0]>>4) != mqtt.PACKET_SUBACK {
+			b.Fatalf("Expected SUBACK %v\n", err)
+		}
+		go func() {
+			for {
+				buf, err := reader.ReadPacket()
+				if err != nil {
+					return
+				}
+				if mqtt.PacketType(buf[0]>>4) == mqtt.PACKET_PUBLISH {
+					atomic.AddInt64(&delivered, 1)
+				}
+			}
+		}()
+	}
+
+	pub, reader := benchConnect(b, tr, "publisher")
+	defer pub.Close()
+	msg := mqtt.NewMessage(false, mqtt.QOS_ONE, false, "bench/topic", strings.Repeat("x", 64))
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		publish(pub, uint16(n%0xFFFF+1), msg)
+		if buf, err := reader.ReadPacket(); err != nil || mqtt.PacketType(buf[0]>>4) != mqtt.PACKET_PUBACK {
+			b.Fatalf("Expected PUBACK %v\n", err)
+		}
+	}
+	published := b.Elapsed()
+
+	expected := int64(b.N) * BENCH_SUBSCRIBERS
+	deadline := time.Now().Add(time.Minute)
+	for atomic.LoadInt64(&delivered) < expected {
+		if time.Now().After(deadline) {
+			b.Fatalf("Delivered %d of %d\n", atomic.LoadInt64(&delivered), expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(published.Nanoseconds())/float64(b.N), "ns/publish")
+	b.ReportMetric(float64(expected)/b.Elapsed().Seconds(), "deliveries/s")
+}
@@ -0,0 +1,136 @@
+package mqtt_test
+
+import (
+	"fmt"
+	"mqtt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.log")
+
+	store, err := mqtt.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnectTime := time.Unix(1700000000, 0)
+	store.SaveSession("a", mqtt.SESSION_EXPIRY_NEVER, time.Time{})
+	store.SaveSession("b", 0, time.Time{})
+	store.SaveSubscription("a", "x/#", mqtt.QOS_ONE, mqtt.SUBSCRIBE_OPTION_NO_LOCAL)
+	store.SaveSubscription("a", "y", mqtt.QOS_TWO, 0)
+	store.DeleteSubscription("a", "y")
+	store.SaveInflight("a", 1, mqtt.NewMessage(false, mqtt.QOS_ONE, false, "x/1", "\x00\xff"))
+	store.SaveInflight("a", 2, nil)
+	store.DeleteSession("b")
+	store.SaveSession("a", 60, disconnectTime)
+
+	msg := mqtt.NewMessage(false, mqtt.QOS_TWO, false, "x/3", "3")
+	msg.SetProperties(mqtt.NewProperties())
+	msg.GetProperties().SetString(mqtt.PROPERTY_CONTENT_TYPE, "text/plain")
+	msg.SetExpiry(disconnectTime.Add(time.Hour))
+	store.PushQueued("a", mqtt.NewMessage(false, mqtt.QOS_ONE, false, "x/2", "2"))
+	store.PushQueued("a", msg)
+	store.PushQueued("b", msg)
+	store.PopQueued("a")
+	store.SaveRetained(mqtt.NewMessage(false, mqtt.QOS_ZERO, true, "$SYS/r", "r"))
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if store, err = mqtt.NewFileStore(path); err != nil {
+			t.Fatal(err)
+		}
+		if sessions := store.GetSessions(); len(sessions) != 1 || sessions[0] != "a" {
+			t.Errorf("Mismatch sessions %v\n", sessions)
+		}
+		if expiryInterval, t0 := store.GetSession("a"); expiryInterval != 60 || !t0.Equal(disconnectTime) {
+			t.Errorf("Mismatch session %d %v\n", expiryInterval, t0)
+		}
+		if subs := store.GetSubscriptions("a"); len(subs) != 1 || subs["x/#"] != mqtt.QOS_ONE {
+			t.Errorf("Mismatch subscriptions %v\n", subs)
+		}
+		if options := store.GetSubscriptionOptions("a"); options["x/#"] != mqtt.SUBSCRIBE_OPTION_NO_LOCAL {
+			t.Errorf("Mismatch subscription options %v\n", options)
+		}
+		queued := store.GetQueued("a")
+		if len(queued) != 1 || queued[0].GetContent() != "3" || queued[0].GetQos() != mqtt.QOS_TWO ||
+			queued[0].GetProperties().GetString(mqtt.PROPERTY_CONTENT_TYPE) != "text/plain" ||
+			!queued[0].GetExpiry().Equal(disconnectTime.Add(time.Hour)) {
+			t.Errorf("Mismatch queued %v\n", queued)
+		}
+		if queued := store.GetQueued("b"); len(queued) != 0 {
+			t.Errorf("Mismatch queued %v\n", queued)
+		}
+		inflights := store.GetInflights("a")
+		if len(inflights) != 2 || inflights[2] != nil || inflights[1].GetContent() != "\x00\xff" {
+			t.Errorf("Mismatch inflights %v\n", inflights)
+		}
+		if msgs := store.GetRetained("$SYS/+"); len(msgs) != 1 || msgs[0].GetContent() != "r" {
+			t.Errorf("Mismatch retained %v\n", msgs)
+		}
+		store.Close()
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.log")
+
+	store, err := mqtt.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SaveSession("c", mqtt.SESSION_EXPIRY_NEVER, time.Time{})
+	for i := 0; i < 10*mqtt.STORE_COMPACT_MIN; i++ {
+		store.SaveInflight("c", uint16(i%100+1), mqtt.NewMessage(false, mqtt.QOS_ONE, false, "t", fmt.Sprint(i)))
+		store.DeleteInflight("c", uint16(i%100+1))
+	}
+	store.SaveInflight("c", 7, mqtt.NewMessage(false, mqtt.QOS_ONE, false, "t", "last"))
+	store.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Size() > 1024*1024 {
+		t.Errorf("Log not compacted\n")
+	}
+	if store, err = mqtt.NewFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if inflights := store.GetInflights("c"); len(inflights) != 1 || inflights[7].GetContent() != "last" {
+		t.Errorf("Mismatch inflights %v\n", inflights)
+	}
+}
+
+func TestRetainedStoreMatch(t *testing.T) {
+	store := mqtt.NewRetainedStore()
+	for _, topic := range []string{"sport", "sport/tennis", "a", "b", "$SYS/a"} {
+		store.SaveRetained(mqtt.NewMessage(false, mqtt.QOS_ZERO, true, topic, topic))
+	}
+
+	//the filters match the same topics as in the topic tree
+	cases := map[string][]string{
+		"+/#":       {"sport", "sport/tennis", "a", "b"},
+		"sport/+/#": {"sport/tennis"},
+		"sport/#":   {"sport", "sport/tennis"},
+		"a/#":       {"a"},
+		"+":         {"sport", "a", "b"},
+		"#":         {"sport", "sport/tennis", "a", "b"},
+		"$SYS/#":    {"$SYS/a"},
+	}
+	for filter, expected := range cases {
+		msgs := store.GetRetained(filter)
+		topics := make([]string, len(msgs))
+		for i, msg := range msgs {
+			topics[i] = msg.GetTopic()
+		}
+		sort.Strings(topics)
+		sort.Strings(expected)
+		if strings.Join(topics, ",") != strings.Join(expected, ",") {
+			t.Errorf("Retained %v for %s instead of %v\n", topics, filter, expected)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package mqtt_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"mqtt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//newTestCertificate issues a certificate for cn, signed by parent or self-signed
+func newTestCertificate(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{cn + ".example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func selfSignedConfig(t *testing.T) *tls.Config {
+	cert := newTestCertificate(t, "127.0.0.1", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}
+}
+
+type cert_listener struct {
+	test_listener
+
+	commonNames chan string
+}
+
+// the client id is mapped from the certificate CN
+func (this *cert_listener) ProcessConnect(eventConnect mqtt.EventConnect) {
+	s := eventConnect.GetSession()
+	cert := s.GetPeerCertificate()
+	if cert == nil || cert.Subject.CommonName != eventConnect.GetClientId() {
+		pktconnack := mqtt.NewPacketConnack()
+		pktconnack.SetReturnCode(mqtt.CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED)
+		s.AcknowledgeConnect(pktconnack)
+		return
+	}
+	this.commonNames <- cert.Subject.CommonName
+	this.test_listener.ProcessConnect(eventConnect)
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	stack := mqtt.GetStack()
+	p := stack.CreateProvider()
+	p.AddTransport(stack.CreateTransport(mqtt.TLS, "127.0.0.1", 18847, &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "127.0.0.1", &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert}))
+	l := &cert_listener{commonNames: make(chan string, 1)}
+	l.provider = p
+	p.AddListener(l)
+	go p.Run()
+	defer stopProvider(p)
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(18847))); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	alice := newTestCertificate(t, "alice", &ca)
+	connect := func(clientId string, certs []tls.Certificate) error {
+		c := stack.CreateClient(stack.CreateTransport(mqtt.TLS, "127.0.0.1", 18847, &tls.Config{RootCAs: pool, Certificates: certs}), clientId)
+		defer stack.DeleteClient(c)
+		c.SetTimeout(3)
+		if err := c.Connect(); err != nil {
+			return err
+		}
+		return c.Disconnect()
+	}
+
+	if err := connect("alice", []tls.Certificate{alice}); err != nil {
+		t.Fatal(err)
+	}
+	if cn := <-l.commonNames; cn != "alice" {
+		t.Fatalf("Unexpected Peer Certificate CN %s\n", cn)
+	}
+	if err := connect("bob", []tls.Certificate{alice}); err == nil {
+		t.Fatal("Client Id Not Matching the Certificate Accepted")
+	}
+	if err := connect("alice", nil); err == nil {
+		t.Fatal("Connection without Client Certificate Accepted")
+	}
+	if err := connect("alice", []tls.Certificate{newTestCertificate(t, "alice", nil)}); err == nil {
+		t.Fatal("Connection with Unverified Client Certificate Accepted")
+	}
+}
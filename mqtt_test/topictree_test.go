@@ -0,0 +1,116 @@
+package mqtt_test
+
+import (
+	"fmt"
+	"mqtt"
+	"testing"
+)
+
+type bench_session struct {
+	mqtt.Session
+
+	id      int
+	filters []string
+}
+
+func TestTopicTree(t *testing.T) {
+	filters := []string{"sport/tennis/player1", "sport/tennis/+", "sport/#", "+/+/player1", "#", "+", "/+", "$SYS/#", "+/monitor/Clients", "finance",
+		"+/#", "sport/+/#", "a/#"}
+	topics := []string{"sport/tennis/player1", "sport/tennis/player2", "sport", "finance", "/finance", "$SYS/monitor/Clients", "$SYS", "a/monitor/Clients", "sport/tennis/player1/ranking",
+		"sport/tennis", "a", "b"}
+
+	tree := mqtt.NewTopicTree()
+	sessions := make([]*bench_session, len(filters))
+	for i := 0; i < len(filters); i++ {
+		sessions[i] = &bench_session{id: i}
+		tree.Subscribe(sessions[i], filters[i], mqtt.QOS(i%3))
+	}
+
+	for _, topic := range topics {
+		matches := tree.Match(topic)
+		for i, filter := range filters {
+			subs, ok := matches[sessions[i]]
+			if ok != mqtt.MatchTopic(filter, topic) {
+				t.Errorf("Mismatch %s vs %s: tree %v\n", filter, topic, ok)
+			} else if ok && subs[filter] != mqtt.QOS(i%3) {
+				t.Errorf("Mismatch QoS %v for %s\n", subs[filter], filter)
+			}
+		}
+	}
+
+	//a multi-level wildcard also matches an empty last level
+	if _, ok := tree.Match("sport/")[sessions[2]]; !ok {
+		t.Errorf("Mismatch sport/# vs sport/\n")
+	}
+
+	for i := 0; i < len(filters); i++ {
+		if i%2 == 0 {
+			tree.Unsubscribe(sessions[i], filters[i])
+		} else {
+			tree.Remove(sessions[i])
+		}
+	}
+	for _, topic := range topics {
+		if matches := tree.Match(topic); len(matches) != 0 {
+			t.Errorf("Unexpected matches %v for %s\n", matches, topic)
+		}
+	}
+}
+
+const (
+	BENCH_SESSIONS      = 10000
+	BENCH_SUBSCRIPTIONS = 10
+)
+
+func benchFilters(i int) []string {
+	filters := make([]string, BENCH_SUBSCRIPTIONS)
+	for j := 0; j < BENCH_SUBSCRIPTIONS; j++ {
+		switch j % 3 {
+		case 0:
+			filters[j] = fmt.Sprintf("devices/%d/sensors/%d", i, j)
+		case 1:
+			filters[j] = fmt.Sprintf("devices/%d/+/%d", i, j)
+		default:
+			filters[j] = fmt.Sprintf("groups/%d/#", (i+j)%100)
+		}
+	}
+	return filters
+}
+
+func BenchmarkTopicTreeMatch(b *testing.B) {
+	tree := mqtt.NewTopicTree()
+	for i := 0; i < BENCH_SESSIONS; i++ {
+		s := &bench_session{id: i}
+		for _, filter := range benchFilters(i) {
+			tree.Subscribe(s, filter, mqtt.QOS_ONE)
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree.Match(fmt.Sprintf("devices/%d/sensors/%d", n%BENCH_SESSIONS, n%BENCH_SUBSCRIPTIONS))
+	}
+}
+
+func BenchmarkLinearMatch(b *testing.B) {
+	sessions := make([]*bench_session, BENCH_SESSIONS)
+	for i := 0; i < BENCH_SESSIONS; i++ {
+		sessions[i] = &bench_session{id: i, filters: benchFilters(i)}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		topic := fmt.Sprintf("devices/%d/sensors/%d", n%BENCH_SESSIONS, n%BENCH_SUBSCRIPTIONS)
+		matches := make(map[mqtt.Session]map[string]mqtt.QOS)
+		for _, s := range sessions {
+			for _, filter := range s.filters {
+				if mqtt.MatchTopic(filter, topic) {
+					if _, ok := matches[s]; !ok {
+						matches[s] = make(map[string]mqtt.QOS)
+					}
+					matches[s][filter] = mqtt.QOS_ONE
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mqtt_test
+
+import (
+	"crypto/tls"
+	"mqtt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startProviderOn(t *testing.T, network string, address string, port int, tlsc *tls.Config) mqtt.Provider {
+	stack := mqtt.GetStack()
+	p := stack.CreateProvider()
+	p.AddTransport(stack.CreateTransport(network, address, port, tlsc))
+	p.AddListener(&test_listener{provider: p})
+	go p.Run()
+
+	//wait for the transport to listen
+	probe := stack.CreateTransport(network, address, port, tlsc)
+	defer stack.DeleteTransport(probe)
+	for i := 0; i < 100; i++ {
+		if conn, err := probe.Dial(); err == nil {
+			conn.Close()
+			return p
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Provider on %s://%s:%d not listening\n", network, address, port)
+	return nil
+}
+
+func testRoundTrip(t *testing.T, network string, address string, port int, tlsc *tls.Config) {
+	p := startProviderOn(t, network, address, port, tlsc)
+	defer stopProvider(p)
+
+	stack := mqtt.GetStack()
+	l := newTestClientListener()
+	c := stack.CreateClient(stack.CreateTransport(network, address, port, tlsc), network)
+	defer stack.DeleteClient(c)
+	c.AddListener(l)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	if _, err := c.Subscribe([]string{"roundtrip/#"}, []mqtt.QOS{mqtt.QOS_TWO}); err != nil {
+		t.Fatal(err)
+	}
+	//larger than a 16 bit websocket frame length
+	content := string(make([]byte, 70000))
+	for _, qos := range []mqtt.QOS{mqtt.QOS_ZERO, mqtt.QOS_ONE, mqtt.QOS_TWO} {
+		if err := c.Publish(mqtt.NewMessage(false, qos, false, "roundtrip/topic", content)); err != nil {
+			t.Fatal(err)
+		}
+		l.expect(t, "roundtrip/topic", qos, content)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	dir, err := os.MkdirTemp("", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testRoundTrip(t, mqtt.UNIX, filepath.Join(dir, "mqtt.sock"), 0, nil)
+}
+
+func TestPipeTransport(t *testing.T) {
+	testRoundTrip(t, mqtt.PIPE, "broker", 1883, nil)
+
+	//nothing listens on the pipe once the provider is stopped
+	if _, err := mqtt.GetStack().CreateTransport(mqtt.PIPE, "broker", 1883, nil).Dial(); err == nil {
+		t.Fatal("Dialed a Closed Pipe")
+	}
+}
@@ -0,0 +1,133 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mqtt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	testRoundTrip(t, mqtt.WS, "127.0.0.1", 18844, nil)
+}
+
+func TestSecureWebSocket(t *testing.T) {
+	testRoundTrip(t, mqtt.WSS, "127.0.0.1", 18845, selfSignedConfig(t))
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	p := startProviderOn(t, mqtt.WS, "127.0.0.1", 18846, nil)
+	defer stopProvider(p)
+
+	for path, status := range map[string]int{"/other": http.StatusNotFound, "/mqtt": http.StatusBadRequest} {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(18846)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		//no mqtt subprotocol requested
+		conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Fatalf("Unexpected Status %d for Path %s\n", resp.StatusCode, path)
+		}
+	}
+}
+
+func TestWebSocketHandshakeTooLarge(t *testing.T) {
+	p := startProviderOn(t, mqtt.WS, "127.0.0.1", 18870, nil)
+	defer stopProvider(p)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(18870)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//a request beyond WS_HANDSHAKE_MAX is dropped without a response
+	conn.Write([]byte("GET /mqtt HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"X-Padding: " + strings.Repeat("a", mqtt.WS_HANDSHAKE_MAX) + "\r\n"))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf, err := io.ReadAll(conn)
+	if opErr, ok := err.(net.Error); ok && opErr.Timeout() {
+		t.Fatal("Oversized Handshake Not Dropped")
+	}
+	if len(buf) != 0 {
+		t.Fatalf("Unexpected Response %q\n", buf)
+	}
+}
+
+//wsOpen does the websocket handshake on a raw connection
+func wsOpen(t *testing.T, port int) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /mqtt HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: mqtt\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected Status %d\n", resp.StatusCode)
+	}
+	return conn, reader
+}
+
+//wsExpectClose reads a close frame with status code, after which the
+//connection is closed
+func wsExpectClose(t *testing.T, reader *bufio.Reader, code []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x80|mqtt.WS_OPCODE_CLOSE || !bytes.Equal(payload, code) {
+		t.Fatalf("Expected Close Frame %x, got %x %x\n", code, header, payload)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected EOF after Close Frame %v\n", err)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	p := startProviderOn(t, mqtt.WS, "127.0.0.1", 18865, nil)
+	defer stopProvider(p)
+
+	pktconn := mqtt.NewPacketConnect()
+	pktconn.SetProtocolName("MQTT")
+	pktconn.SetProtocolLevel(4)
+	pktconn.SetConnectFlags(mqtt.CONNECT_FLAG_CLEAN_SESSION)
+	pktconn.SetClientId("wsframes")
+	buf := pktconn.Bytes()
+
+	//an unmasked client frame fails the connection with 1002 protocol error
+	conn, reader := wsOpen(t, 18865)
+	defer conn.Close()
+	conn.Write(append([]byte{0x80 | mqtt.WS_OPCODE_BINARY, byte(len(buf))}, buf...))
+	wsExpectClose(t, reader, []byte{0x03, 0xEA})
+
+	//a close is answered with a close carrying its status code
+	conn, reader = wsOpen(t, 18865)
+	defer conn.Close()
+	key := []byte{1, 2, 3, 4}
+	code := []byte{0x03, 0xE9} //1001 going away
+	conn.Write([]byte{0x80 | mqtt.WS_OPCODE_CLOSE, 0x80 | 2, key[0], key[1], key[2], key[3], code[0] ^ key[0], code[1] ^ key[1]})
+	wsExpectClose(t, reader, code)
+}
@@ -26,7 +26,19 @@ const (
 	PACKET_PINGREQ
 	PACKET_PINGRESP
 	PACKET_DISCONNECT
-	PACKET_RESERVED_15
+	PACKET_AUTH
+
+	PACKET_RESERVED_15 = PACKET_AUTH //reserved before MQTT 5
+)
+
+//protocol names and levels accepted in CONNECT
+const (
+	PROTOCOL_NAME     = "MQTT"
+	PROTOCOL_NAME_3_1 = "MQIsdp"
+
+	PROTOCOL_LEVEL_3_1   byte = 3
+	PROTOCOL_LEVEL_3_1_1 byte = 4
+	PROTOCOL_LEVEL_5     byte = 5
 )
 
 /* Packet Type Strings*/
@@ -46,7 +58,7 @@ var PACKET_TYPE_STRINGS = []string{
 	"PINGREQ",
 	"PINGRESP",
 	"DISCONNECT",
-	"RESERVED_15",
+	"AUTH",
 }
 
 type IBytizer interface {
@@ -70,6 +82,11 @@ type Packet interface {
 
 	GetFlag() byte
 	SetFlag(byte)
+
+	//the protocol level the packet is parsed and bytized for, set by the
+	//session from the negotiated CONNECT
+	GetProtocolLevel() byte
+	SetProtocolLevel(l byte)
 }
 
 type PacketPingreq interface {
@@ -82,15 +99,30 @@ type PacketPingresp interface {
 
 type PacketDisconnect interface {
 	Packet
+
+	//MQTT 5
+	GetReasonCode() ReasonCode
+	SetReasonCode(c ReasonCode)
+
+	GetProperties() Properties
+	SetProperties(p Properties)
 }
 
 ////////////////////Implementation////////////////////////
 
+//Packetize parses an MQTT 3.1.1 packet
 func Packetize(buffer []byte) (pkt Packet, err error) {
+	return PacketizeLevel(buffer, PROTOCOL_LEVEL_3_1_1)
+}
+
+//PacketizeLevel parses a packet of the protocol level negotiated by CONNECT,
+//a CONNECT carries its own level
+func PacketizeLevel(buffer []byte, level byte) (pkt Packet, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			pkt = nil
-			err = errors.New(r.(string))
+			//runtime errors are recovered as well as the panics of Parse
+			err = errors.New(fmt.Sprint(r))
 		}
 	}()
 
@@ -123,7 +155,13 @@ func Packetize(buffer []byte) (pkt Packet, err error) {
 	case PACKET_PINGRESP:
 		pkt = NewPacket(PACKET_PINGRESP)
 	case PACKET_DISCONNECT:
-		pkt = NewPacket(PACKET_DISCONNECT)
+		pkt = NewPacketDisconnect()
+	case PACKET_AUTH:
+		if level == PROTOCOL_LEVEL_5 {
+			pkt = NewPacketAuth()
+		} else {
+			return nil, fmt.Errorf("Invalid Control Packet Type %d\n", packetType)
+		}
 	default:
 		return nil, fmt.Errorf("Invalid Control Packet Type %d\n", packetType)
 	}
@@ -131,6 +169,7 @@ func Packetize(buffer []byte) (pkt Packet, err error) {
 	if pkt == nil {
 		return nil, errors.New("Can't NewPacket")
 	}
+	pkt.SetProtocolLevel(level)
 
 	if err = pkt.Parse(buffer); err != nil {
 		return nil, err
@@ -145,6 +184,9 @@ type packet struct {
 
 	packetType PacketType
 	packetFlag byte
+
+	protocolLevel byte
+	properties    *properties //MQTT 5
 }
 
 func NewPacket(pt PacketType) *packet {
@@ -207,41 +249,15 @@ func (this *packet) EncodingRemainingLength(X uint32) ([]byte, error) {
 		return nil, errors.New("X value > 0xFFFFFF7F")
 	}
 
-	var buffer bytes.Buffer
-	var encodedByte byte
-	for X > 0 {
-		encodedByte = byte(X % 128)
-		X = X / 128
-		if X > 0 {
-			encodedByte = encodedByte | 128
-		} else {
-			buffer.WriteByte(encodedByte)
-		}
-	}
-
-	return buffer.Bytes(), nil
+	return encodingVariableByteInteger(X), nil
 }
 func (this *packet) DecodingRemainingLength(buffer []byte) (uint32, uint32, error) {
-	multipler := uint32(1)
-	encodedByte := byte(128)
-
-	value := uint32(0)
-	i := 0
-	for encodedByte&128 != 0 {
-		if len(buffer) > i {
-			encodedByte = buffer[i]
-			i++
-			value += uint32(encodedByte&127) * multipler
-			multipler *= 128
-			if multipler > 128*128*128 {
-				return 0, 0, errors.New("Malformed Remaining Length")
-			}
-		} else {
-			return 0, 0, errors.New("Malformed Remaining Length")
-		}
+	value, length, err := decodingVariableByteInteger(buffer)
+	if err != nil {
+		return 0, 0, errors.New("Malformed Remaining Length")
 	}
 
-	return value, uint32(i), nil
+	return value, length, nil
 }
 
 func (this *packet) EncodingUTF8(U string) []byte {
@@ -261,11 +277,12 @@ func (this *packet) DecodingUTF8(buffer []byte) (string, uint32, error) {
 	}
 
 	length := ((uint16(buffer[0])) << 8) | uint16(buffer[1])
-	if len(buffer) < int(2+length) {
+	//int(2+length) would wrap around for a length of 0xFFFF
+	if len(buffer) < int(length)+2 {
 		return "", 0, errors.New("Malformed UTF8 encoded strings")
 	}
 
-	return string(buffer[2 : 2+length]), uint32(2 + length), nil
+	return string(buffer[2 : int(length)+2]), uint32(length) + 2, nil
 }
 
 func (this *packet) EncodingBinary(B []byte) []byte {
@@ -281,15 +298,15 @@ func (this *packet) EncodingBinary(B []byte) []byte {
 }
 func (this *packet) DecodingBinary(buffer []byte) ([]byte, uint32, error) {
 	if len(buffer) < 2 {
-		return nil, 0, errors.New("Malformed UTF8 encoded strings")
+		return nil, 0, errors.New("Malformed Binary Data")
 	}
 
 	length := ((uint16(buffer[0])) << 8) | uint16(buffer[1])
-	if len(buffer) < int(2+length) {
-		return nil, 0, errors.New("Malformed UTF8 encoded strings")
+	if len(buffer) < int(length)+2 {
+		return nil, 0, errors.New("Malformed Binary Data")
 	}
 
-	return buffer[2 : 2+length], uint32(2 + length), nil
+	return buffer[2 : int(length)+2], uint32(length) + 2, nil
 }
 
 //Fixed Header
@@ -306,3 +323,145 @@ func (this *packet) GetFlag() byte {
 func (this *packet) SetFlag(pf byte) {
 	this.packetFlag = pf
 }
+
+func (this *packet) GetProtocolLevel() byte {
+	return this.protocolLevel
+}
+func (this *packet) SetProtocolLevel(l byte) {
+	this.protocolLevel = l
+}
+
+//MQTT 5 Properties
+func (this *packet) GetProperties() Properties {
+	if this.properties == nil {
+		this.properties = newProperties()
+	}
+	return this.properties
+}
+func (this *packet) SetProperties(p Properties) {
+	if p == nil {
+		this.properties = nil
+	} else {
+		this.properties = p.Copy().(*properties)
+	}
+}
+
+func (this *packet) IsLevel5() bool {
+	return this.protocolLevel == PROTOCOL_LEVEL_5
+}
+
+//EncodingProperties writes the properties of an MQTT 5 packet, nothing
+//for the earlier levels
+func (this *packet) EncodingProperties(buffer *bytes.Buffer) {
+	if !this.IsLevel5() {
+		return
+	}
+	buffer.Write(encodingProperties(this.properties))
+}
+
+//DecodingProperties reads the properties of an MQTT 5 packet and returns
+//the number of bytes consumed, 0 for the earlier levels
+func (this *packet) DecodingProperties(buffer []byte) (uint32, error) {
+	if !this.IsLevel5() {
+		return 0, nil
+	}
+	p, consumedBytes, err := decodingProperties(buffer)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s Control Packet Properties %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
+	}
+	this.properties = p
+	return consumedBytes, nil
+}
+
+//packet_reason is a DISCONNECT or AUTH, which in MQTT 5 carry an optional
+//reason code and properties
+type packet_reason struct {
+	packet
+
+	reasonCode ReasonCode
+}
+
+func NewPacketDisconnect() *packet_reason {
+	this := packet_reason{}
+
+	this.IBytizer = &this
+	this.IParser = &this
+
+	this.packetType = PACKET_DISCONNECT
+	this.packetFlag = 0
+
+	return &this
+}
+
+func (this *packet_reason) IBytize() []byte {
+	var buffer bytes.Buffer
+	var buffer2 bytes.Buffer
+
+	//the reason code and properties can be omitted for success without properties
+	if this.IsLevel5() && (this.reasonCode != REASON_SUCCESS || (this.properties != nil && this.properties.Len() != 0)) {
+		buffer2.WriteByte(byte(this.reasonCode))
+		this.EncodingProperties(&buffer2)
+	}
+
+	//Fixed Header
+	buffer.WriteByte((byte(this.packetType) << 4) | (this.packetFlag & 0x0F))
+	buf2 := buffer2.Bytes()
+	x, _ := this.EncodingRemainingLength(uint32(len(buf2)))
+	buffer.Write(x)
+
+	//Variable Header
+	buffer.Write(buf2)
+
+	return buffer.Bytes()
+}
+
+func (this *packet_reason) IParse(buffer []byte) error {
+	var err error
+	var bufferLength, remainingLength, consumedBytes uint32
+
+	if !this.IsLevel5() {
+		return this.packet.IParse(buffer)
+	}
+
+	bufferLength = uint32(len(buffer))
+	if buffer == nil || bufferLength < 2 {
+		return fmt.Errorf("Invalid %s Control Packet Size %x\n", PACKET_TYPE_STRINGS[this.packetType], bufferLength)
+	}
+
+	//Fixed Header
+	if packetType := PacketType((buffer[0] >> 4) & 0x0F); packetType != this.packetType {
+		return fmt.Errorf("Invalid %s Control Packet Type %x\n", PACKET_TYPE_STRINGS[this.packetType], packetType)
+	}
+	if packetFlag := buffer[0] & 0x0F; packetFlag != this.packetFlag {
+		return fmt.Errorf("Invalid %s Control Packet Flags %x\n", PACKET_TYPE_STRINGS[this.packetType], packetFlag)
+	}
+	if remainingLength, consumedBytes, err = this.DecodingRemainingLength(buffer[1:]); err != nil {
+		return fmt.Errorf("Invalid %s Control Packet DecodingRemainingLength %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
+	}
+	if consumedBytes += 1; bufferLength < consumedBytes+remainingLength {
+		return fmt.Errorf("Invalid %s Control Packet Remaining Length %x\n", PACKET_TYPE_STRINGS[this.packetType], remainingLength)
+	}
+	buffer = buffer[:consumedBytes+remainingLength]
+
+	//Variable Header
+	this.reasonCode = REASON_SUCCESS
+	this.properties = nil
+	if remainingLength > 0 {
+		this.reasonCode = ReasonCode(buffer[consumedBytes])
+		consumedBytes += 1
+	}
+	if remainingLength > 1 {
+		if _, err = this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *packet_reason) GetReasonCode() ReasonCode {
+	return this.reasonCode
+}
+func (this *packet_reason) SetReasonCode(c ReasonCode) {
+	this.reasonCode = c
+}
@@ -13,6 +13,13 @@ type PacketAck interface {
 	//Variable Header
 	GetPacketId() uint16
 	SetPacketId(id uint16)
+
+	//MQTT 5
+	GetReasonCode() ReasonCode
+	SetReasonCode(c ReasonCode)
+
+	GetProperties() Properties
+	SetProperties(p Properties)
 }
 
 type PacketPuback interface {
@@ -33,12 +40,16 @@ type PacketPubcomp interface {
 
 type PacketUnsuback interface {
 	PacketAck
+
+	//MQTT 5 Payload, one reason code per topic filter
+	GetReasonCodes() []ReasonCode
+	SetReasonCodes([]ReasonCode)
 }
 
 type PacketSuback interface {
 	PacketAck
 
-	//Payload
+	//Payload, reason codes in MQTT 5
 	GetReturnCodes() []byte
 	SetReturnCodes([]byte)
 }
@@ -50,6 +61,8 @@ type PacketConnack interface {
 	GetSPFlag() bool
 	SetSPFlag(b bool)
 
+	//GetReasonCode and SetReasonCode carry the MQTT 5 reason code, which
+	//when left to 0 is derived from the return code
 	GetReturnCode() CONNACK_RETURNCODE
 	SetReturnCode(c CONNACK_RETURNCODE)
 }
@@ -59,7 +72,9 @@ type PacketConnack interface {
 type packet_ack struct {
 	packet
 
-	packetId uint16
+	packetId    uint16
+	reasonCode  ReasonCode   //MQTT 5
+	reasonCodes []ReasonCode //MQTT 5 UNSUBACK
 }
 
 func NewPacketAcks(pt PacketType) *packet_ack {
@@ -85,6 +100,10 @@ func NewPacketAcks(pt PacketType) *packet_ack {
 func (this *packet_ack) IBytize() []byte {
 	var buffer bytes.Buffer
 
+	if this.IsLevel5() {
+		return this.bytize5()
+	}
+
 	buffer.WriteByte((byte(this.packetType) << 4) | (this.packetFlag & 0x0F))
 	buffer.WriteByte(2)
 	buffer.WriteByte(byte(this.packetId >> 8))
@@ -93,7 +112,46 @@ func (this *packet_ack) IBytize() []byte {
 	return buffer.Bytes()
 }
 
+func (this *packet_ack) bytize5() []byte {
+	var buffer bytes.Buffer
+	var buffer2 bytes.Buffer
+
+	//Variable Header
+	buffer2.WriteByte(byte(this.packetId >> 8))
+	buffer2.WriteByte(byte(this.packetId & 0xFF))
+
+	hasProperties := this.properties != nil && this.properties.Len() != 0
+	if this.packetType == PACKET_UNSUBACK {
+		this.EncodingProperties(&buffer2)
+
+		//Payload
+		for _, c := range this.reasonCodes {
+			buffer2.WriteByte(byte(c))
+		}
+	} else if this.reasonCode != REASON_SUCCESS || hasProperties {
+		//the reason code and properties can be omitted for success without properties
+		buffer2.WriteByte(byte(this.reasonCode))
+		if hasProperties {
+			this.EncodingProperties(&buffer2)
+		}
+	}
+
+	//Fixed Header
+	buffer.WriteByte((byte(this.packetType) << 4) | (this.packetFlag & 0x0F))
+	buf2 := buffer2.Bytes()
+	x, _ := this.EncodingRemainingLength(uint32(len(buf2)))
+	buffer.Write(x)
+
+	buffer.Write(buf2)
+
+	return buffer.Bytes()
+}
+
 func (this *packet_ack) IParse(buffer []byte) error {
+	if this.IsLevel5() {
+		return this.parse5(buffer)
+	}
+
 	if buffer == nil || len(buffer) != 4 {
 		return fmt.Errorf("Invalid %s Control Packet Size %x\n", PACKET_TYPE_STRINGS[this.packetType], len(buffer))
 	}
@@ -115,6 +173,69 @@ func (this *packet_ack) IParse(buffer []byte) error {
 	return nil
 }
 
+func (this *packet_ack) parse5(buffer []byte) error {
+	var err error
+	var bufferLength, remainingLength, consumedBytes uint32
+
+	bufferLength = uint32(len(buffer))
+	if buffer == nil || bufferLength < 4 {
+		return fmt.Errorf("Invalid %s Control Packet Size %x\n", PACKET_TYPE_STRINGS[this.packetType], bufferLength)
+	}
+
+	//Fixed Header
+	if packetType := PacketType((buffer[0] >> 4) & 0x0F); packetType != this.packetType {
+		return fmt.Errorf("Invalid %s Control Packet Type %x\n", PACKET_TYPE_STRINGS[this.packetType], packetType)
+	}
+	if packetFlag := buffer[0] & 0x0F; packetFlag != this.packetFlag {
+		return fmt.Errorf("Invalid %s Control Packet Flags %x\n", PACKET_TYPE_STRINGS[this.packetType], packetFlag)
+	}
+	if remainingLength, consumedBytes, err = this.DecodingRemainingLength(buffer[1:]); err != nil {
+		return fmt.Errorf("Invalid %s Control Packet DecodingRemainingLength %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
+	}
+	if consumedBytes += 1; bufferLength < consumedBytes+remainingLength || remainingLength < 2 {
+		return fmt.Errorf("Invalid %s Control Packet Remaining Length %x\n", PACKET_TYPE_STRINGS[this.packetType], remainingLength)
+	}
+	buffer = buffer[:consumedBytes+remainingLength]
+	bufferLength = consumedBytes + remainingLength
+
+	//Variable Header
+	if this.packetId = ((uint16(buffer[consumedBytes])) << 8) | uint16(buffer[consumedBytes+1]); this.packetId == 0 {
+		return fmt.Errorf("Invalid %s Control Packet PacketId 0\n", PACKET_TYPE_STRINGS[this.packetType])
+	}
+	consumedBytes += 2
+
+	this.reasonCode = REASON_SUCCESS
+	this.reasonCodes = nil
+	this.properties = nil
+	if this.packetType == PACKET_UNSUBACK {
+		propertyBytes, err := this.DecodingProperties(buffer[consumedBytes:])
+		if err != nil {
+			return err
+		}
+		if consumedBytes += propertyBytes; bufferLength < consumedBytes+1 {
+			return fmt.Errorf("Invalid %s Control Packet Must Have at least One Reason Code\n", PACKET_TYPE_STRINGS[this.packetType])
+		}
+
+		//Payload
+		for _, c := range buffer[consumedBytes:] {
+			this.reasonCodes = append(this.reasonCodes, ReasonCode(c))
+		}
+		return nil
+	}
+
+	if bufferLength > consumedBytes {
+		this.reasonCode = ReasonCode(buffer[consumedBytes])
+		consumedBytes += 1
+	}
+	if bufferLength > consumedBytes {
+		if _, err = this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 //Variable Header
 func (this *packet_ack) GetPacketId() uint16 {
 	return this.packetId
@@ -123,6 +244,22 @@ func (this *packet_ack) SetPacketId(id uint16) {
 	this.packetId = id
 }
 
+//MQTT 5
+func (this *packet_ack) GetReasonCode() ReasonCode {
+	return this.reasonCode
+}
+func (this *packet_ack) SetReasonCode(c ReasonCode) {
+	this.reasonCode = c
+}
+
+func (this *packet_ack) GetReasonCodes() []ReasonCode {
+	return this.reasonCodes
+}
+func (this *packet_ack) SetReasonCodes(reasonCodes []ReasonCode) {
+	this.reasonCodes = make([]ReasonCode, len(reasonCodes))
+	copy(this.reasonCodes, reasonCodes)
+}
+
 /////////////////////
 type packet_suback struct {
 	packet_ack
@@ -145,18 +282,23 @@ func NewPacketSuback() *packet_suback {
 func (this *packet_suback) IBytize() []byte {
 	var buffer bytes.Buffer
 
-	//Fixed Header
-	buffer.WriteByte((byte(this.packetType) << 4) | (this.packetFlag & 0x0F))
-	remainingLength := uint32(2 + len(this.returnCodes))
-	x, _ := this.EncodingRemainingLength(remainingLength)
-	buffer.Write(x)
+	var buffer2 bytes.Buffer
 
 	//Variable Header
-	buffer.WriteByte(byte(this.packetId >> 8))
-	buffer.WriteByte(byte(this.packetId & 0xFF))
+	buffer2.WriteByte(byte(this.packetId >> 8))
+	buffer2.WriteByte(byte(this.packetId & 0xFF))
+	this.EncodingProperties(&buffer2)
 
 	//Payload
-	buffer.Write(this.returnCodes)
+	buffer2.Write(this.returnCodes)
+
+	//Fixed Header
+	buffer.WriteByte((byte(this.packetType) << 4) | (this.packetFlag & 0x0F))
+	buf2 := buffer2.Bytes()
+	x, _ := this.EncodingRemainingLength(uint32(len(buf2)))
+	buffer.Write(x)
+
+	buffer.Write(buf2)
 
 	return buffer.Bytes()
 }
@@ -191,15 +333,24 @@ func (this *packet_suback) IParse(buffer []byte) error {
 	if this.packetId = ((uint16(buffer[consumedBytes])) << 8) | uint16(buffer[consumedBytes+1]); this.packetId == 0 {
 		return fmt.Errorf("Invalid %s Control Packet PacketId 0\n", PACKET_TYPE_STRINGS[this.packetType])
 	}
-	if consumedBytes += 2; bufferLength < consumedBytes+1 {
+	consumedBytes += 2
+
+	this.properties = nil
+	if propertyBytes, err := this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+		return err
+	} else {
+		consumedBytes += propertyBytes
+	}
+	if bufferLength < consumedBytes+1 {
 		return fmt.Errorf("Invalid %s Control Packet Must Have at least One Return Code\n", PACKET_TYPE_STRINGS[this.packetType])
 	}
 
 	//Payload
-	this.returnCodes = make([]byte, remainingLength-2)
-	copy(this.returnCodes, buffer[consumedBytes:consumedBytes+remainingLength-2])
-	for i := 0; i < int(remainingLength-2); i++ {
-		if !(this.returnCodes[i] <= 0x02 || this.returnCodes[i] == 0x80) {
+	this.returnCodes = make([]byte, bufferLength-consumedBytes)
+	copy(this.returnCodes, buffer[consumedBytes:])
+	for i := 0; i < len(this.returnCodes); i++ {
+		//MQTT 5 has more failure reason codes than 0x80
+		if !(this.returnCodes[i] <= 0x02 || this.returnCodes[i] == 0x80 || (this.IsLevel5() && this.returnCodes[i] > 0x80)) {
 			return fmt.Errorf("Invalid %s Control Packet Return Code %02x\n", PACKET_TYPE_STRINGS[this.packetType], this.returnCodes[i])
 		}
 	}
@@ -250,6 +401,10 @@ func NewPacketConnack() *packet_connack {
 func (this *packet_connack) IBytize() []byte {
 	var buffer bytes.Buffer
 
+	if this.IsLevel5() {
+		return this.bytize5()
+	}
+
 	//Fixed Header
 	buffer.WriteByte((byte(this.packetType) << 4) | (this.packetFlag & 0x0F))
 	buffer.WriteByte(2)
@@ -261,7 +416,35 @@ func (this *packet_connack) IBytize() []byte {
 	return buffer.Bytes()
 }
 
+func (this *packet_connack) bytize5() []byte {
+	var buffer bytes.Buffer
+	var buffer2 bytes.Buffer
+
+	//Variable Header
+	buffer2.WriteByte(byte(this.spFlag))
+	reasonCode := this.reasonCode
+	if reasonCode == REASON_SUCCESS {
+		reasonCode = connackReasonCodes[this.returnCode]
+	}
+	buffer2.WriteByte(byte(reasonCode))
+	this.EncodingProperties(&buffer2)
+
+	//Fixed Header
+	buffer.WriteByte((byte(this.packetType) << 4) | (this.packetFlag & 0x0F))
+	buf2 := buffer2.Bytes()
+	x, _ := this.EncodingRemainingLength(uint32(len(buf2)))
+	buffer.Write(x)
+
+	buffer.Write(buf2)
+
+	return buffer.Bytes()
+}
+
 func (this *packet_connack) IParse(buffer []byte) error {
+	if this.IsLevel5() {
+		return this.parse5(buffer)
+	}
+
 	if buffer == nil || len(buffer) != 4 {
 		return fmt.Errorf("Invalid %s Control Packet Size %x\n", PACKET_TYPE_STRINGS[this.packetType], len(buffer))
 	}
@@ -291,6 +474,47 @@ func (this *packet_connack) IParse(buffer []byte) error {
 	return nil
 }
 
+func (this *packet_connack) parse5(buffer []byte) error {
+	var err error
+	var bufferLength, remainingLength, consumedBytes uint32
+
+	bufferLength = uint32(len(buffer))
+	if buffer == nil || bufferLength < 4 {
+		return fmt.Errorf("Invalid %s Control Packet Size %x\n", PACKET_TYPE_STRINGS[this.packetType], bufferLength)
+	}
+
+	//Fixed Header
+	if packetType := PacketType((buffer[0] >> 4) & 0x0F); packetType != this.packetType {
+		return fmt.Errorf("Invalid %s Control Packet Type %x\n", PACKET_TYPE_STRINGS[this.packetType], packetType)
+	}
+	if packetFlag := buffer[0] & 0x0F; packetFlag != this.packetFlag {
+		return fmt.Errorf("Invalid %s Control Packet Flags %x\n", PACKET_TYPE_STRINGS[this.packetType], packetFlag)
+	}
+	if remainingLength, consumedBytes, err = this.DecodingRemainingLength(buffer[1:]); err != nil {
+		return fmt.Errorf("Invalid %s Control Packet DecodingRemainingLength %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
+	}
+	if consumedBytes += 1; bufferLength < consumedBytes+remainingLength || remainingLength < 3 {
+		return fmt.Errorf("Invalid %s Control Packet Remaining Length %x\n", PACKET_TYPE_STRINGS[this.packetType], remainingLength)
+	}
+	buffer = buffer[:consumedBytes+remainingLength]
+
+	//Variable Header
+	if buffer[consumedBytes]&0xFE != 0 {
+		return fmt.Errorf("Invalid %s Control Packet Acknowledge Flags %x\n", PACKET_TYPE_STRINGS[this.packetType], buffer[consumedBytes])
+	}
+	this.spFlag = buffer[consumedBytes] & 0x01
+
+	this.reasonCode = ReasonCode(buffer[consumedBytes+1])
+	this.returnCode = connackReturnCode(this.reasonCode)
+	consumedBytes += 2
+
+	if _, err = this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 //Variable Header
 func (this *packet_connack) GetSPFlag() bool {
 	return this.spFlag != 0
@@ -0,0 +1,31 @@
+package mqtt
+
+////////////////////Interface//////////////////////////////
+
+//PacketAuth is the MQTT 5 AUTH packet of the enhanced authentication
+//exchange, the method and data are in the AUTHENTICATION_METHOD and
+//AUTHENTICATION_DATA properties
+type PacketAuth interface {
+	Packet
+
+	GetReasonCode() ReasonCode
+	SetReasonCode(c ReasonCode)
+
+	GetProperties() Properties
+	SetProperties(p Properties)
+}
+
+////////////////////Implementation////////////////////////
+
+func NewPacketAuth() *packet_reason {
+	this := packet_reason{}
+
+	this.IBytizer = &this
+	this.IParser = &this
+
+	this.packetType = PACKET_AUTH
+	this.packetFlag = 0
+	this.protocolLevel = PROTOCOL_LEVEL_5
+
+	return &this
+}
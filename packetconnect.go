@@ -43,11 +43,21 @@ type PacketConnect interface {
 	GetWillMessage() string
 	SetWillMessage(s string)
 
+	GetWillPayload() []byte
+	SetWillPayload(b []byte)
+
 	GetUserName() string
 	SetUserName(s string)
 
 	GetPassword() []byte
 	SetPassword(s []byte)
+
+	//MQTT 5
+	GetProperties() Properties
+	SetProperties(p Properties)
+
+	GetWillProperties() Properties
+	SetWillProperties(p Properties)
 }
 
 ////////////////////Implementation////////////////////////
@@ -56,17 +66,17 @@ type packet_connect struct {
 	packet
 
 	//Variable Header
-	protocolName  string
-	protocolLevel byte
-	connectFlags  byte
-	keepAlive     uint16
+	protocolName string
+	connectFlags byte
+	keepAlive    uint16
 
 	//Payload
-	clientId    string
-	willTopic   string
-	willMessage string
-	userName    string
-	password    []byte
+	clientId       string
+	willProperties *properties //MQTT 5
+	willTopic      string
+	willMessage    []byte
+	userName       string
+	password       []byte
 }
 
 func NewPacketConnect() *packet_connect {
@@ -99,14 +109,19 @@ func (this *packet_connect) IBytize() []byte {
 	buffer2.WriteByte(byte(this.keepAlive >> 8))
 	buffer2.WriteByte(byte(this.keepAlive & 0xFF))
 
+	this.EncodingProperties(&buffer2)
+
 	//Payload
 	clientId := this.EncodingUTF8(this.clientId)
 	buffer2.Write(clientId)
 
 	//Will Flag bit 2
 	if (this.connectFlags & CONNECT_FLAG_WILL_FLAG) != 0 {
+		if this.IsLevel5() {
+			buffer2.Write(encodingProperties(this.willProperties))
+		}
 		buffer2.Write(this.EncodingUTF8(this.willTopic))
-		buffer2.Write(this.EncodingUTF8(this.willMessage))
+		buffer2.Write(this.EncodingBinary(this.willMessage))
 	}
 
 	//UserName Flag bit 7
@@ -162,8 +177,11 @@ func (this *packet_connect) IParse(buffer []byte) error {
 
 	//Variable Header
 	protocolLength := ((uint32(buffer[consumedBytes])) << 8) | uint32(buffer[consumedBytes+1])
-	consumedBytes += 2
-	if this.protocolName = string(buffer[consumedBytes : consumedBytes+protocolLength]); this.protocolName != "MQTT" {
+	if consumedBytes += 2; bufferLength < consumedBytes+protocolLength+4 {
+		return fmt.Errorf("Invalid %s Control Packet Protocol Name Length %x\n", PACKET_TYPE_STRINGS[this.packetType], protocolLength)
+	}
+	//the level is checked against the name by the session, MQIsdp is MQTT 3.1
+	if this.protocolName = string(buffer[consumedBytes : consumedBytes+protocolLength]); this.protocolName != PROTOCOL_NAME && this.protocolName != PROTOCOL_NAME_3_1 {
 		return fmt.Errorf("Invalid %s Control Packet Protocol Name %s\n", PACKET_TYPE_STRINGS[this.packetType], this.protocolName)
 	}
 	consumedBytes += protocolLength
@@ -194,6 +212,13 @@ func (this *packet_connect) IParse(buffer []byte) error {
 	this.keepAlive = ((uint16(buffer[consumedBytes])) << 8) | uint16(buffer[consumedBytes+1])
 	consumedBytes += 2
 
+	this.properties = nil
+	if propertyBytes, err := this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+		return err
+	} else {
+		consumedBytes += propertyBytes
+	}
+
 	//Payload
 	if this.clientId, utf8Bytes, err = this.DecodingUTF8(buffer[consumedBytes:]); err != nil {
 		return fmt.Errorf("Invalid %s Control Packet ClientId DecodingUTF8 %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
@@ -201,19 +226,27 @@ func (this *packet_connect) IParse(buffer []byte) error {
 	consumedBytes += utf8Bytes
 
 	//Will Flag bit 2
+	this.willProperties = nil
 	if (this.connectFlags & CONNECT_FLAG_WILL_FLAG) != 0 {
+		if this.IsLevel5() {
+			if this.willProperties, utf8Bytes, err = decodingProperties(buffer[consumedBytes:]); err != nil {
+				return fmt.Errorf("Invalid %s Control Packet Will Properties %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
+			}
+			consumedBytes += utf8Bytes
+		}
+
 		if this.willTopic, utf8Bytes, err = this.DecodingUTF8(buffer[consumedBytes:]); err != nil {
 			return fmt.Errorf("Invalid %s Control Packet WillTopic DecodingUTF8 %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
 		}
 		consumedBytes += utf8Bytes
 
-		if this.willMessage, utf8Bytes, err = this.DecodingUTF8(buffer[consumedBytes:]); err != nil {
-			return fmt.Errorf("Invalid %s Control Packet WillMessage DecodingUTF8 %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
+		if this.willMessage, utf8Bytes, err = this.DecodingBinary(buffer[consumedBytes:]); err != nil {
+			return fmt.Errorf("Invalid %s Control Packet WillMessage DecodingBinary %s\n", PACKET_TYPE_STRINGS[this.packetType], err.Error())
 		}
 		consumedBytes += utf8Bytes
 	} else {
 		this.willTopic = ""
-		this.willMessage = ""
+		this.willMessage = nil
 	}
 
 	//UserName Flag bit 7
@@ -247,13 +280,6 @@ func (this *packet_connect) SetProtocolName(n string) {
 	this.protocolName = n
 }
 
-func (this *packet_connect) GetProtocolLevel() byte {
-	return this.protocolLevel
-}
-func (this *packet_connect) SetProtocolLevel(l byte) {
-	this.protocolLevel = l
-}
-
 func (this *packet_connect) GetConnectFlags() byte {
 	return this.connectFlags
 }
@@ -284,10 +310,17 @@ func (this *packet_connect) SetWillTopic(s string) {
 }
 
 func (this *packet_connect) GetWillMessage() string {
-	return this.willMessage
+	return string(this.willMessage)
 }
 func (this *packet_connect) SetWillMessage(s string) {
-	this.willMessage = s
+	this.willMessage = []byte(s)
+}
+
+func (this *packet_connect) GetWillPayload() []byte {
+	return this.willMessage
+}
+func (this *packet_connect) SetWillPayload(b []byte) {
+	this.willMessage = b
 }
 
 func (this *packet_connect) GetUserName() string {
@@ -303,3 +336,18 @@ func (this *packet_connect) GetPassword() []byte {
 func (this *packet_connect) SetPassword(s []byte) {
 	this.password = s
 }
+
+//MQTT 5
+func (this *packet_connect) GetWillProperties() Properties {
+	if this.willProperties == nil {
+		this.willProperties = newProperties()
+	}
+	return this.willProperties
+}
+func (this *packet_connect) SetWillProperties(p Properties) {
+	if p == nil {
+		this.willProperties = nil
+	} else {
+		this.willProperties = p.Copy().(*properties)
+	}
+}
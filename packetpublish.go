@@ -57,8 +57,13 @@ func (this *packet_publish) IBytize() []byte {
 		buffer2.WriteByte(byte(this.packetId & 0xFF))
 	}
 
+	//the properties of an MQTT 5 PUBLISH are those of its message
+	if this.IsLevel5() {
+		buffer2.Write(encodingProperties(this.message.GetProperties()))
+	}
+
 	//Payload
-	buffer2.WriteString(this.message.GetContent())
+	buffer2.Write(this.message.GetPayload())
 
 	//2nd Pass
 
@@ -92,7 +97,7 @@ func (this *packet_publish) IParse(buffer []byte) error {
 	var qos QOS
 	var retain bool
 	var topic string
-	var content string
+	var payload []byte
 
 	bufferLength = uint32(len(buffer))
 	if buffer == nil || bufferLength < 5 {
@@ -156,14 +161,25 @@ func (this *packet_publish) IParse(buffer []byte) error {
 		consumedBytes += 2
 	}
 
+	this.properties = nil
+	if propertyBytes, err := this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+		return err
+	} else {
+		consumedBytes += propertyBytes
+	}
+
 	if bufferLength < consumedBytes {
 		return fmt.Errorf("Invalid %s Control Packet Payload Length\n", PACKET_TYPE_STRINGS[this.packetType])
 	}
 
-	//Payload
-	content = string(buffer[consumedBytes:])
+	//Payload, not copied, the capacity is limited so that it can't be
+	//appended to over the rest of buffer
+	payload = buffer[consumedBytes:bufferLength:bufferLength]
 
-	this.message = NewMessage(dup, qos, retain, topic, content)
+	this.message = NewMessagePayload(dup, qos, retain, topic, payload)
+	if this.properties != nil {
+		this.message.SetProperties(this.properties)
+	}
 
 	return nil
 }
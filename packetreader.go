@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+////////////////////Interface//////////////////////////////
+
+const (
+	PACKET_SIZE_MAX      = 268435460 //a remaining length of 268435455 after a 5 bytes fixed header
+	PACKET_SIZE_DEFAULT  = 1 << 20
+	PACKET_READER_BUFFER = 4096
+)
+
+//PacketReader reads whole control packets off a stream. A read interrupted
+//by a deadline returns the timeout error, and the next one resumes the packet
+//where it stopped. After any other error the stream has to be closed
+type PacketReader interface {
+	ReadPacket() ([]byte, error)
+
+	GetMaxPacketSize() uint32 //0 for PACKET_SIZE_MAX
+	SetMaxPacketSize(size uint32)
+}
+
+////////////////////Implementation////////////////////////
+
+var errPacketTooLarge = errors.New("Packet Exceeds Maximum Packet Size\n")
+
+type packet_reader struct {
+	reader        *bufio.Reader
+	maxPacketSize uint32
+
+	//the packet being read, kept across timeouts
+	header       [5]byte
+	headerLength int
+	packet       []byte
+	read         int
+}
+
+func NewPacketReader(r io.Reader, maxPacketSize uint32) *packet_reader {
+	this := &packet_reader{}
+
+	this.reader = bufio.NewReaderSize(r, PACKET_READER_BUFFER)
+	this.maxPacketSize = maxPacketSize
+
+	return this
+}
+
+func (this *packet_reader) GetMaxPacketSize() uint32 {
+	return this.maxPacketSize
+}
+
+func (this *packet_reader) SetMaxPacketSize(size uint32) {
+	this.maxPacketSize = size
+}
+
+func (this *packet_reader) ReadPacket() ([]byte, error) {
+	//Fixed Header, the packet is only allocated once its size is known to
+	//be allowed
+	for this.packet == nil {
+		b, err := this.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		this.header[this.headerLength] = b
+		if this.headerLength++; this.headerLength == 1 {
+			continue
+		}
+		if b&0x80 != 0 {
+			if this.headerLength == len(this.header) {
+				return nil, errors.New("Malformed Remaining Length\n")
+			}
+			continue
+		}
+
+		remainingLength, _, err := decodingVariableByteInteger(this.header[1:this.headerLength])
+		if err != nil {
+			return nil, err
+		}
+		if size := uint32(this.headerLength) + remainingLength; this.maxPacketSize != 0 && size > this.maxPacketSize {
+			return nil, errPacketTooLarge
+		}
+		this.packet = make([]byte, uint32(this.headerLength)+remainingLength)
+		this.read = copy(this.packet, this.header[:this.headerLength])
+	}
+
+	//Variable Header + Payload
+	for this.read < len(this.packet) {
+		n, err := this.reader.Read(this.packet[this.read:])
+		this.read += n
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	packet := this.packet
+	this.packet = nil
+	this.headerLength = 0
+	this.read = 0
+
+	return packet, nil
+}
@@ -20,8 +20,26 @@ type PacketSubscribe interface {
 
 	GetQoSs() []QOS
 	SetQoSs([]QOS)
+
+	//MQTT 5 subscription options, the QoS in the low bits and the
+	//SUBSCRIBE_OPTION flags
+	GetOptions() []byte
+	SetOptions([]byte)
+
+	GetProperties() Properties
+	SetProperties(p Properties)
 }
 
+const (
+	SUBSCRIBE_OPTION_NO_LOCAL            byte = 0x04
+	SUBSCRIBE_OPTION_RETAIN_AS_PUBLISHED byte = 0x08
+	SUBSCRIBE_OPTION_RETAIN_HANDLING     byte = 0x30 //mask of the RETAIN_HANDLING values
+
+	RETAIN_HANDLING_SEND     byte = 0x00 //retained messages are sent on subscribe
+	RETAIN_HANDLING_SEND_NEW byte = 0x10 //only if the subscription didn't exist
+	RETAIN_HANDLING_NONE     byte = 0x20 //never
+)
+
 ////////////////////Implementation////////////////////////
 
 type packet_subscribe struct {
@@ -30,6 +48,7 @@ type packet_subscribe struct {
 	packetId uint16
 	topics   []string
 	qos      []QOS
+	options  []byte //MQTT 5
 }
 
 func NewPacketSubscribe() *packet_subscribe {
@@ -53,6 +72,7 @@ func (this *packet_subscribe) IBytize() []byte {
 	//Variable Header
 	buffer2.WriteByte(byte(this.packetId >> 8))
 	buffer2.WriteByte(byte(this.packetId & 0xFF))
+	this.EncodingProperties(&buffer2)
 
 	//Payload
 	for i := 0; i < len(this.topics); i++ {
@@ -60,7 +80,11 @@ func (this *packet_subscribe) IBytize() []byte {
 		buffer2.WriteByte(byte(topicLength >> 8))
 		buffer2.WriteByte(byte(topicLength & 0xFF))
 		buffer2.WriteString(this.topics[i])
-		buffer2.WriteByte(byte(this.qos[i]))
+		if this.IsLevel5() && i < len(this.options) {
+			buffer2.WriteByte(this.options[i]&^0x03 | byte(this.qos[i]))
+		} else {
+			buffer2.WriteByte(byte(this.qos[i]))
+		}
 	}
 
 	//2nd Pass
@@ -108,14 +132,26 @@ func (this *packet_subscribe) IParse(buffer []byte) error {
 	if this.packetId = ((uint16(buffer[consumedBytes])) << 8) | uint16(buffer[consumedBytes+1]); this.packetId == 0 {
 		return fmt.Errorf("Invalid %s Control Packet PacketId 0\n", PACKET_TYPE_STRINGS[this.packetType])
 	}
-	if consumedBytes += 2; bufferLength < consumedBytes+4 {
+	consumedBytes += 2
+
+	this.properties = nil
+	if propertyBytes, err := this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+		return err
+	} else {
+		consumedBytes += propertyBytes
+	}
+	if bufferLength < consumedBytes+4 {
 		return fmt.Errorf("Invalid %s Control Packet Payload Length\n", PACKET_TYPE_STRINGS[this.packetType])
 	}
 
 	//Payload
 	this.topics = nil
 	this.qos = nil
+	this.options = nil
 	for bufferLength > consumedBytes {
+		if bufferLength < consumedBytes+2 {
+			return fmt.Errorf("Invalid %s Control Packet Payload Length\n", PACKET_TYPE_STRINGS[this.packetType])
+		}
 		topicLength = ((uint32(buffer[consumedBytes])) << 8) | uint32(buffer[consumedBytes+1])
 		if consumedBytes += 2; bufferLength < consumedBytes+topicLength || topicLength == 0 {
 			return fmt.Errorf("Invalid %s Control Packet Topic Length %x\n", PACKET_TYPE_STRINGS[this.packetType], topicLength)
@@ -126,6 +162,16 @@ func (this *packet_subscribe) IParse(buffer []byte) error {
 			return fmt.Errorf("Invalid %s Control Packet QoS Length\n", PACKET_TYPE_STRINGS[this.packetType])
 		}
 
+		if this.IsLevel5() {
+			options := buffer[consumedBytes]
+			if options&0xC0 != 0 || options&0x03 > 2 || options&SUBSCRIBE_OPTION_RETAIN_HANDLING > RETAIN_HANDLING_NONE {
+				return fmt.Errorf("Invalid %s Control Packet Subscription Options %x\n", PACKET_TYPE_STRINGS[this.packetType], options)
+			}
+			this.options = append(this.options, options)
+			this.qos = append(this.qos, QOS(options&0x03))
+			consumedBytes += 1
+			continue
+		}
 		if buffer[consumedBytes] > 2 {
 			return fmt.Errorf("Invalid %s Control Packet QoS Level\n", PACKET_TYPE_STRINGS[this.packetType])
 		}
@@ -158,3 +204,10 @@ func (this *packet_subscribe) GetQoSs() []QOS {
 func (this *packet_subscribe) SetQoSs(qos []QOS) {
 	this.qos = qos
 }
+
+func (this *packet_subscribe) GetOptions() []byte {
+	return this.options
+}
+func (this *packet_subscribe) SetOptions(options []byte) {
+	this.options = options
+}
@@ -17,6 +17,10 @@ type PacketUnsubscribe interface {
 	//Payload
 	GetUnsubscribeTopics() []string
 	SetUnsubscribeTopics([]string)
+
+	//MQTT 5
+	GetProperties() Properties
+	SetProperties(p Properties)
 }
 
 ////////////////////Implementation////////////////////////
@@ -49,6 +53,7 @@ func (this *packet_unsubscribe) IBytize() []byte {
 	//Variable Header
 	buffer2.WriteByte(byte(this.packetId >> 8))
 	buffer2.WriteByte(byte(this.packetId & 0xFF))
+	this.EncodingProperties(&buffer2)
 
 	//Payload
 	for i := 0; i < len(this.topics); i++ {
@@ -103,7 +108,15 @@ func (this *packet_unsubscribe) IParse(buffer []byte) error {
 	if this.packetId = ((uint16(buffer[consumedBytes])) << 8) | uint16(buffer[consumedBytes+1]); this.packetId == 0 {
 		return fmt.Errorf("Invalid %s Control Packet PacketId 0\n", PACKET_TYPE_STRINGS[this.packetType])
 	}
-	if consumedBytes += 2; bufferLength < consumedBytes+3 {
+	consumedBytes += 2
+
+	this.properties = nil
+	if propertyBytes, err := this.DecodingProperties(buffer[consumedBytes:]); err != nil {
+		return err
+	} else {
+		consumedBytes += propertyBytes
+	}
+	if bufferLength < consumedBytes+3 {
 		return fmt.Errorf("Invalid %s Control Packet Must Have at least One Topic\n", PACKET_TYPE_STRINGS[this.packetType])
 	}
 
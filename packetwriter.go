@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+////////////////////Interface//////////////////////////////
+
+const (
+	OUTBOUND_QUEUE_SIZE  = 1024 //packets waiting to be written per session
+	PACKET_WRITER_BUFFER = 4096
+	WRITE_TIMEOUT        = 10 //seconds
+)
+
+////////////////////Implementation////////////////////////
+
+var errWriterClosed = errors.New("Packet Writer Closed\n")
+var errOutboundOverflow = errors.New("Outbound Queue Overflow\n")
+
+//packet_writer owns the writes to a connection. The packets sent from the
+//provider loop and from the connection's reader are queued on a bounded
+//channel, and written by a single goroutine which batches whatever is
+//queued into one flush
+type packet_writer struct {
+	conn      net.Conn
+	outbound  chan []byte
+	writer    *bufio.Writer
+	quit      chan bool
+	done      chan bool
+	closeOnce sync.Once
+
+	//held by Send across the closed check and the enqueue, so nothing is
+	//queued once Close has started
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func newPacketWriter(conn net.Conn, size int) *packet_writer {
+	this := &packet_writer{}
+
+	this.conn = conn
+	this.outbound = make(chan []byte, size)
+	this.writer = bufio.NewWriterSize(conn, PACKET_WRITER_BUFFER)
+	this.quit = make(chan bool)
+	this.done = make(chan bool)
+
+	return this
+}
+
+//Send queues buf without blocking, errOutboundOverflow is returned when
+//the queue is full and errWriterClosed after Close
+func (this *packet_writer) Send(buf []byte) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return errWriterClosed
+	}
+
+	select {
+	case this.outbound <- buf:
+		return nil
+	default:
+		return errOutboundOverflow
+	}
+}
+
+//Close writes what has been queued so far and stops the writer
+func (this *packet_writer) Close() {
+	this.closeOnce.Do(func() {
+		this.mutex.Lock()
+		this.closed = true
+		this.mutex.Unlock()
+		close(this.quit)
+	})
+	<-this.done
+}
+
+func (this *packet_writer) ServeWrite() {
+	defer close(this.done)
+
+	for {
+		select {
+		case buf := <-this.outbound:
+			if err := this.write(buf); err != nil {
+				log.Println(err)
+				//the reader notices the closed connection
+				this.conn.Close()
+				return
+			}
+		case <-this.quit:
+			//nothing is queued after quit is closed
+			for len(this.outbound) != 0 {
+				if err := this.write(<-this.outbound); err != nil {
+					log.Println(err)
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+//write writes buf and the packets queued after it with a single flush
+func (this *packet_writer) write(buf []byte) error {
+	this.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT * time.Second))
+	if _, err := this.writer.Write(buf); err != nil {
+		return err
+	}
+	//only this goroutine receives, so the queued packets stay queued
+	for n := len(this.outbound); n > 0; n-- {
+		if _, err := this.writer.Write(<-this.outbound); err != nil {
+			return err
+		}
+	}
+	return this.writer.Flush()
+}
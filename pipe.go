@@ -0,0 +1,251 @@
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+////////////////////Implementation////////////////////////
+
+//The pipe network connects transports in the same process by name, without
+//opening ports. Unlike net.Pipe the connections are buffered, since a
+//session and a client may both be writing acknowledgements at once
+
+var pipeListeners = make(map[string]*pipe_listener)
+var pipeMutex sync.Mutex
+
+type pipe_addr string
+
+func (this pipe_addr) Network() string {
+	return PIPE
+}
+
+func (this pipe_addr) String() string {
+	return string(this)
+}
+
+type pipe_timeout struct{}
+
+func (this pipe_timeout) Error() string   { return "i/o timeout" }
+func (this pipe_timeout) Timeout() bool   { return true }
+func (this pipe_timeout) Temporary() bool { return true }
+
+type pipe_listener struct {
+	addr     pipe_addr
+	conns    chan net.Conn
+	quit     chan bool
+	closed   sync.Once
+	deadline time.Time
+	mutex    sync.Mutex
+}
+
+func listenPipe(name string) (*pipe_listener, error) {
+	pipeMutex.Lock()
+	defer pipeMutex.Unlock()
+
+	if _, ok := pipeListeners[name]; ok {
+		return nil, &net.OpError{Op: "listen", Net: PIPE, Err: errors.New("address already in use")}
+	}
+
+	this := &pipe_listener{}
+
+	this.addr = pipe_addr(name)
+	this.conns = make(chan net.Conn)
+	this.quit = make(chan bool)
+	pipeListeners[name] = this
+
+	return this, nil
+}
+
+func dialPipe(name string) (net.Conn, error) {
+	pipeMutex.Lock()
+	l, ok := pipeListeners[name]
+	pipeMutex.Unlock()
+
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: PIPE, Err: errors.New("connection refused")}
+	}
+
+	a2b, b2a := newPipeBuffer(), newPipeBuffer()
+	local := &pipe_conn{local: pipe_addr(name + "#client"), remote: l.addr, in: b2a, out: a2b}
+	remote := &pipe_conn{local: l.addr, remote: local.local, in: a2b, out: b2a}
+
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.quit:
+		return nil, &net.OpError{Op: "dial", Net: PIPE, Err: errors.New("connection refused")}
+	}
+}
+
+func (this *pipe_listener) Accept() (net.Conn, error) {
+	this.mutex.Lock()
+	deadline := this.deadline
+	this.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.quit:
+		return nil, &net.OpError{Op: "accept", Net: PIPE, Err: errors.New("use of closed network connection")}
+	case <-timeout:
+		return nil, &net.OpError{Op: "accept", Net: PIPE, Err: pipe_timeout{}}
+	}
+}
+
+func (this *pipe_listener) SetDeadline(t time.Time) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.deadline = t
+	return nil
+}
+
+func (this *pipe_listener) Close() error {
+	this.closed.Do(func() {
+		pipeMutex.Lock()
+		delete(pipeListeners, string(this.addr))
+		pipeMutex.Unlock()
+		close(this.quit)
+	})
+	return nil
+}
+
+func (this *pipe_listener) Addr() net.Addr {
+	return this.addr
+}
+
+//pipe_buffer is one direction of a pipe_conn
+type pipe_buffer struct {
+	buf    []byte
+	closed bool
+	notify chan bool
+	mutex  sync.Mutex
+}
+
+func newPipeBuffer() *pipe_buffer {
+	return &pipe_buffer{notify: make(chan bool, 1)}
+}
+
+func (this *pipe_buffer) signal() {
+	select {
+	case this.notify <- true:
+	default:
+	}
+}
+
+func (this *pipe_buffer) close() {
+	this.mutex.Lock()
+	this.closed = true
+	this.mutex.Unlock()
+	this.signal()
+}
+
+type pipe_conn struct {
+	local  pipe_addr
+	remote pipe_addr
+	in     *pipe_buffer
+	out    *pipe_buffer
+
+	readDeadline time.Time
+	mutex        sync.Mutex
+}
+
+func (this *pipe_conn) Read(b []byte) (int, error) {
+	for {
+		this.in.mutex.Lock()
+		if len(this.in.buf) != 0 {
+			n := copy(b, this.in.buf)
+			this.in.buf = this.in.buf[n:]
+			if len(this.in.buf) != 0 {
+				this.in.signal()
+			}
+			this.in.mutex.Unlock()
+			return n, nil
+		}
+		closed := this.in.closed
+		this.in.mutex.Unlock()
+		if closed {
+			return 0, io.EOF
+		}
+
+		this.mutex.Lock()
+		deadline := this.readDeadline
+		this.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, &net.OpError{Op: "read", Net: PIPE, Addr: this.remote, Err: pipe_timeout{}}
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case <-this.in.notify:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-timeout:
+			return 0, &net.OpError{Op: "read", Net: PIPE, Addr: this.remote, Err: pipe_timeout{}}
+		}
+	}
+}
+
+func (this *pipe_conn) Write(b []byte) (int, error) {
+	this.out.mutex.Lock()
+	if this.out.closed {
+		this.out.mutex.Unlock()
+		return 0, &net.OpError{Op: "write", Net: PIPE, Addr: this.remote, Err: io.ErrClosedPipe}
+	}
+	this.out.buf = append(this.out.buf, b...)
+	this.out.mutex.Unlock()
+	this.out.signal()
+
+	return len(b), nil
+}
+
+func (this *pipe_conn) Close() error {
+	this.in.close()
+	this.out.close()
+	return nil
+}
+
+func (this *pipe_conn) LocalAddr() net.Addr {
+	return this.local
+}
+
+func (this *pipe_conn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+func (this *pipe_conn) SetDeadline(t time.Time) error {
+	return this.SetReadDeadline(t)
+}
+
+//writes never block, so only the read deadline applies
+func (this *pipe_conn) SetReadDeadline(t time.Time) error {
+	this.mutex.Lock()
+	this.readDeadline = t
+	this.mutex.Unlock()
+	this.in.signal()
+
+	return nil
+}
+
+func (this *pipe_conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,428 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+////////////////////Interface//////////////////////////////
+
+type PropertyId byte
+
+//MQTT 5 property identifiers
+const (
+	PROPERTY_PAYLOAD_FORMAT_INDICATOR          PropertyId = 0x01
+	PROPERTY_MESSAGE_EXPIRY_INTERVAL           PropertyId = 0x02
+	PROPERTY_CONTENT_TYPE                      PropertyId = 0x03
+	PROPERTY_RESPONSE_TOPIC                    PropertyId = 0x08
+	PROPERTY_CORRELATION_DATA                  PropertyId = 0x09
+	PROPERTY_SUBSCRIPTION_IDENTIFIER           PropertyId = 0x0B
+	PROPERTY_SESSION_EXPIRY_INTERVAL           PropertyId = 0x11
+	PROPERTY_ASSIGNED_CLIENT_IDENTIFIER        PropertyId = 0x12
+	PROPERTY_SERVER_KEEP_ALIVE                 PropertyId = 0x13
+	PROPERTY_AUTHENTICATION_METHOD             PropertyId = 0x15
+	PROPERTY_AUTHENTICATION_DATA               PropertyId = 0x16
+	PROPERTY_REQUEST_PROBLEM_INFORMATION       PropertyId = 0x17
+	PROPERTY_WILL_DELAY_INTERVAL               PropertyId = 0x18
+	PROPERTY_REQUEST_RESPONSE_INFORMATION      PropertyId = 0x19
+	PROPERTY_RESPONSE_INFORMATION              PropertyId = 0x1A
+	PROPERTY_SERVER_REFERENCE                  PropertyId = 0x1C
+	PROPERTY_REASON_STRING                     PropertyId = 0x1F
+	PROPERTY_RECEIVE_MAXIMUM                   PropertyId = 0x21
+	PROPERTY_TOPIC_ALIAS_MAXIMUM               PropertyId = 0x22
+	PROPERTY_TOPIC_ALIAS                       PropertyId = 0x23
+	PROPERTY_MAXIMUM_QOS                       PropertyId = 0x24
+	PROPERTY_RETAIN_AVAILABLE                  PropertyId = 0x25
+	PROPERTY_USER_PROPERTY                     PropertyId = 0x26
+	PROPERTY_MAXIMUM_PACKET_SIZE               PropertyId = 0x27
+	PROPERTY_WILDCARD_SUBSCRIPTION_AVAILABLE   PropertyId = 0x28
+	PROPERTY_SUBSCRIPTION_IDENTIFIER_AVAILABLE PropertyId = 0x29
+	PROPERTY_SHARED_SUBSCRIPTION_AVAILABLE     PropertyId = 0x2A
+)
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+//Properties of an MQTT 5 packet. Integer properties of any width are read
+//and written with GetInt and SetInt, UTF-8 strings with GetString and
+//SetString, binary data with GetBinary and SetBinary. The subscription
+//identifier and user property may occur more than once
+type Properties interface {
+	Has(id PropertyId) bool
+	Delete(id PropertyId)
+	Len() int
+
+	GetInt(id PropertyId) uint32
+	SetInt(id PropertyId, value uint32)
+
+	GetString(id PropertyId) string
+	SetString(id PropertyId, value string)
+
+	GetBinary(id PropertyId) []byte
+	SetBinary(id PropertyId, value []byte)
+
+	GetSubscriptionIdentifiers() []uint32
+	AddSubscriptionIdentifier(value uint32)
+
+	GetUserProperties() []UserProperty
+	AddUserProperty(key string, value string)
+
+	Copy() Properties
+}
+
+////////////////////Implementation////////////////////////
+
+type property_type byte
+
+const (
+	property_byte property_type = iota
+	property_two_byte_integer
+	property_four_byte_integer
+	property_variable_byte_integer
+	property_utf8_string
+	property_binary_data
+	property_utf8_string_pair
+)
+
+var propertyTypes = map[PropertyId]property_type{
+	PROPERTY_PAYLOAD_FORMAT_INDICATOR:          property_byte,
+	PROPERTY_MESSAGE_EXPIRY_INTERVAL:           property_four_byte_integer,
+	PROPERTY_CONTENT_TYPE:                      property_utf8_string,
+	PROPERTY_RESPONSE_TOPIC:                    property_utf8_string,
+	PROPERTY_CORRELATION_DATA:                  property_binary_data,
+	PROPERTY_SUBSCRIPTION_IDENTIFIER:           property_variable_byte_integer,
+	PROPERTY_SESSION_EXPIRY_INTERVAL:           property_four_byte_integer,
+	PROPERTY_ASSIGNED_CLIENT_IDENTIFIER:        property_utf8_string,
+	PROPERTY_SERVER_KEEP_ALIVE:                 property_two_byte_integer,
+	PROPERTY_AUTHENTICATION_METHOD:             property_utf8_string,
+	PROPERTY_AUTHENTICATION_DATA:               property_binary_data,
+	PROPERTY_REQUEST_PROBLEM_INFORMATION:       property_byte,
+	PROPERTY_WILL_DELAY_INTERVAL:               property_four_byte_integer,
+	PROPERTY_REQUEST_RESPONSE_INFORMATION:      property_byte,
+	PROPERTY_RESPONSE_INFORMATION:              property_utf8_string,
+	PROPERTY_SERVER_REFERENCE:                  property_utf8_string,
+	PROPERTY_REASON_STRING:                     property_utf8_string,
+	PROPERTY_RECEIVE_MAXIMUM:                   property_two_byte_integer,
+	PROPERTY_TOPIC_ALIAS_MAXIMUM:               property_two_byte_integer,
+	PROPERTY_TOPIC_ALIAS:                       property_two_byte_integer,
+	PROPERTY_MAXIMUM_QOS:                       property_byte,
+	PROPERTY_RETAIN_AVAILABLE:                  property_byte,
+	PROPERTY_USER_PROPERTY:                     property_utf8_string_pair,
+	PROPERTY_MAXIMUM_PACKET_SIZE:               property_four_byte_integer,
+	PROPERTY_WILDCARD_SUBSCRIPTION_AVAILABLE:   property_byte,
+	PROPERTY_SUBSCRIPTION_IDENTIFIER_AVAILABLE: property_byte,
+	PROPERTY_SHARED_SUBSCRIPTION_AVAILABLE:     property_byte,
+}
+
+type properties struct {
+	ints            map[PropertyId]uint32
+	strings         map[PropertyId]string
+	binaries        map[PropertyId][]byte
+	subscriptionIds []uint32
+	users           []UserProperty
+}
+
+func NewProperties() Properties {
+	return newProperties()
+}
+
+func newProperties() *properties {
+	this := &properties{}
+
+	this.ints = make(map[PropertyId]uint32)
+	this.strings = make(map[PropertyId]string)
+	this.binaries = make(map[PropertyId][]byte)
+
+	return this
+}
+
+func (this *properties) Has(id PropertyId) bool {
+	switch id {
+	case PROPERTY_SUBSCRIPTION_IDENTIFIER:
+		return len(this.subscriptionIds) != 0
+	case PROPERTY_USER_PROPERTY:
+		return len(this.users) != 0
+	}
+	_, i := this.ints[id]
+	_, s := this.strings[id]
+	_, b := this.binaries[id]
+	return i || s || b
+}
+
+func (this *properties) Delete(id PropertyId) {
+	switch id {
+	case PROPERTY_SUBSCRIPTION_IDENTIFIER:
+		this.subscriptionIds = nil
+	case PROPERTY_USER_PROPERTY:
+		this.users = nil
+	}
+	delete(this.ints, id)
+	delete(this.strings, id)
+	delete(this.binaries, id)
+}
+
+func (this *properties) Len() int {
+	return len(this.ints) + len(this.strings) + len(this.binaries) + len(this.subscriptionIds) + len(this.users)
+}
+
+func (this *properties) GetInt(id PropertyId) uint32 {
+	return this.ints[id]
+}
+func (this *properties) SetInt(id PropertyId, value uint32) {
+	this.ints[id] = value
+}
+
+func (this *properties) GetString(id PropertyId) string {
+	return this.strings[id]
+}
+func (this *properties) SetString(id PropertyId, value string) {
+	this.strings[id] = value
+}
+
+func (this *properties) GetBinary(id PropertyId) []byte {
+	return this.binaries[id]
+}
+func (this *properties) SetBinary(id PropertyId, value []byte) {
+	this.binaries[id] = value
+}
+
+func (this *properties) GetSubscriptionIdentifiers() []uint32 {
+	return this.subscriptionIds
+}
+func (this *properties) AddSubscriptionIdentifier(value uint32) {
+	this.subscriptionIds = append(this.subscriptionIds, value)
+}
+
+func (this *properties) GetUserProperties() []UserProperty {
+	return this.users
+}
+func (this *properties) AddUserProperty(key string, value string) {
+	this.users = append(this.users, UserProperty{Key: key, Value: value})
+}
+
+func (this *properties) Copy() Properties {
+	that := newProperties()
+
+	for id, value := range this.ints {
+		that.ints[id] = value
+	}
+	for id, value := range this.strings {
+		that.strings[id] = value
+	}
+	for id, value := range this.binaries {
+		that.binaries[id] = value
+	}
+	that.subscriptionIds = append(that.subscriptionIds, this.subscriptionIds...)
+	that.users = append(that.users, this.users...)
+
+	return that
+}
+
+//Encoding writes the property length followed by the properties, in the
+//order of their identifiers. A property set with the accessor of another
+//type is skipped
+func (this *properties) Encoding() []byte {
+	var buffer bytes.Buffer
+	var buffer2 bytes.Buffer
+
+	var ids []int
+	for id := range this.ints {
+		ids = append(ids, int(id))
+	}
+	for id := range this.strings {
+		ids = append(ids, int(id))
+	}
+	for id := range this.binaries {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	for _, i := range ids {
+		id := PropertyId(i)
+		switch propertyTypes[id] {
+		case property_byte:
+			if value, ok := this.ints[id]; ok {
+				buffer2.WriteByte(byte(id))
+				buffer2.WriteByte(byte(value))
+			}
+		case property_two_byte_integer:
+			if value, ok := this.ints[id]; ok {
+				buffer2.WriteByte(byte(id))
+				buffer2.WriteByte(byte(value >> 8))
+				buffer2.WriteByte(byte(value & 0xFF))
+			}
+		case property_four_byte_integer:
+			if value, ok := this.ints[id]; ok {
+				buffer2.WriteByte(byte(id))
+				buffer2.WriteByte(byte(value >> 24))
+				buffer2.WriteByte(byte(value >> 16))
+				buffer2.WriteByte(byte(value >> 8))
+				buffer2.WriteByte(byte(value & 0xFF))
+			}
+		case property_utf8_string:
+			if value, ok := this.strings[id]; ok {
+				buffer2.WriteByte(byte(id))
+				buffer2.Write(encodingUTF8(value))
+			}
+		case property_binary_data:
+			if value, ok := this.binaries[id]; ok {
+				buffer2.WriteByte(byte(id))
+				buffer2.Write(encodingUTF8(string(value)))
+			}
+		}
+	}
+	for _, value := range this.subscriptionIds {
+		buffer2.WriteByte(byte(PROPERTY_SUBSCRIPTION_IDENTIFIER))
+		buffer2.Write(encodingVariableByteInteger(value))
+	}
+	for _, user := range this.users {
+		buffer2.WriteByte(byte(PROPERTY_USER_PROPERTY))
+		buffer2.Write(encodingUTF8(user.Key))
+		buffer2.Write(encodingUTF8(user.Value))
+	}
+
+	buffer.Write(encodingVariableByteInteger(uint32(buffer2.Len())))
+	buffer.Write(buffer2.Bytes())
+
+	return buffer.Bytes()
+}
+
+func encodingProperties(p Properties) []byte {
+	switch p := p.(type) {
+	case nil:
+		return []byte{0}
+	case *properties:
+		if p == nil {
+			return []byte{0}
+		}
+		return p.Encoding()
+	}
+	return p.Copy().(*properties).Encoding()
+}
+
+//decodingProperties reads the property length and the properties, and
+//returns the number of bytes consumed
+func decodingProperties(buffer []byte) (*properties, uint32, error) {
+	length, consumedBytes, err := decodingVariableByteInteger(buffer)
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint32(len(buffer)) < consumedBytes+length {
+		return nil, 0, errors.New("Malformed Property Length")
+	}
+	buffer = buffer[consumedBytes : consumedBytes+length]
+
+	this := newProperties()
+	for i := uint32(0); i < length; {
+		id := PropertyId(buffer[i])
+		i++
+
+		propertyType, ok := propertyTypes[id]
+		if !ok {
+			return nil, 0, fmt.Errorf("Invalid Property Identifier %02x", id)
+		}
+		if this.Has(id) && id != PROPERTY_USER_PROPERTY && id != PROPERTY_SUBSCRIPTION_IDENTIFIER {
+			return nil, 0, fmt.Errorf("Duplicated Property %02x", id)
+		}
+
+		var n uint32
+		switch propertyType {
+		case property_byte:
+			n = 1
+		case property_two_byte_integer:
+			n = 2
+		case property_four_byte_integer:
+			n = 4
+		}
+		if length < i+n {
+			return nil, 0, fmt.Errorf("Malformed Property %02x", id)
+		}
+
+		switch propertyType {
+		case property_byte:
+			this.ints[id] = uint32(buffer[i])
+		case property_two_byte_integer:
+			this.ints[id] = (uint32(buffer[i]) << 8) | uint32(buffer[i+1])
+		case property_four_byte_integer:
+			this.ints[id] = (uint32(buffer[i]) << 24) | (uint32(buffer[i+1]) << 16) | (uint32(buffer[i+2]) << 8) | uint32(buffer[i+3])
+		case property_variable_byte_integer:
+			value, m, err := decodingVariableByteInteger(buffer[i:])
+			if err != nil || value == 0 {
+				return nil, 0, fmt.Errorf("Malformed Property %02x", id)
+			}
+			this.subscriptionIds = append(this.subscriptionIds, value)
+			n = m
+		case property_utf8_string, property_binary_data:
+			value, m, err := decodingUTF8(buffer[i:])
+			if err != nil {
+				return nil, 0, fmt.Errorf("Malformed Property %02x", id)
+			}
+			if propertyType == property_utf8_string {
+				this.strings[id] = value
+			} else {
+				this.binaries[id] = []byte(value)
+			}
+			n = m
+		case property_utf8_string_pair:
+			key, m, err := decodingUTF8(buffer[i:])
+			if err != nil {
+				return nil, 0, fmt.Errorf("Malformed Property %02x", id)
+			}
+			value, m2, err := decodingUTF8(buffer[i+m:])
+			if err != nil {
+				return nil, 0, fmt.Errorf("Malformed Property %02x", id)
+			}
+			this.users = append(this.users, UserProperty{Key: key, Value: value})
+			n = m + m2
+		}
+		i += n
+	}
+
+	return this, consumedBytes + length, nil
+}
+
+//encodingVariableByteInteger also encodes 0, as the single byte 0x00
+func encodingVariableByteInteger(X uint32) []byte {
+	var buffer bytes.Buffer
+
+	for {
+		encodedByte := byte(X % 128)
+		X = X / 128
+		if X > 0 {
+			encodedByte = encodedByte | 128
+		}
+		buffer.WriteByte(encodedByte)
+		if X == 0 {
+			break
+		}
+	}
+
+	return buffer.Bytes()
+}
+
+func decodingVariableByteInteger(buffer []byte) (uint32, uint32, error) {
+	value := uint32(0)
+	for i := 0; i < 4; i++ {
+		if len(buffer) <= i {
+			break
+		}
+		value |= uint32(buffer[i]&127) << (7 * uint(i))
+		if buffer[i]&128 == 0 {
+			return value, uint32(i + 1), nil
+		}
+	}
+
+	return 0, 0, errors.New("Malformed Variable Byte Integer")
+}
+
+func encodingUTF8(U string) []byte {
+	return (&packet{}).EncodingUTF8(U)
+}
+
+func decodingUTF8(buffer []byte) (string, uint32, error) {
+	return (&packet{}).DecodingUTF8(buffer)
+}
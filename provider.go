@@ -1,16 +1,28 @@
 package mqtt
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 ////////////////////Interface//////////////////////////////
 
+const (
+	CLIENT_ID_PREFIX    = "auto-"
+	DISPATCH_QUEUE_SIZE = 1024 //messages waiting per dispatch worker
+	DRAIN_INTERVAL      = 10   //milliseconds between the checks of a draining provider
+)
+
 type Provider interface {
 	AddTransport(t Transport)
 	GetTransports() []Transport
@@ -19,20 +31,130 @@ type Provider interface {
 	AddListener(l Listener)
 	RemoveListener(l Listener)
 
+	SetQueueLimits(maxMessages int, maxBytes int)
+	SetQueuePolicy(policy QueuePolicy)
+
+	//packets waiting to be written to a connection, a slow consumer whose
+	//queue is full loses QoS 0 messages and is disconnected otherwise
+	SetOutboundQueueSize(size int)
+
+	//messages are delivered to the subscribers by dispatch workers, each
+	//serving a share of the sessions, runtime.NumCPU() by default. The
+	//sessions keep their share, so the number of workers can only be set
+	//before Run, an error is returned afterwards
+	GetDispatchWorkers() int
+	SetDispatchWorkers(workers int) error
+	SetQos2Delivery(mode Qos2Delivery)
+	SetOverlapDelivery(mode OverlapDelivery)
+
+	//the retained store is read by the sessions without locking, so it can
+	//only be set before Run, an error is returned afterwards
+	GetRetainedStore() RetainedStore
+	SetRetainedStore(rs RetainedStore) error
+
+	//the persistent sessions are restored from the store by Run and keep
+	//writing to it, so it can only be set before Run, an error is returned
+	//afterwards
+	GetStore() Store
+	SetStore(store Store) error
+
+	GetAuthenticator() Authenticator
+	SetAuthenticator(a Authenticator) //nil accepts every CONNECT
+
+	GetAuthorizer() Authorizer
+	SetAuthorizer(a Authorizer) //nil allows every topic
+
+	//clients connecting with a zero-length client identifier are assigned
+	//the prefix followed by a unique suffix
+	GetClientIdPrefix() string
+	SetClientIdPrefix(prefix string)
+
+	//connections sending a larger packet are closed before it is read, 0
+	//allows up to PACKET_SIZE_MAX
+	GetMaxPacketSize() uint32
+	SetMaxPacketSize(size uint32)
+
 	Forward(m Message)
+
+	Run()
+	//Stop stops accepting connections and lets the sessions finish their
+	//QoS 1 and 2 flows and write their queued packets until ctx is done,
+	//then disconnects them. A *ShutdownError reports what was abandoned
+	Stop(ctx context.Context) error
+}
+
+//ShutdownError is returned by Stop when ctx was done before the provider
+//drained, with the work abandoned by client identifier
+type ShutdownError struct {
+	Err        error          //ctx.Err()
+	Inflights  map[string]int //QoS 1 and 2 messages sent and not acknowledged
+	Inbounds   map[string]int //QoS 2 messages received and not released
+	Outbound   map[string]int //packets queued and not written
+	Dispatches int            //messages not delivered to the subscribers yet
+}
+
+func (this *ShutdownError) Error() string {
+	count := func(m map[string]int) (n int) {
+		for _, v := range m {
+			n += v
+		}
+		return n
+	}
+	return fmt.Sprintf("Provider Stopped with %d Inflight, %d Inbound, %d Outbound Packets and %d Dispatches Abandoned: %v\n",
+		count(this.Inflights), count(this.Inbounds), count(this.Outbound), this.Dispatches, this.Err)
+}
+
+func (this *ShutdownError) Unwrap() error {
+	return this.Err
+}
+
+func (this *ShutdownError) empty() bool {
+	return len(this.Inflights) == 0 && len(this.Inbounds) == 0 && len(this.Outbound) == 0 && this.Dispatches == 0
 }
 
 ////////////////////Implementation////////////////////////
 
+//delivery is a message for the matching sessions of one dispatch worker
+type delivery struct {
+	msg      Message
+	sessions map[Session]map[string]QOS
+}
+
 type provider struct {
 	listeners       map[Listener]Listener
 	transports 		map[Transport]Transport
 	sessions   		map[Session]*session
-
-	forward   chan Message
-	join      chan *session
-	leave	  chan *session
+	clients         map[string]*session //sessions by client identifier
+	tree            TopicTree
+	retained        RetainedStore
+	store           Store
+	authenticator   Authenticator
+	authorizer      Authorizer
+	clientIdPrefix  string
+	clientIds       uint64 //identifiers assigned so far
+	maxPacketSize   uint32
+	mutex           sync.Mutex
+	options         sync.RWMutex //guards the settings read by new sessions
+
+	queueMaxMessages int
+	queueMaxBytes    int
+	queuePolicy      QueuePolicy
+
+	outboundQueueSize int
+
+	qos2Delivery    Qos2Delivery
+	overlapDelivery OverlapDelivery
+
+	running     bool //Run was called, guarded by options
+	workers     []chan delivery
+	shards      uint32 //sessions assigned to the workers so far
+	dispatching int64  //deliveries queued and not finished by the workers
+	join        chan *session
+	leave	    chan *session
 	
+	stopping  chan bool //closed when Stop starts draining
+	stopOnce  sync.Once
+	stopErr   error //returned by every call to Stop
 	quit      chan bool
 	waitGroup *sync.WaitGroup
 }
@@ -43,10 +165,25 @@ func newProvider() *provider {
 	this.listeners = make(map[Listener]Listener)
 	this.transports = make(map[Transport]Transport)
 	this.sessions = make(map[Session]*session)
-
-	this.forward = make(chan Message)
+	this.clients = make(map[string]*session)
+	this.tree = NewTopicTree()
+	this.store = NewMemoryStore()
+	this.retained = this.store
+	this.clientIdPrefix = CLIENT_ID_PREFIX
+	this.maxPacketSize = PACKET_SIZE_DEFAULT
+
+	this.queueMaxMessages = QUEUE_MAX_MESSAGES
+	this.queueMaxBytes = QUEUE_MAX_BYTES
+	this.queuePolicy = QUEUE_DROP_OLDEST
+	this.outboundQueueSize = OUTBOUND_QUEUE_SIZE
+
+	this.qos2Delivery = QOS2_DELIVERY_ON_PUBLISH
+	this.overlapDelivery = OVERLAP_DELIVERY_MAX_QOS
+
+	this.SetDispatchWorkers(runtime.NumCPU())
 	this.join = make(chan *session)
 	this.leave = make(chan *session)
+	this.stopping = make(chan bool)
 	
 	this.quit = make(chan bool)
 	this.waitGroup = &sync.WaitGroup{}
@@ -82,7 +219,233 @@ func (this *provider) RemoveListener(l Listener) {
 	delete(this.listeners, l)
 }
 
+func (this *provider) SetQueueLimits(maxMessages int, maxBytes int) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.queueMaxMessages = maxMessages
+	this.queueMaxBytes = maxBytes
+}
+
+func (this *provider) SetQueuePolicy(policy QueuePolicy) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.queuePolicy = policy
+}
+
+func (this *provider) SetOutboundQueueSize(size int) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.outboundQueueSize = size
+}
+
+func (this *provider) GetDispatchWorkers() int {
+	this.options.RLock()
+	defer this.options.RUnlock()
+
+	return len(this.workers)
+}
+
+func (this *provider) SetDispatchWorkers(workers int) error {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	if this.running {
+		return errors.New("Dispatch Workers Set after Run\n")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	this.workers = make([]chan delivery, workers)
+	for i := 0; i < workers; i++ {
+		this.workers[i] = make(chan delivery, DISPATCH_QUEUE_SIZE)
+	}
+
+	return nil
+}
+
+//NextShard assigns a new session to a dispatch worker
+func (this *provider) NextShard() int {
+	return int(atomic.AddUint32(&this.shards, 1) % uint32(len(this.workers)))
+}
+
+func (this *provider) SetQos2Delivery(mode Qos2Delivery) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.qos2Delivery = mode
+}
+
+func (this *provider) SetOverlapDelivery(mode OverlapDelivery) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.overlapDelivery = mode
+}
+
+func (this *provider) GetRetainedStore() RetainedStore {
+	return this.retained
+}
+
+func (this *provider) SetRetainedStore(rs RetainedStore) error {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	if this.running {
+		return errors.New("Retained Store Set after Run\n")
+	}
+	this.retained = rs
+
+	return nil
+}
+
+func (this *provider) GetStore() Store {
+	return this.store
+}
+
+//SetStore replaces the session store, which is also used as retained store
+func (this *provider) SetStore(store Store) error {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	if this.running {
+		return errors.New("Store Set after Run\n")
+	}
+	this.store = store
+	this.retained = store
+
+	return nil
+}
+
+func (this *provider) GetAuthenticator() Authenticator {
+	this.options.RLock()
+	defer this.options.RUnlock()
+
+	return this.authenticator
+}
+
+func (this *provider) SetAuthenticator(a Authenticator) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.authenticator = a
+}
+
+func (this *provider) GetAuthorizer() Authorizer {
+	this.options.RLock()
+	defer this.options.RUnlock()
+
+	return this.authorizer
+}
+
+func (this *provider) SetAuthorizer(a Authorizer) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.authorizer = a
+}
+
+func (this *provider) Authorize(s Session, topic string, access AclAccess) bool {
+	authorizer := this.GetAuthorizer()
+	return authorizer == nil || authorizer.Authorize(s, topic, access)
+}
+
+func (this *provider) GetClientIdPrefix() string {
+	this.options.RLock()
+	defer this.options.RUnlock()
+
+	return this.clientIdPrefix
+}
+
+func (this *provider) SetClientIdPrefix(prefix string) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.clientIdPrefix = prefix
+}
+
+func (this *provider) GetMaxPacketSize() uint32 {
+	this.options.RLock()
+	defer this.options.RUnlock()
+
+	return this.maxPacketSize
+}
+
+func (this *provider) SetMaxPacketSize(size uint32) {
+	this.options.Lock()
+	defer this.options.Unlock()
+
+	this.maxPacketSize = size
+}
+
+//AssignClientId generates the identifier of a client connecting with a
+//zero-length one. The random part keeps it unique across restarts, the
+//counter within this provider
+func (this *provider) AssignClientId() string {
+	var nonce [8]byte
+	rand.Read(nonce[:])
+
+	this.mutex.Lock()
+	this.clientIds++
+	n := this.clientIds
+	this.mutex.Unlock()
+
+	return fmt.Sprintf("%s%s-%d", this.GetClientIdPrefix(), hex.EncodeToString(nonce[:]), n)
+}
+
+//Restore recreates the sessions with CleanSession=0 saved in the store as
+//offline sessions, which queue messages until their clients reconnect
+func (this *provider) Restore() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now()
+	for _, clientId := range this.store.GetSessions() {
+		s := newSession(nil, this)
+		s.state = SESSION_STATE_TERMINATED
+		s.err = errors.New("Session Restored\n")
+		s.clientId = clientId
+		s.cleanSession = false
+		s.expiryInterval, s.disconnectTime = this.store.GetSession(clientId)
+		//the expiry interval runs from the restart when the session was
+		//connected at the shutdown
+		if s.disconnectTime.IsZero() {
+			s.disconnectTime = now
+		}
+
+		options := this.store.GetSubscriptionOptions(clientId)
+		for sub, qos := range this.store.GetSubscriptions(clientId) {
+			s.topics[sub] = sub
+			s.qos[sub] = qos
+			s.options[sub] = options[sub]
+			this.tree.Subscribe(s, sub, qos)
+		}
+		for packetId, msg := range this.store.GetInflights(clientId) {
+			s.PacketIds[uint32(packetId)] = packetId
+			s.inflights[packetId] = &inflight{msg: msg, released: msg == nil, timestamp: now}
+			if packetId >= s.packetId {
+				s.packetId = packetId + 1
+			}
+		}
+		if s.packetId == 0 {
+			s.packetId = 1
+		}
+		s.queue.restore(this.store, clientId)
+
+		this.clients[clientId] = s
+	}
+}
+
 func (this *provider) Run() {
+	//the workers don't change anymore once running
+	this.options.Lock()
+	this.running = true
+	this.options.Unlock()
+
+	this.Restore()
+
 	for _, t := range this.transports {
 		if err := t.Listen(); err != nil {
 			log.Printf("Listening %s://%s:%d Failed!!!\n", t.GetNetwork(), t.GetAddress(), t.GetPort())
@@ -92,59 +455,213 @@ func (this *provider) Run() {
 			go this.ServeAccept(t.(*transport))
 		}
 	}
+	for _, work := range this.workers {
+		this.waitGroup.Add(1)
+		go this.ServeDispatch(work)
+	}
 	
+	expire := time.NewTicker(time.Second)
+	defer expire.Stop()
+
 	//infinite loop run until ctrl+c
 	for {
 		select {
+		case now := <-expire.C:
+			this.Expire(now)
 		case s := <-this.join:
-			this.sessions[s] = s
+			if !this.Join(s) {
+				s.Terminate(errors.New("Provider Stopping\n"))
+			}
 		case s := <-this.leave:
+			this.mutex.Lock()
 			delete(this.sessions, s)
-		case msg := <-this.forward:
-			for _, s := range this.sessions {
-				if err := s.Forward(msg); err != nil {
+			this.mutex.Unlock()
+		case <-this.quit:
+			log.Println("ServeForward Quit")
+			return
+		}
+	}
+}
+
+//Join registers a connection's session, unless the provider is stopping
+func (this *provider) Join(s *session) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	select {
+	case <-this.stopping:
+		return false
+	default:
+	}
+	this.sessions[s] = s
+	return true
+}
+
+//Expire forgets the offline sessions whose session expiry interval has
+//elapsed since their disconnection
+func (this *provider) Expire(now time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for clientId, s := range this.clients {
+		if s.disconnectTime.IsZero() || s.expiryInterval == SESSION_EXPIRY_NEVER {
+			continue
+		}
+		if now.Sub(s.disconnectTime) >= time.Duration(s.expiryInterval)*time.Second {
+			log.Println("Session Expired", clientId)
+			this.tree.Remove(s)
+			delete(this.clients, clientId)
+			this.store.DeleteSession(clientId)
+			s.queue.persist(nil, "")
+		}
+	}
+}
+
+//ServeDispatch delivers the messages queued for the sessions of a worker.
+//A session only writes to its outbound queue, so a slow subscriber doesn't
+//hold up the others
+func (this *provider) ServeDispatch(work chan delivery) {
+	defer this.waitGroup.Done()
+
+	for {
+		select {
+		case d := <-work:
+			encoded := make(map[byte][]byte)
+			for s, subs := range d.sessions {
+				if err := s.(*session).Dispatch(d.msg, subs, encoded); err != nil {
 					log.Println(err)
-					for _, l := range this.listeners {
-						l.ProcessIOException(newEventIOException(s, s.conn.RemoteAddr()))
-					}
 				}
 			}
+			atomic.AddInt64(&this.dispatching, -1)
 		case <-this.quit:
-			log.Println("ServeForward Quit")
 			return
 		}
 	}
 }
 
-func (this *provider) Stop() {
-	this.quit <- true
-	for _, s := range this.sessions {
-		s.Terminate(errors.New("Provider Stopped\n"))
-	}
+//Stop only stops the provider once, a later or concurrent call waits for the
+//first one and returns its result
+func (this *provider) Stop(ctx context.Context) error {
+	this.stopOnce.Do(func() {
+		this.stopErr = this.stop(ctx)
+	})
+	return this.stopErr
+}
+
+func (this *provider) stop(ctx context.Context) error {
+	close(this.stopping)
 	for _, t := range this.transports {
 		t.Close()
 	}
-	this.waitGroup.Wait()
+
+	var abandoned *ShutdownError
+	if !this.Drain(ctx) {
+		abandoned = this.Pending()
+		abandoned.Err = ctx.Err()
+	}
+	close(this.quit)
+
+	sessions := this.Sessions()
+	for _, s := range sessions {
+		s.Disconnect(REASON_SERVER_SHUTTING_DOWN)
+		s.Terminate(errors.New("Provider Stopped\n"))
+	}
+
+	done := make(chan bool)
+	go func() {
+		this.waitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		//the connections which are still written to are dropped
+		for _, s := range sessions {
+			s.conn.Close()
+		}
+		<-done
+	}
+
+	//the persistent sessions have been detached, and are resumed from the
+	//store by the next Run
+	if err := this.store.Sync(); err != nil {
+		log.Println("Syncing Store", err)
+		if abandoned == nil {
+			return err
+		}
+	}
+	if abandoned != nil {
+		return abandoned
+	}
+	return nil
+}
+
+//Drain waits until the connected sessions and the dispatch workers have
+//nothing pending. It returns false when ctx is done first
+func (this *provider) Drain(ctx context.Context) bool {
+	ticker := time.NewTicker(DRAIN_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+
+	for !this.Pending().empty() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+//Pending collects the work left to the connected sessions and the dispatch
+//workers
+func (this *provider) Pending() *ShutdownError {
+	pending := &ShutdownError{
+		Inflights:  make(map[string]int),
+		Inbounds:   make(map[string]int),
+		Outbound:   make(map[string]int),
+		Dispatches: int(atomic.LoadInt64(&this.dispatching)),
+	}
+	for _, s := range this.Sessions() {
+		inflights, inbounds, outbound := s.Pending()
+		if inflights != 0 {
+			pending.Inflights[s.clientId] += inflights
+		}
+		if inbounds != 0 {
+			pending.Inbounds[s.clientId] += inbounds
+		}
+		if outbound != 0 {
+			pending.Outbound[s.clientId] += outbound
+		}
+	}
+	return pending
+}
+
+//Sessions returns the sessions of the served connections
+func (this *provider) Sessions() []*session {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	sessions := make([]*session, 0, len(this.sessions))
+	for _, s := range this.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
 }
 
 func (this *provider) ServeAccept(t *transport) {
 	defer this.waitGroup.Done()
-	defer t.lner.Close()
 
 	for {
-		select {
-		case <-t.quit:
-			log.Printf("Listening %s://%s:%d Stoped!!!\n", t.GetNetwork(), t.GetAddress(), t.GetPort())
-			return
-		default:
-			//can't delete default, otherwise blocking call
-		}
-		t.SetDeadline(time.Now().Add(1e9))
+		//Close unblocks Accept, which then fails
 		conn, err := t.Accept()
 		if err != nil {
-			if opErr, ok := err.(*net.OpError); !(ok && opErr.Timeout()) {
-				log.Println(err)
+			select {
+			case <-t.quit:
+				log.Printf("Listening %s://%s:%d Stoped!!!\n", t.GetNetwork(), t.GetAddress(), t.GetPort())
+				return
+			default:
 			}
+			log.Println(err)
 			continue
 		}
 		this.waitGroup.Add(1)
@@ -156,8 +673,27 @@ func (this *provider) ServeConn(conn net.Conn) {
 	defer this.waitGroup.Done()
 	defer conn.Close()
 
-	s := newSession(conn)
-	this.join <- s
+	//TLS is negotiated here rather than in Accept, so a slow peer doesn't
+	//hold up the listener
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		tlsconn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT * time.Second))
+		if err := tlsconn.Handshake(); err != nil {
+			log.Println("TLS Handshake", conn.RemoteAddr(), err)
+			return
+		}
+		tlsconn.SetDeadline(time.Time{})
+	}
+
+	s := newSession(conn, this)
+	defer close(s.done)
+	go s.writer.ServeWrite()
+	defer s.writer.Close()
+	reader := NewPacketReader(conn, this.GetMaxPacketSize())
+	select {
+	case this.join <- s:
+	case <-this.quit:
+		return
+	}
 
 	var buf []byte
 	var err error
@@ -165,16 +701,32 @@ func (this *provider) ServeConn(conn net.Conn) {
 		select {
 		case <-s.quit:
 			log.Println("Disconnecting", conn.RemoteAddr())
+			will := s.Will()
+			if will != nil && !this.Authorize(s, will.GetTopic(), ACL_WRITE) {
+				log.Println("Will Not Authorized", s.GetClientId(), will.GetTopic())
+				will = nil
+			}
 			for _, l := range this.listeners {
-				l.ProcessSessionTerminated(newEventSessionTerminated(s, s.Error(), s.Will()))
+				l.ProcessSessionTerminated(newEventSessionTerminated(s, s.Error(), will))
+			}
+			this.Detach(s)
+			select {
+			case this.leave <- s:
+			case <-this.quit:
 			}
-			this.leave <- s
 			return
 		default:
 			//can't delete default, otherwise blocking call
 		}
 
-		if buf, err = this.ReadPacket(conn); err != nil {
+		if s.Retransmit(time.Now()) {
+			for _, l := range this.listeners {
+				l.ProcessTimeout(newEventTimeout(s, TIMEOUT_RETRANSMIT))
+			}
+		}
+
+		conn.SetReadDeadline(time.Now().Add(1e9)) //wait for 1 second
+		if buf, err = reader.ReadPacket(); err != nil {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 				s.keepAliveAccumulated += 1 //add 1 second
 				if s.keepAlive != 0 && s.keepAliveAccumulated >= (s.keepAlive*3)/2 {
@@ -182,12 +734,22 @@ func (this *provider) ServeConn(conn net.Conn) {
 					for _, l := range this.listeners {
 						l.ProcessTimeout(newEventTimeout(s, TIMEOUT_SESSION))
 					}
+					s.Disconnect(REASON_KEEP_ALIVE_TIMEOUT)
 					s.Terminate(errors.New("Timeout"))
 				} else {
 					continue
 				}
 			} else {
+				select {
+				case <-s.quit:
+					//the connection was closed by a takeover
+					continue
+				default:
+				}
 				log.Println(err)
+				if err == errPacketTooLarge {
+					s.Disconnect(REASON_PACKET_TOO_LARGE)
+				}
 				for _, l := range this.listeners {
 					l.ProcessIOException(newEventIOException(s, conn.RemoteAddr()))
 				}
@@ -198,6 +760,16 @@ func (this *provider) ServeConn(conn net.Conn) {
 			if evt := s.Process(buf); evt != nil {
 				switch evt.GetEventType() {
 				case EVENT_CONNECT:
+					if authenticator := this.GetAuthenticator(); authenticator != nil {
+						if returnCode := authenticator.Authenticate(evt.(EventConnect)); returnCode != CONNACK_RETURNCODE_ACCEPTED {
+							pktconnack := NewPacketConnack()
+							pktconnack.SetReturnCode(returnCode)
+							s.AcknowledgeConnect(pktconnack)
+							//the connection is closed once the CONNACK is written
+							s.Terminate(errors.New(s.Error()))
+							break
+						}
+					}
 					for _, l := range this.listeners {
 						l.ProcessConnect(evt.(EventConnect))
 					}
@@ -226,42 +798,136 @@ func (this *provider) ServeConn(conn net.Conn) {
 	}
 }
 
-func (this *provider) Forward(msg Message) {
-	this.forward <- msg
+//Takeover registers an accepted session under its client identifier, and
+//returns the previous session with the same client identifier. A connected
+//previous session is taken over, and has to be finished before its state
+//is resumed, so Takeover must not be called with the session mutex held
+func (this *provider) Takeover(s *session) *session {
+	if s.clientId == "" {
+		return nil
+	}
+
+	this.mutex.Lock()
+	old, ok := this.clients[s.clientId]
+	this.clients[s.clientId] = s
+	this.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	if old.done != nil {
+		log.Println("Taking Over Session", s.clientId)
+		old.Disconnect(REASON_SESSION_TAKEN_OVER)
+		old.Terminate(errors.New("Session Taken Over\n"))
+		old.writer.Close()
+		old.conn.Close()
+		<-old.done
+	}
+
+	return old
 }
 
-func (this *provider) ReadPacket(conn net.Conn) ([]byte, error) {
-	var pkt [1]byte
-	var buf []byte
-	var err error
+//Attach makes the session registered by Takeover current. With
+//CleanSession=0 the state of old is resumed and true is returned, which is
+//the Session Present flag of the CONNACK
+func (this *provider) Attach(s *session, old *session) bool {
+	if s.clientId == "" {
+		return false
+	}
 
-	conn.SetDeadline(time.Now().Add(1e9)) //wait for 1 second
-	if _, err = conn.Read(pkt[:]); err != nil {
-		return nil, err
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if s.cleanSession || !s.Persistent() {
+		this.store.DeleteSession(s.clientId)
+	}
+	if s.Persistent() {
+		this.store.SaveSession(s.clientId, s.expiryInterval, time.Time{})
 	}
-	buf = append(buf, pkt[0])
 
-	var remainingLength uint32 = 0
-	var multiplier uint32 = 1
-	for {
-		if _, err = conn.Read(pkt[:]); err != nil {
-			return nil, err
-		}
-		buf = append(buf, pkt[0])
-		remainingLength += uint32(pkt[0]&127) * multiplier
-		if (pkt[0] & 128) == 0 {
-			break
+	present := false
+	if old != nil {
+		this.tree.Remove(old)
+		if !s.cleanSession {
+			s.Resume(old)
+			for sub := range s.topics {
+				this.tree.Subscribe(s, sub, s.qos[sub])
+			}
+			present = true
 		}
-		multiplier *= 128
 	}
+	if s.Persistent() {
+		s.queue.persist(this.store, s.clientId)
+	} else {
+		s.queue.persist(nil, "")
+	}
+
+	return present
+}
+
+//Detach forgets a terminated session unless its state has to be kept
+//for the next connection with the same client identifier
+func (this *provider) Detach(s *session) {
+	if s.Persistent() {
+		this.mutex.Lock()
+		s.disconnectTime = time.Now()
+		this.store.SaveSession(s.clientId, s.expiryInterval, s.disconnectTime)
+		this.mutex.Unlock()
+		return
+	}
+
+	this.tree.Remove(s)
+	if s.clientId == "" {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if old, ok := this.clients[s.clientId]; ok && old == s {
+		delete(this.clients, s.clientId)
+	}
+}
 
-	if remainingLength > 0 {
-		data := make([]byte, remainingLength)
-		if _, err = io.ReadFull(conn, data); err != nil {
-			return nil, err
+//Forward publishes msg to the matching subscriptions. A retained message
+//replaces the one stored for its topic, or deletes it with an empty payload.
+//The subscriptions are matched on the caller's goroutine, the deliveries are
+//queued to the dispatch workers, so the caller only waits while a worker's
+//queue is full. Each session is served by one worker, which keeps the order
+//of its messages
+func (this *provider) Forward(msg Message) {
+	if msg.GetRetain() {
+		if len(msg.GetPayload()) == 0 {
+			this.retained.DeleteRetained(msg.GetTopic())
+		} else {
+			//the stored copy keeps the MQTT 5 properties and the expiry
+			retained := NewMessagePayload(false, msg.GetQos(), true, msg.GetTopic(), msg.GetPayload())
+			if properties := msg.GetProperties(); properties != nil {
+				retained.SetProperties(properties.Copy())
+			}
+			retained.SetExpiry(msg.GetExpiry())
+			this.retained.SaveRetained(retained)
 		}
-		buf = append(buf, data...)
 	}
 
-	return buf, nil
+	//offline sessions with CleanSession=0 stay subscribed to queue messages
+	shares := make([]map[Session]map[string]QOS, len(this.workers))
+	for s, subs := range this.tree.Match(msg.GetTopic()) {
+		shard := s.(*session).shard
+		if shares[shard] == nil {
+			shares[shard] = make(map[Session]map[string]QOS)
+		}
+		shares[shard][s] = subs
+	}
+	for shard, sessions := range shares {
+		if sessions == nil {
+			continue
+		}
+		atomic.AddInt64(&this.dispatching, 1)
+		select {
+		case this.workers[shard] <- delivery{msg, sessions}:
+		case <-this.quit:
+			atomic.AddInt64(&this.dispatching, -1)
+			return
+		}
+	}
 }
@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+)
+
+////////////////////Interface//////////////////////////////
+
+type QueuePolicy byte
+
+const (
+	QUEUE_DROP_OLDEST QueuePolicy = iota //discard the oldest queued messages to make room
+	QUEUE_DROP_NEWEST                    //discard the incoming message
+	QUEUE_REJECT                         //discard the incoming message and report an error
+)
+
+const (
+	QUEUE_MAX_MESSAGES = 1000
+	QUEUE_MAX_BYTES    = 1 << 20
+)
+
+////////////////////Implementation////////////////////////
+
+type message_queue struct {
+	maxMessages int //0 means unlimited
+	maxBytes    int //0 means unlimited
+	policy      QueuePolicy
+
+	messages []Message
+	bytes    int
+	mutex    sync.Mutex
+
+	//the queue of a persistent session is mirrored to the store
+	store    Store
+	clientId string
+}
+
+func newMessageQueue(maxMessages int, maxBytes int, policy QueuePolicy) *message_queue {
+	this := &message_queue{}
+
+	this.maxMessages = maxMessages
+	this.maxBytes = maxBytes
+	this.policy = policy
+
+	return this
+}
+
+func (this *message_queue) size(msg Message) int {
+	return len(msg.GetTopic()) + len(msg.GetPayload())
+}
+
+func (this *message_queue) full(size int) bool {
+	return (this.maxMessages > 0 && len(this.messages)+1 > this.maxMessages) ||
+		(this.maxBytes > 0 && this.bytes+size > this.maxBytes)
+}
+
+func (this *message_queue) Push(msg Message) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	size := this.size(msg)
+	if this.maxBytes > 0 && size > this.maxBytes {
+		return errors.New("Message Exceeds Queue Size Limit\n")
+	}
+
+	if this.full(size) {
+		switch this.policy {
+		case QUEUE_DROP_OLDEST:
+			for this.full(size) {
+				this.bytes -= this.size(this.messages[0])
+				this.messages[0] = nil
+				this.messages = this.messages[1:]
+				if this.store != nil {
+					this.store.PopQueued(this.clientId)
+				}
+			}
+		case QUEUE_DROP_NEWEST:
+			return nil
+		default:
+			return errors.New("Message Queue Full\n")
+		}
+	}
+
+	this.messages = append(this.messages, msg)
+	this.bytes += size
+	if this.store != nil {
+		this.store.PushQueued(this.clientId, msg)
+	}
+
+	return nil
+}
+
+func (this *message_queue) Pop() Message {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if len(this.messages) == 0 {
+		return nil
+	}
+
+	msg := this.messages[0]
+	this.messages[0] = nil
+	this.messages = this.messages[1:]
+	this.bytes -= this.size(msg)
+	if this.store != nil {
+		this.store.PopQueued(this.clientId)
+	}
+
+	return msg
+}
+
+func (this *message_queue) Len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return len(this.messages)
+}
+
+//persist mirrors the queue to store from now on, writing the messages
+//already queued. A nil store stops mirroring
+func (this *message_queue) persist(store Store, clientId string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if store != nil && (this.store != store || this.clientId != clientId) {
+		for _, msg := range this.messages {
+			store.PushQueued(clientId, msg)
+		}
+	}
+	this.store = store
+	this.clientId = clientId
+}
+
+//restore loads the messages saved in store and keeps mirroring to it
+func (this *message_queue) restore(store Store, clientId string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, msg := range store.GetQueued(clientId) {
+		this.messages = append(this.messages, msg)
+		this.bytes += this.size(msg)
+	}
+	this.store = store
+	this.clientId = clientId
+}
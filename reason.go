@@ -0,0 +1,83 @@
+package mqtt
+
+////////////////////Interface//////////////////////////////
+
+//ReasonCode of the MQTT 5 acknowledgements, DISCONNECT and AUTH. Codes from
+//0x80 on report a failure
+type ReasonCode byte
+
+const (
+	REASON_SUCCESS                                ReasonCode = 0x00
+	REASON_NORMAL_DISCONNECTION                   ReasonCode = 0x00
+	REASON_GRANTED_QOS_0                          ReasonCode = 0x00
+	REASON_GRANTED_QOS_1                          ReasonCode = 0x01
+	REASON_GRANTED_QOS_2                          ReasonCode = 0x02
+	REASON_DISCONNECT_WITH_WILL_MESSAGE           ReasonCode = 0x04
+	REASON_NO_MATCHING_SUBSCRIBERS                ReasonCode = 0x10
+	REASON_NO_SUBSCRIPTION_EXISTED                ReasonCode = 0x11
+	REASON_CONTINUE_AUTHENTICATION                ReasonCode = 0x18
+	REASON_REAUTHENTICATE                         ReasonCode = 0x19
+	REASON_UNSPECIFIED_ERROR                      ReasonCode = 0x80
+	REASON_MALFORMED_PACKET                       ReasonCode = 0x81
+	REASON_PROTOCOL_ERROR                         ReasonCode = 0x82
+	REASON_IMPLEMENTATION_SPECIFIC_ERROR          ReasonCode = 0x83
+	REASON_UNSUPPORTED_PROTOCOL_VERSION           ReasonCode = 0x84
+	REASON_CLIENT_IDENTIFIER_NOT_VALID            ReasonCode = 0x85
+	REASON_BAD_USER_NAME_OR_PASSWORD              ReasonCode = 0x86
+	REASON_NOT_AUTHORIZED                         ReasonCode = 0x87
+	REASON_SERVER_UNAVAILABLE                     ReasonCode = 0x88
+	REASON_SERVER_BUSY                            ReasonCode = 0x89
+	REASON_BANNED                                 ReasonCode = 0x8A
+	REASON_SERVER_SHUTTING_DOWN                   ReasonCode = 0x8B
+	REASON_BAD_AUTHENTICATION_METHOD              ReasonCode = 0x8C
+	REASON_KEEP_ALIVE_TIMEOUT                     ReasonCode = 0x8D
+	REASON_SESSION_TAKEN_OVER                     ReasonCode = 0x8E
+	REASON_TOPIC_FILTER_INVALID                   ReasonCode = 0x8F
+	REASON_TOPIC_NAME_INVALID                     ReasonCode = 0x90
+	REASON_PACKET_IDENTIFIER_IN_USE               ReasonCode = 0x91
+	REASON_PACKET_IDENTIFIER_NOT_FOUND            ReasonCode = 0x92
+	REASON_RECEIVE_MAXIMUM_EXCEEDED               ReasonCode = 0x93
+	REASON_TOPIC_ALIAS_INVALID                    ReasonCode = 0x94
+	REASON_PACKET_TOO_LARGE                       ReasonCode = 0x95
+	REASON_MESSAGE_RATE_TOO_HIGH                  ReasonCode = 0x96
+	REASON_QUOTA_EXCEEDED                         ReasonCode = 0x97
+	REASON_ADMINISTRATIVE_ACTION                  ReasonCode = 0x98
+	REASON_PAYLOAD_FORMAT_INVALID                 ReasonCode = 0x99
+	REASON_RETAIN_NOT_SUPPORTED                   ReasonCode = 0x9A
+	REASON_QOS_NOT_SUPPORTED                      ReasonCode = 0x9B
+	REASON_USE_ANOTHER_SERVER                     ReasonCode = 0x9C
+	REASON_SERVER_MOVED                           ReasonCode = 0x9D
+	REASON_SHARED_SUBSCRIPTIONS_NOT_SUPPORTED     ReasonCode = 0x9E
+	REASON_CONNECTION_RATE_EXCEEDED               ReasonCode = 0x9F
+	REASON_MAXIMUM_CONNECT_TIME                   ReasonCode = 0xA0
+	REASON_SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED ReasonCode = 0xA1
+	REASON_WILDCARD_SUBSCRIPTIONS_NOT_SUPPORTED   ReasonCode = 0xA2
+)
+
+////////////////////Implementation////////////////////////
+
+//the MQTT 5 reason code of a CONNACK return code, for CONNACKs built the
+//3.1.1 way and sent to an MQTT 5 client
+var connackReasonCodes = map[CONNACK_RETURNCODE]ReasonCode{
+	CONNACK_RETURNCODE_ACCEPTED:                              REASON_SUCCESS,
+	CONNACK_RETURNCODE_REFUSED_UNACCEPTABLE_PROTOCOL_VERSION: REASON_UNSUPPORTED_PROTOCOL_VERSION,
+	CONNACK_RETURNCODE_REFUSED_IDENTIFIER_REJECTED:           REASON_CLIENT_IDENTIFIER_NOT_VALID,
+	CONNACK_RETURNCODE_REFUSED_SERVER_UNAVAILABLE:            REASON_SERVER_UNAVAILABLE,
+	CONNACK_RETURNCODE_REFUSED_BAD_USERNAME_OR_PASSWORD:      REASON_BAD_USER_NAME_OR_PASSWORD,
+	CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED:                REASON_NOT_AUTHORIZED,
+}
+
+//connackReturnCode maps an MQTT 5 CONNACK reason code back to the nearest
+//3.1.1 return code
+func connackReturnCode(reasonCode ReasonCode) CONNACK_RETURNCODE {
+	for returnCode, code := range connackReasonCodes {
+		if code == reasonCode {
+			return returnCode
+		}
+	}
+	switch reasonCode {
+	case REASON_BANNED, REASON_BAD_AUTHENTICATION_METHOD:
+		return CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED
+	}
+	return CONNACK_RETURNCODE_REFUSED_SERVER_UNAVAILABLE
+}
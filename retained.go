@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+////////////////////Interface//////////////////////////////
+
+type RetainedStore interface {
+	SaveRetained(msg Message)
+	DeleteRetained(topic string)
+
+	//GetRetained returns the retained messages matching a topic filter
+	GetRetained(filter string) []Message
+}
+
+////////////////////Implementation////////////////////////
+
+type retained_store struct {
+	messages map[string]Message
+	mutex    sync.RWMutex
+}
+
+func NewRetainedStore() RetainedStore {
+	this := &retained_store{}
+
+	this.messages = make(map[string]Message)
+
+	return this
+}
+
+func (this *retained_store) SaveRetained(msg Message) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.messages[msg.GetTopic()] = msg
+}
+
+func (this *retained_store) DeleteRetained(topic string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	delete(this.messages, topic)
+}
+
+func (this *retained_store) GetRetained(filter string) []Message {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	var msgs []Message
+	for topic, msg := range this.messages {
+		if MatchTopic(filter, topic) {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs
+}
+
+func (this *retained_store) all() []Message {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	msgs := make([]Message, 0, len(this.messages))
+	for _, msg := range this.messages {
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
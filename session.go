@@ -2,10 +2,16 @@ package mqtt
 
 
 import(
+	"crypto/tls"
+	"crypto/x509"
 	"errors" 
  	"fmt" 
  	"log" 
 	"net" 
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 ////////////////////Interface//////////////////////////////
 
@@ -17,16 +23,54 @@ const (
 	SESSION_STATE_TERMINATED
 )
 
+const (
+	RETRANSMIT_TIMER = 20 //seconds
+	RETRANSMIT_MAX   = 3
+)
+
+const (
+	SESSION_EXPIRY_NEVER uint32 = 0xFFFFFFFF //session expiry interval of a session kept until it is resumed
+	RECEIVE_MAXIMUM      uint16 = 65535      //default MQTT 5 receive maximum
+)
+
+type Qos2Delivery byte
+
+const (
+	QOS2_DELIVERY_ON_PUBLISH Qos2Delivery = iota //deliver on PUBLISH, ignore redelivered packet identifiers
+	QOS2_DELIVERY_ON_PUBREL                      //store on PUBLISH, deliver on PUBREL
+)
+
+type OverlapDelivery byte
+
+const (
+	OVERLAP_DELIVERY_MAX_QOS OverlapDelivery = iota //one copy at the maximum QoS of all matching subscriptions
+	OVERLAP_DELIVERY_EACH                           //one copy per matching subscription
+)
+
 type Session interface {
-	GetRetransmitTimer() int
+	GetRetransmitTimer() int //seconds, 0 disables retransmission, unused by MQTT 5
 	SetRetransmitTimer(retransmitTimer int)
 
+	GetMaxRetransmits() int //0 retransmits without limit
+	SetMaxRetransmits(maxRetransmits int)
+
 	GetState() SessionState
+	GetClientId() string //assigned by the provider when the CONNECT carried a zero-length one
+	GetUserName() string
+	GetKeepAlive() uint16    //seconds
+	GetRemoteAddr() net.Addr //nil for a session restored from the store
+	GetProtocolLevel() byte
+	GetConnectTime() time.Time
+	GetSubscriptions() map[string]QOS //a copy, topic filter to granted QoS
 	Error() string
 	Terminate(err error)
 
 	GetAppData() interface{}
 	SetAppData(interface{})
+
+	//GetPeerCertificate returns the verified TLS client certificate, so its
+	//subject CN and SANs can be mapped to a client identity in ProcessConnect
+	GetPeerCertificate() *x509.Certificate
 	
 	
 	Will() Message
@@ -37,52 +81,217 @@ type Session interface {
 
 ////////////////////Implementation////////////////////////
 
+//inflight is an outgoing QoS 1 or 2 message waiting for acknowledgement
+type inflight struct {
+	msg       Message
+	released  bool //PUBREC received, waiting for PUBCOMP
+	timestamp time.Time
+	retries   int
+}
+
 type session struct {
 	state           SessionState
 	err             error
 	quit            chan bool
+	done            chan bool //closed when the connection is served no more
+	quitOnce        sync.Once
+	mutex           sync.Mutex //guards the state shared with the dispatch workers
+	overflow        bool       //the outbound queue overflowed, ends the session on unlock
+	successor       *session   //the session which resumed this one
 	appData         interface{}
 	retransmitTimer int
+	maxRetransmits  int
 	
-	conn net.Conn
+	conn     net.Conn
+	writer   *packet_writer
+	provider *provider
+	shard    int //the dispatch worker delivering to this session
 
 	//Connect
-	keepAlive uint16
-	clientId  string
-	will      Message
+	keepAlive     uint16
+	clientId      string
+	userName      string
+	protocolLevel byte
+	connectTime   time.Time
+	cleanSession  bool
+	will          Message
+
+	//MQTT 5 CONNECT properties
+	expiryInterval uint32 //seconds the state is kept after disconnection
+	disconnectTime time.Time
+	receiveMaximum uint16 //QoS 1 and 2 messages in flight the client accepts
+	maxPacketSize  uint32 //0 for no limit
+	assigned       bool   //the client identifier was assigned by the provider
+
+	//MQTT 5 enhanced authentication
+	authMethod     string
+	authData       []byte //sent in CONNACK once authenticated
+	pendingConnect PacketConnect
 
 	//Publish
 	packetId  uint16
 	PacketIds map[uint32]uint16
+	inflights map[uint16]*inflight
+
+	//Inbound QoS 2
+	qos2Delivery Qos2Delivery
+	inbounds     map[uint16]Message
 
 	//Subscribe
-	topics map[string]string
-	qos    map[string]QOS
+	topics          map[string]string
+	qos             map[string]QOS
+	options         map[string]byte //MQTT 5 subscription options
+	overlapDelivery OverlapDelivery
+
+	//Offline messages for CleanSession=0
+	queue *message_queue
 
 	//private
 	keepAliveAccumulated uint16
 	topicsToBeAdded      []string
 	qosToBeAdded         []QOS
+	optionsToBeAdded     []byte
 }
 
-func newSession(conn net.Conn) *session {
+func newSession(conn net.Conn, p *provider) *session {
 	this := &session{}
 
 	this.conn = conn
+	this.provider = p
 	this.err = nil
 	this.state = SESSION_STATE_CREATED
+
+	//the provider's settings may be changed while it runs
+	p.options.RLock()
+	defer p.options.RUnlock()
+
 	this.quit = make(chan bool)
+	this.shard = p.NextShard()
+	if conn != nil {
+		this.done = make(chan bool)
+		this.writer = newPacketWriter(conn, p.outboundQueueSize)
+	}
 	this.packetId = 1
 	this.PacketIds = make(map[uint32]uint16)
+	this.inflights = make(map[uint16]*inflight)
+	this.qos2Delivery = p.qos2Delivery
+	this.inbounds = make(map[uint16]Message)
+	this.retransmitTimer = RETRANSMIT_TIMER
+	this.maxRetransmits = RETRANSMIT_MAX
 	this.keepAlive = 0
 	this.keepAliveAccumulated = 0
 	this.topics = make(map[string]string)
 	this.qos = make(map[string]QOS)
+	this.options = make(map[string]byte)
+	this.overlapDelivery = p.overlapDelivery
+	this.cleanSession = true
+	this.expiryInterval = 0
+	this.receiveMaximum = RECEIVE_MAXIMUM
 	this.will = nil
+	this.queue = newMessageQueue(p.queueMaxMessages, p.queueMaxBytes, p.queuePolicy)
 
 	return this
 }
 
+//Resume takes over the subscriptions and in-flight packet identifiers of
+//a previous session with the same client identifier. The messages still
+//dispatched to the previous session are passed on to this one
+func (this *session) Resume(old *session) {
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+
+	old.successor = this
+	this.packetId = old.packetId
+	this.PacketIds = old.PacketIds
+	this.inflights = old.inflights
+	this.inbounds = old.inbounds
+	this.topics = old.topics
+	this.qos = old.qos
+	this.options = old.options
+	this.queue = old.queue
+}
+
+//Persistent reports whether the session state is kept after disconnection,
+//which is CleanSession=0 before MQTT 5 and a session expiry interval since
+func (this *session) Persistent() bool {
+	return this.expiryInterval != 0 && this.clientId != ""
+}
+
+//Pending counts the QoS 1 and 2 messages sent and not acknowledged, the
+//QoS 2 messages received and not released, and the packets not written yet.
+//Only a connected session can finish them
+func (this *session) Pending() (inflights int, inbounds int, outbound int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.state != SESSION_STATE_CONNECTED || this.writer == nil {
+		return 0, 0, 0
+	}
+	return len(this.inflights), len(this.inbounds), len(this.writer.outbound)
+}
+
+//write queues pkt for the connection's writer
+func (this *session) write(pkt Packet) error {
+	return this.send(this.encode(pkt), false)
+}
+
+//send queues buf for the connection's writer. When the outbound queue of a
+//slow consumer is full, a QoS 0 PUBLISH is dropped and anything else ends
+//the session once the mutex is released
+func (this *session) send(buf []byte, droppable bool) error {
+	err := this.writer.Send(buf)
+	if err == errOutboundOverflow {
+		if droppable {
+			log.Println("Outbound Queue Full, Message Dropped", this.clientId)
+			return nil
+		}
+		log.Println("Outbound Queue Overflow", this.clientId)
+		this.overflow = true
+	}
+	return err
+}
+
+//unlock releases the mutex, and ends the session if its outbound queue
+//overflowed meanwhile
+func (this *session) unlock() {
+	overflow := this.overflow
+	this.mutex.Unlock()
+
+	if overflow {
+		this.Terminate(errOutboundOverflow)
+		this.conn.Close()
+	}
+}
+
+//encode bytizes pkt for the negotiated protocol level
+func (this *session) encode(pkt Packet) []byte {
+	pkt.SetProtocolLevel(this.protocolLevel)
+	return pkt.Bytes()
+}
+
+//Disconnect tells an MQTT 5 client why the server closes the connection,
+//earlier protocol levels have no DISCONNECT sent by the server
+func (this *session) Disconnect(reasonCode ReasonCode) {
+	this.mutex.Lock()
+	defer this.unlock()
+
+	this.disconnect(reasonCode)
+}
+
+func (this *session) disconnect(reasonCode ReasonCode) {
+	if this.protocolLevel != PROTOCOL_LEVEL_5 || this.conn == nil || this.state != SESSION_STATE_CONNECTED {
+		return
+	}
+
+	pktdisconnect := NewPacketDisconnect()
+	pktdisconnect.SetReasonCode(reasonCode)
+	if err := this.write(pktdisconnect); err != nil {
+		log.Println(err.Error())
+	} else {
+		log.Println("SENT DISCONNECT", reasonCode)
+	}
+}
+
 func (this *session) GetRetransmitTimer() int {
 	return this.retransmitTimer
 }
@@ -91,56 +300,412 @@ func (this *session) SetRetransmitTimer(retransmitTimer int) {
 	this.retransmitTimer = retransmitTimer
 }
 
+func (this *session) GetMaxRetransmits() int {
+	return this.maxRetransmits
+}
+
+func (this *session) SetMaxRetransmits(maxRetransmits int) {
+	this.maxRetransmits = maxRetransmits
+}
+
 func (this *session) GetState() SessionState {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	return this.state
 }
 
 func (this *session) Error() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	return this.err.Error()
 }
 
 func (this *session) Terminate(err error) {
-	this.state = SESSION_STATE_TERMINATED
-	this.err = err
-	close(this.quit)
+	this.quitOnce.Do(func() {
+		this.mutex.Lock()
+		this.state = SESSION_STATE_TERMINATED
+		this.err = err
+		this.mutex.Unlock()
+		close(this.quit)
+	})
 }
 
 func (this *session) GetAppData() interface{} {
 	return this.appData
 }
 
+func (this *session) GetClientId() string {
+	return this.clientId
+}
+
+func (this *session) GetUserName() string {
+	return this.userName
+}
+
+func (this *session) GetKeepAlive() uint16 {
+	return this.keepAlive
+}
+
+func (this *session) GetRemoteAddr() net.Addr {
+	if this.conn == nil {
+		return nil
+	}
+	return this.conn.RemoteAddr()
+}
+
+func (this *session) GetProtocolLevel() byte {
+	return this.protocolLevel
+}
+
+func (this *session) GetConnectTime() time.Time {
+	return this.connectTime
+}
+
+func (this *session) GetSubscriptions() map[string]QOS {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	subs := make(map[string]QOS, len(this.qos))
+	for sub, qos := range this.qos {
+		subs[sub] = qos
+	}
+	return subs
+}
+
+func (this *session) GetPeerCertificate() *x509.Certificate {
+	if c, ok := this.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := c.ConnectionState()
+		if len(state.VerifiedChains) != 0 && len(state.VerifiedChains[0]) != 0 {
+			return state.VerifiedChains[0][0]
+		}
+	}
+	return nil
+}
+
 func (this *session) SetAppData(appData interface{}) {
 	this.appData = appData
 }
 
 func (this *session) Forward(msg Message) error {
-	if this.state == SESSION_STATE_CONNECTED { //&& msg.GetClientId() != this.clientId {
-		for _, sub := range this.topics {
-			if this.Match(sub, msg.GetTopic()) {
-				if _, err := this.conn.Write(msg.Packetize(this.packetId).Bytes()); err != nil {
-					log.Println(err.Error())
-					return err
-				}
+	this.mutex.Lock()
+	defer this.unlock()
 
-				if msg.GetQos() == QOS_TWO || msg.GetQos() == QOS_ONE {
-					this.PacketIds[uint32(this.packetId)] = this.packetId
-					if this.packetId++; this.packetId == 0 {
-						this.packetId++
-					}
-				}
+	return this.forward(msg)
+}
+
+func (this *session) forward(msg Message) error {
+	subs := make(map[string]QOS)
+	for _, sub := range this.topics {
+		if this.Match(sub, msg.GetTopic()) {
+			subs[sub] = this.qos[sub]
+		}
+	}
+
+	return this.dispatch(msg, subs, nil)
+}
+
+//Dispatch delivers msg for the matching subscriptions subs according to the
+//overlapping subscription delivery mode and the MQTT 5 subscription options.
+//encoded caches the QoS 0 PUBLISH packets of msg shared by the sessions
+//delivered to by one dispatch worker, it may be nil
+func (this *session) Dispatch(msg Message, subs map[string]QOS, encoded map[byte][]byte) error {
+	this.mutex.Lock()
+	if successor := this.successor; successor != nil {
+		this.mutex.Unlock()
+		return successor.Dispatch(msg, subs, encoded)
+	}
+	defer this.unlock()
+
+	return this.dispatch(msg, subs, encoded)
+}
+
+func (this *session) dispatch(msg Message, subs map[string]QOS, encoded map[byte][]byte) error {
+	if len(subs) == 0 {
+		return nil
+	}
 
-				break
+	//No Local subscriptions don't receive the client's own messages
+	local := false
+	if m, ok := msg.(*message); ok && m.clientId != "" && m.clientId == this.clientId {
+		local = true
+	}
+
+	if this.overlapDelivery == OVERLAP_DELIVERY_EACH {
+		for sub, qos := range subs {
+			if local && this.options[sub]&SUBSCRIBE_OPTION_NO_LOCAL != 0 {
+				continue
+			}
+			retain := msg.GetRetain() && this.options[sub]&SUBSCRIBE_OPTION_RETAIN_AS_PUBLISHED != 0
+			if err := this.deliver(msg, qos, retain, encoded); err != nil {
+				return err
 			}
 		}
+		return nil
+	}
+
+	matched, retain := false, false
+	granted := QOS_ZERO
+	for sub, qos := range subs {
+		if local && this.options[sub]&SUBSCRIBE_OPTION_NO_LOCAL != 0 {
+			continue
+		}
+		matched = true
+		if qos > granted {
+			granted = qos
+		}
+		if msg.GetRetain() && this.options[sub]&SUBSCRIBE_OPTION_RETAIN_AS_PUBLISHED != 0 {
+			retain = true
+		}
+	}
+	if !matched {
+		return nil
+	}
+	return this.deliver(msg, granted, retain, encoded)
+}
+
+//deliver sends msg with min(publish QoS, granted QoS). The shared message is
+//never modified: each session sends its own copy, on which DUP can be set.
+//RETAIN is only set for retained messages sent on a new subscription
+func (this *session) deliver(msg Message, granted QOS, retain bool, encoded map[byte][]byte) error {
+	qos := msg.GetQos()
+	if granted < qos {
+		qos = granted
+	}
+
+	//an expired message isn't delivered anymore
+	expiry := msg.GetExpiry()
+	if !expiry.IsZero() && !time.Now().Before(expiry) {
+		return nil
+	}
+
+	if this.state != SESSION_STATE_CONNECTED {
+		//queue QoS 1 and 2 messages until the client reconnects
+		if this.Persistent() && qos != QOS_ZERO {
+			return this.queue.Push(msg)
+		}
+		return nil
+	}
+
+	//the client's receive maximum bounds the messages in flight, the others
+	//wait in the queue until acknowledgements are received
+	if qos != QOS_ZERO && len(this.inflights) >= int(this.receiveMaximum) {
+		if err := this.queue.Push(msg); err != nil {
+			log.Println(err.Error())
+		}
+		return nil
+	}
+
+	//a QoS 0 PUBLISH without expiry is the same for every session with the
+	//same protocol level, and is only encoded once per dispatch
+	key := this.protocolLevel << 1
+	if retain {
+		key |= 1
+	}
+	shared := qos == QOS_ZERO && expiry.IsZero() && encoded != nil
+
+	var out Message
+	var packetId uint16
+	buf := encoded[key]
+	if !shared || buf == nil {
+		out = NewMessagePayload(false, qos, retain, msg.GetTopic(), msg.GetPayload())
+		if properties := msg.GetProperties(); properties != nil {
+			properties = properties.Copy()
+			properties.Delete(PROPERTY_TOPIC_ALIAS)
+			properties.Delete(PROPERTY_SUBSCRIPTION_IDENTIFIER)
+			out.SetProperties(properties)
+		}
+		if !expiry.IsZero() {
+			//the expiry interval sent is what remains of it
+			if out.GetProperties() == nil {
+				out.SetProperties(NewProperties())
+			}
+			remaining := (time.Until(expiry) + time.Second - 1) / time.Second
+			out.GetProperties().SetInt(PROPERTY_MESSAGE_EXPIRY_INTERVAL, uint32(remaining))
+			out.SetExpiry(expiry)
+		}
+
+		if qos != QOS_ZERO {
+			packetId = this.NextPacketId()
+		}
+
+		buf = this.encode(out.Packetize(packetId))
+		if shared {
+			encoded[key] = buf
+		}
+	}
+	if this.maxPacketSize != 0 && uint32(len(buf)) > this.maxPacketSize {
+		log.Println("Message Exceeds Maximum Packet Size", this.clientId, msg.GetTopic())
+		return nil
+	}
+
+	if err := this.send(buf, qos == QOS_ZERO); err != nil {
+		log.Println(err.Error())
+		//a persistent session gets it once reconnected
+		if this.Persistent() && qos != QOS_ZERO {
+			this.queue.Push(msg)
+		}
+		return err
+	}
+
+	if qos != QOS_ZERO {
+		this.PacketIds[uint32(packetId)] = packetId
+		this.inflights[packetId] = &inflight{msg: out, timestamp: time.Now()}
+		if this.Persistent() {
+			this.provider.store.SaveInflight(this.clientId, packetId, out)
+		}
+	}
+
+	return nil
+}
+
+//NextPacketId allocates a packet identifier which is not in flight
+func (this *session) NextPacketId() uint16 {
+	for {
+		packetId := this.packetId
+		if this.packetId++; this.packetId == 0 {
+			this.packetId++
+		}
+		if _, ok := this.inflights[packetId]; !ok {
+			return packetId
+		}
+	}
+}
+
+//Retransmit resends the unacknowledged QoS 1 and 2 messages whose retransmit
+//timer has expired. It returns true when a message reached the maximum number
+//of retransmissions, which is raised to listeners as TIMEOUT_RETRANSMIT.
+//MQTT 5 forbids resending other than on reconnection [MQTT-4.4.0-1], so
+//MQTT 5 sessions only resend in Redeliver
+func (this *session) Retransmit(now time.Time) bool {
+	this.mutex.Lock()
+	defer this.unlock()
+
+	if this.state != SESSION_STATE_CONNECTED || this.retransmitTimer <= 0 || this.protocolLevel == PROTOCOL_LEVEL_5 {
+		return false
+	}
+
+	exceeded := false
+	for packetId, f := range this.inflights {
+		if this.maxRetransmits > 0 && f.retries >= this.maxRetransmits {
+			continue
+		}
+		if now.Sub(f.timestamp) < time.Duration(this.retransmitTimer)*time.Second {
+			continue
+		}
+		if err := this.Resend(packetId, f); err != nil {
+			return false
+		}
+		f.timestamp = now
+		if f.retries++; this.maxRetransmits > 0 && f.retries >= this.maxRetransmits {
+			exceeded = true
+		}
+	}
+
+	return exceeded
+}
+
+//Redeliver resends all unacknowledged QoS 1 and 2 messages in their original
+//order after the client reconnected
+func (this *session) Redeliver() error {
+	packetIds := make([]uint16, 0, len(this.inflights))
+	for packetId := range this.inflights {
+		packetIds = append(packetIds, packetId)
+	}
+	sort.Slice(packetIds, func(i, j int) bool {
+		return this.inflights[packetIds[i]].timestamp.Before(this.inflights[packetIds[j]].timestamp)
+	})
+
+	now := time.Now()
+	for _, packetId := range packetIds {
+		f := this.inflights[packetId]
+		if err := this.Resend(packetId, f); err != nil {
+			return err
+		}
+		f.retries = 0
+		f.timestamp = now
+	}
+
+	return nil
+}
+
+//Resend sends PUBLISH with DUP=1, or PUBREL once PUBREC has been received
+func (this *session) Resend(packetId uint16, f *inflight) error {
+	var pkt Packet
+	if f.released {
+		pkgpubrel := NewPacketAcks(PACKET_PUBREL)
+		pkgpubrel.SetPacketId(packetId)
+		pkt = pkgpubrel
+	} else {
+		f.msg.SetDup(true)
+		pkt = f.msg.Packetize(packetId)
+	}
+
+	if err := this.write(pkt); err != nil {
+		log.Println(err.Error())
+		return err
+	} else {
+		log.Println("RESENT", PACKET_TYPE_STRINGS[pkt.GetType()], packetId)
 	}
 
 	return nil
 }
 
+//drain forwards the queued messages while the receive maximum allows
+func (this *session) drain() error {
+	for len(this.inflights) < int(this.receiveMaximum) {
+		msg := this.queue.Pop()
+		if msg == nil {
+			break
+		}
+		if err := this.forward(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (this *session) AcknowledgeConnect(pktconnack PacketConnack) error {
+	//a taken over session is waited for before locking, it may be
+	//delivering to this one
+	var old *session
+	if pktconnack.GetReturnCode() == CONNACK_RETURNCODE_ACCEPTED {
+		old = this.provider.Takeover(this)
+	}
+
+	this.mutex.Lock()
+	defer this.unlock()
+
 	switch this.state {
 	case SESSION_STATE_CREATED:
-		if _, err := this.conn.Write(pktconnack.Bytes()); err != nil {
+		if pktconnack.GetReturnCode() == CONNACK_RETURNCODE_ACCEPTED {
+			pktconnack.SetSPFlag(this.provider.Attach(this, old))
+		} else {
+			pktconnack.SetSPFlag(false)
+		}
+		//MQTT 3.1 has no Session Present flag
+		if this.protocolLevel == PROTOCOL_LEVEL_3_1 {
+			pktconnack.SetSPFlag(false)
+		}
+		if this.protocolLevel == PROTOCOL_LEVEL_5 && pktconnack.GetReturnCode() == CONNACK_RETURNCODE_ACCEPTED {
+			properties := pktconnack.GetProperties()
+			if this.assigned {
+				properties.SetString(PROPERTY_ASSIGNED_CLIENT_IDENTIFIER, this.clientId)
+			}
+			if maxPacketSize := this.provider.GetMaxPacketSize(); maxPacketSize != 0 {
+				properties.SetInt(PROPERTY_MAXIMUM_PACKET_SIZE, maxPacketSize)
+			}
+			properties.SetInt(PROPERTY_SUBSCRIPTION_IDENTIFIER_AVAILABLE, 0)
+			properties.SetInt(PROPERTY_SHARED_SUBSCRIPTION_AVAILABLE, 0)
+			if this.authMethod != "" {
+				properties.SetString(PROPERTY_AUTHENTICATION_METHOD, this.authMethod)
+				if this.authData != nil {
+					properties.SetBinary(PROPERTY_AUTHENTICATION_DATA, this.authData)
+				}
+			}
+		}
+		if err := this.write(pktconnack); err != nil {
 			log.Println(err.Error())
 			return err
 		} else {
@@ -148,33 +713,100 @@ func (this *session) AcknowledgeConnect(pktconnack PacketConnack) error {
 		}
 		if pktconnack.GetReturnCode() == CONNACK_RETURNCODE_ACCEPTED {
 			this.state = SESSION_STATE_CONNECTED
+			if err := this.Redeliver(); err != nil {
+				return err
+			}
+			if err := this.drain(); err != nil {
+				return err
+			}
 		} else {
 			this.state = SESSION_STATE_TERMINATED
 			this.err = fmt.Errorf("Listener Refused Connection with Return Code %x\n", pktconnack.GetReturnCode())
 		}
 		return nil
 	default:
+		//a session taken over while it waited still passes on the state
+		//of the one it took over
+		if old != nil {
+			this.provider.Attach(this, old)
+		}
 		return errors.New("Invalid ServerSession State\n")
 	}
 }
 
 func (this *session) AcknowledgeSubscribe(pktsuback PacketSuback) error {
+	this.mutex.Lock()
+	defer this.unlock()
+
 	switch this.state {
 	case SESSION_STATE_CONNECTED:
 		retCodes := pktsuback.GetReturnCodes()
 		if len(this.qosToBeAdded) != len(retCodes) {
 			return errors.New("Invalid Return Codes Length in PacketSuback\n")
 		}
-		if _, err := this.conn.Write(pktsuback.Bytes()); err != nil {
+		for i := 0; i < len(retCodes); i++ {
+			if retCodes[i] > 0x02 {
+				continue
+			}
+			if this.protocolLevel == PROTOCOL_LEVEL_5 && strings.HasPrefix(this.topicsToBeAdded[i], "$share/") {
+				retCodes[i] = byte(REASON_SHARED_SUBSCRIPTIONS_NOT_SUPPORTED)
+			} else if !this.provider.Authorize(this, this.topicsToBeAdded[i], ACL_READ) {
+				log.Println("Subscription Not Authorized", this.clientId, this.topicsToBeAdded[i])
+				if this.protocolLevel == PROTOCOL_LEVEL_5 {
+					retCodes[i] = byte(REASON_NOT_AUTHORIZED)
+				} else {
+					retCodes[i] = 0x80
+				}
+			}
+		}
+		acks := retCodes
+		if this.protocolLevel == PROTOCOL_LEVEL_3_1 {
+			//MQTT 3.1 has no failure return code, a refused subscription is
+			//acknowledged with QoS 0 but not added
+			acks = make([]byte, len(retCodes))
+			for i := 0; i < len(retCodes); i++ {
+				if retCodes[i] <= 0x02 {
+					acks[i] = retCodes[i]
+				}
+			}
+		}
+		pktsuback.SetReturnCodes(acks)
+		if err := this.write(pktsuback); err != nil {
 			log.Println(err.Error())
 			return err
 		} else {
 			log.Println("SENT SUBACK")
 		}
+		existed := make([]bool, len(retCodes))
+		for i := 0; i < len(retCodes); i++ {
+			_, existed[i] = this.topics[this.topicsToBeAdded[i]]
+		}
 		for i := 0; i < len(retCodes); i++ {
 			if retCodes[i] <= 0x02 {
 				this.topics[this.topicsToBeAdded[i]] = this.topicsToBeAdded[i]
 				this.qos[this.topicsToBeAdded[i]] = QOS(retCodes[i])
+				this.options[this.topicsToBeAdded[i]] = this.subscribeOptions(i)
+				this.provider.tree.Subscribe(this, this.topicsToBeAdded[i], QOS(retCodes[i]))
+				if this.Persistent() {
+					this.provider.store.SaveSubscription(this.clientId, this.topicsToBeAdded[i], QOS(retCodes[i]), this.subscribeOptions(i))
+				}
+			}
+		}
+		for i := 0; i < len(retCodes); i++ {
+			retainHandling := this.subscribeOptions(i) & SUBSCRIBE_OPTION_RETAIN_HANDLING
+			if retainHandling == RETAIN_HANDLING_NONE || retainHandling == RETAIN_HANDLING_SEND_NEW && existed[i] {
+				continue
+			}
+			if retCodes[i] <= 0x02 {
+				for _, msg := range this.provider.retained.GetRetained(this.topicsToBeAdded[i]) {
+					//an expired retained message isn't sent to new subscriptions
+					if expiry := msg.GetExpiry(); !expiry.IsZero() && !time.Now().Before(expiry) {
+						continue
+					}
+					if err := this.deliver(msg, QOS(retCodes[i]), true, nil); err != nil {
+						return err
+					}
+				}
 			}
 		}
 		return nil
@@ -183,8 +815,25 @@ func (this *session) AcknowledgeSubscribe(pktsuback PacketSuback) error {
 	}
 }
 
+//subscribeOptions returns the MQTT 5 options of the i-th subscription to
+//be added, 0 before MQTT 5
+func (this *session) subscribeOptions(i int) byte {
+	if i < len(this.optionsToBeAdded) {
+		return this.optionsToBeAdded[i] &^ 0x03
+	}
+	return 0
+}
+
+//Process handles a packet read from the connection
 func (this *session) Process(buf []byte) Event {
-	pkt, err := Packetize(buf)
+	this.mutex.Lock()
+	defer this.unlock()
+
+	return this.process(buf)
+}
+
+func (this *session) process(buf []byte) Event {
+	pkt, err := PacketizeLevel(buf, this.protocolLevel)
 	if err != nil {
 		if this.state != SESSION_STATE_TERMINATED {
 			this.state = SESSION_STATE_TERMINATED
@@ -199,7 +848,18 @@ func (this *session) Process(buf []byte) Event {
 	case SESSION_STATE_CREATED:
 		switch pkt.GetType() {
 		case PACKET_CONNECT:
+			if this.pendingConnect != nil {
+				return this.ProcessTerminate("Invalid Second CONNECT Packet Received during Authentication\n", false)
+			}
 			return this.ProcessConnect(pkt.(PacketConnect))
+		case PACKET_AUTH:
+			//the enhanced authentication started by CONNECT goes on
+			pktauth := pkt.(PacketAuth)
+			if this.pendingConnect == nil || pktauth.GetReasonCode() != REASON_CONTINUE_AUTHENTICATION ||
+				pktauth.GetProperties().GetString(PROPERTY_AUTHENTICATION_METHOD) != this.authMethod {
+				return this.refuseConnect(CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED, REASON_PROTOCOL_ERROR, errors.New("Invalid AUTH Packet Received\n"))
+			}
+			return this.ProcessAuth(pktauth.GetProperties().GetBinary(PROPERTY_AUTHENTICATION_DATA))
 		default:
 			return this.ProcessTerminate("Invalid First CONNECT Packet Received\n", false)
 		}
@@ -216,24 +876,37 @@ func (this *session) Process(buf []byte) Event {
 		case PACKET_PINGREQ:
 			log.Println("PINGREQ Packet Received")
 			pkgpingresp := NewPacket(PACKET_PINGRESP)
-			if _, err := this.conn.Write(pkgpingresp.Bytes()); err != nil {
+			if err := this.write(pkgpingresp); err != nil {
 				log.Println(err.Error())
 			} else {
 				log.Println("SENT PINGRESP")
 			}
 		case PACKET_PUBREL:
 			clientPacketId := uint32(pkt.(PacketPubrel).GetPacketId()) << 16
-			if _, ok := this.PacketIds[clientPacketId]; !ok {
+			if _, ok := this.PacketIds[clientPacketId]; !ok && this.protocolLevel == PROTOCOL_LEVEL_5 {
+				pkgpubcomp := NewPacketAcks(PACKET_PUBCOMP)
+				pkgpubcomp.SetPacketId(uint16(clientPacketId >> 16))
+				pkgpubcomp.SetReasonCode(REASON_PACKET_IDENTIFIER_NOT_FOUND)
+				if err := this.write(pkgpubcomp); err != nil {
+					log.Println(err.Error())
+				} else {
+					log.Println("SENT PUBCOMP", REASON_PACKET_IDENTIFIER_NOT_FOUND)
+				}
+			} else if !ok {
 				return this.ProcessTerminate(fmt.Sprintf("Invalid PubRel PacketId %x Received\n", clientPacketId>>16), false)
 			} else {
 				delete(this.PacketIds, clientPacketId)
 				pkgpubcomp := NewPacketAcks(PACKET_PUBCOMP)
 				pkgpubcomp.SetPacketId(uint16(clientPacketId >> 16))
-				if _, err := this.conn.Write(pkgpubcomp.Bytes()); err != nil {
+				if err := this.write(pkgpubcomp); err != nil {
 					log.Println(err.Error())
 				} else {
 					log.Println("SENT PUBCOMP")
 				}
+				if msg, ok := this.inbounds[uint16(clientPacketId>>16)]; ok {
+					delete(this.inbounds, uint16(clientPacketId>>16))
+					return newEventPublish(this, msg)
+				}
 			}
 		case PACKET_PUBACK:
 			serverPacketId := uint32(pkt.(PacketPuback).GetPacketId())
@@ -241,15 +914,41 @@ func (this *session) Process(buf []byte) Event {
 				return this.ProcessTerminate(fmt.Sprintf("Invalid PubAck PacketId %x Received\n", serverPacketId), false)
 			} else {
 				delete(this.PacketIds, serverPacketId)
+				delete(this.inflights, uint16(serverPacketId))
+				if this.Persistent() {
+					this.provider.store.DeleteInflight(this.clientId, uint16(serverPacketId))
+				}
+				if err := this.drain(); err != nil {
+					log.Println(err.Error())
+				}
 			}
 		case PACKET_PUBREC:
 			serverPacketId := uint32(pkt.(PacketPuback).GetPacketId())
 			if _, ok := this.PacketIds[serverPacketId]; !ok {
 				return this.ProcessTerminate(fmt.Sprintf("Invalid PubRec PacketId %x Received\n", serverPacketId), false)
+			} else if pkt.(PacketPuback).GetReasonCode() >= 0x80 {
+				//a PUBREC with a failure reason code ends the exchange
+				log.Println("PUBREC Received with Reason Code", pkt.(PacketPuback).GetReasonCode())
+				delete(this.PacketIds, serverPacketId)
+				delete(this.inflights, uint16(serverPacketId))
+				if this.Persistent() {
+					this.provider.store.DeleteInflight(this.clientId, uint16(serverPacketId))
+				}
+				if err := this.drain(); err != nil {
+					log.Println(err.Error())
+				}
 			} else {
+				if f, ok := this.inflights[uint16(serverPacketId)]; ok {
+					f.released = true
+					f.retries = 0
+					f.timestamp = time.Now()
+				}
+				if this.Persistent() {
+					this.provider.store.SaveInflight(this.clientId, uint16(serverPacketId), nil)
+				}
 				pkgpubrel := NewPacketAcks(PACKET_PUBREL)
 				pkgpubrel.SetPacketId(uint16(serverPacketId))
-				if _, err := this.conn.Write(pkgpubrel.Bytes()); err != nil {
+				if err := this.write(pkgpubrel); err != nil {
 					log.Println(err.Error())
 				} else {
 					log.Println("SENT PUBREL")
@@ -261,8 +960,43 @@ func (this *session) Process(buf []byte) Event {
 				return this.ProcessTerminate(fmt.Sprintf("Invalid PubComp PacketId %x Received\n", serverPacketId), false)
 			} else {
 				delete(this.PacketIds, serverPacketId)
+				delete(this.inflights, uint16(serverPacketId))
+				if this.Persistent() {
+					this.provider.store.DeleteInflight(this.clientId, uint16(serverPacketId))
+				}
+				if err := this.drain(); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		case PACKET_AUTH:
+			//re-authentication, started with REAUTHENTICATE
+			pktauth := pkt.(PacketAuth)
+			if this.authMethod == "" || pktauth.GetProperties().GetString(PROPERTY_AUTHENTICATION_METHOD) != this.authMethod ||
+				pktauth.GetReasonCode() != REASON_REAUTHENTICATE && pktauth.GetReasonCode() != REASON_CONTINUE_AUTHENTICATION {
+				this.disconnect(REASON_PROTOCOL_ERROR)
+				return this.ProcessTerminate("Invalid AUTH Packet Received\n", false)
 			}
+			return this.ProcessAuth(pktauth.GetProperties().GetBinary(PROPERTY_AUTHENTICATION_DATA))
 		case PACKET_DISCONNECT:
+			pktdisconnect := pkt.(PacketDisconnect)
+			if this.protocolLevel == PROTOCOL_LEVEL_5 {
+				if properties := pktdisconnect.GetProperties(); properties.Has(PROPERTY_SESSION_EXPIRY_INTERVAL) {
+					expiryInterval := properties.GetInt(PROPERTY_SESSION_EXPIRY_INTERVAL)
+					//a session which expires on disconnection can't be kept afterwards
+					if this.expiryInterval == 0 && expiryInterval != 0 {
+						this.disconnect(REASON_PROTOCOL_ERROR)
+						return this.ProcessTerminate("Invalid DISCONNECT Session Expiry Interval\n", false)
+					}
+					if this.Persistent() && expiryInterval == 0 {
+						this.provider.store.DeleteSession(this.clientId)
+						this.queue.persist(nil, "")
+					}
+					this.expiryInterval = expiryInterval
+				}
+				if pktdisconnect.GetReasonCode() == REASON_DISCONNECT_WITH_WILL_MESSAGE {
+					return this.ProcessTerminate("DISCONNECT Packet Received with Will Message\n", false)
+				}
+			}
 			return this.ProcessTerminate("DISCONNECT Packet Received\n", true)
 		default:
 			return this.ProcessTerminate(fmt.Sprintf("Unexpected %s Packet Received\n", PACKET_TYPE_STRINGS[pkt.GetType()]), false)
@@ -275,106 +1009,261 @@ func (this *session) Process(buf []byte) Event {
 }
 
 func (this *session) ProcessConnect(pkgconn PacketConnect) Event {
-	if pkgconn.GetProtocolLevel() != 0x04 {
-		pkgconnack := NewPacketConnack()
-		pkgconnack.SetSPFlag(false)
-		pkgconnack.SetReturnCode(CONNACK_RETURNCODE_REFUSED_UNACCEPTABLE_PROTOCOL_VERSION)
-		if _, err := this.conn.Write(pkgconnack.Bytes()); err != nil {
-			log.Println(err.Error())
-		} else {
-			log.Println("SENT CONNACK")
+	level, clientId := pkgconn.GetProtocolLevel(), pkgconn.GetClientId()
+	connectFlags := pkgconn.GetConnectFlags()
+
+	//MQTT 3.1 is named MQIsdp, MQTT 3.1.1 and 5 are named MQTT
+	if !(level == PROTOCOL_LEVEL_3_1 && pkgconn.GetProtocolName() == PROTOCOL_NAME_3_1) &&
+		!((level == PROTOCOL_LEVEL_3_1_1 || level == PROTOCOL_LEVEL_5) && pkgconn.GetProtocolName() == PROTOCOL_NAME) {
+		return this.refuseConnect(CONNACK_RETURNCODE_REFUSED_UNACCEPTABLE_PROTOCOL_VERSION, REASON_UNSUPPORTED_PROTOCOL_VERSION,
+			fmt.Errorf("Invalid %x Control Packet Protocol Level %x\n", pkgconn.GetType(), level))
+	}
+	this.protocolLevel = level
+
+	//MQTT 3.1 client identifiers have 1 to 23 characters, MQTT 3.1.1 only
+	//allows a zero-length one with CleanSession=1
+	if level == PROTOCOL_LEVEL_3_1 && (len(clientId) == 0 || len(clientId) > 23) ||
+		level == PROTOCOL_LEVEL_3_1_1 && len(clientId) == 0 && (connectFlags&CONNECT_FLAG_CLEAN_SESSION) == 0 {
+		return this.refuseConnect(CONNACK_RETURNCODE_REFUSED_IDENTIFIER_REJECTED, REASON_CLIENT_IDENTIFIER_NOT_VALID,
+			fmt.Errorf("Invalid %x Control Packet Identifier Rejected\n", pkgconn.GetType()))
+	}
+
+	this.keepAlive = pkgconn.GetKeepAlive()
+	this.connectTime = time.Now()
+	this.clientId = clientId
+	if this.clientId == "" {
+		this.clientId = this.provider.AssignClientId()
+		this.assigned = true
+		log.Println("Assigned Client Identifier", this.clientId)
+	}
+	if (connectFlags & CONNECT_FLAG_USERNAME_FLAG) != 0 {
+		this.userName = pkgconn.GetUserName()
+	}
+
+	this.cleanSession = (connectFlags & CONNECT_FLAG_CLEAN_SESSION) != 0
+	if this.cleanSession {
+		this.expiryInterval = 0
+	} else {
+		this.expiryInterval = SESSION_EXPIRY_NEVER
+	}
+
+	var properties Properties
+	if level == PROTOCOL_LEVEL_5 {
+		//Clean Start only discards the previous session, the session expiry
+		//interval, 0 by default, decides whether this one is kept
+		properties = pkgconn.GetProperties()
+		this.expiryInterval = properties.GetInt(PROPERTY_SESSION_EXPIRY_INTERVAL)
+		if properties.Has(PROPERTY_RECEIVE_MAXIMUM) {
+			this.receiveMaximum = uint16(properties.GetInt(PROPERTY_RECEIVE_MAXIMUM))
 		}
+		this.maxPacketSize = properties.GetInt(PROPERTY_MAXIMUM_PACKET_SIZE)
+		if this.receiveMaximum == 0 || properties.Has(PROPERTY_MAXIMUM_PACKET_SIZE) && this.maxPacketSize == 0 {
+			return this.refuseConnect(CONNACK_RETURNCODE_REFUSED_SERVER_UNAVAILABLE, REASON_PROTOCOL_ERROR,
+				fmt.Errorf("Invalid %x Control Packet Properties\n", pkgconn.GetType()))
+		}
+	}
 
-		this.state = SESSION_STATE_TERMINATED
-		this.err = fmt.Errorf("Invalid %x Control Packet Protocol Level %x\n", pkgconn.GetType(), pkgconn.GetProtocolLevel())
-		return newEventSessionTerminated(this, this.Error(), nil)
-	} else if len(pkgconn.GetClientId()) == 0 && (pkgconn.GetConnectFlags()&CONNECT_FLAG_CLEAN_SESSION) == 0 {
-		pkgconnack := NewPacketConnack()
-		pkgconnack.SetSPFlag(false)
-		pkgconnack.SetReturnCode(CONNACK_RETURNCODE_REFUSED_IDENTIFIER_REJECTED)
-		if _, err := this.conn.Write(pkgconnack.Bytes()); err != nil {
-			log.Println(err.Error())
+	willTopic := pkgconn.GetWillTopic()
+	willMessage := pkgconn.GetWillPayload()
+
+	if (connectFlags & CONNECT_FLAG_WILL_FLAG) != 0 {
+		var retain bool
+		if (connectFlags & CONNECT_FLAG_WILL_RETAIN) != 0 {
+			retain = true
 		} else {
-			log.Println("SENT CONNACK")
+			retain = false
 		}
+		this.will = NewMessagePayload(false,
+			QOS((connectFlags&(CONNECT_FLAG_WILL_QOS_BIT3|CONNECT_FLAG_WILL_QOS_BIT4))>>3),
+			retain,
+			willTopic,
+			willMessage)
+		if level == PROTOCOL_LEVEL_5 && pkgconn.GetWillProperties().Len() != 0 {
+			this.will.SetProperties(pkgconn.GetWillProperties())
+		}
+		//this.will.SetClientId(this.clientId)
+	} else {
+		this.will = nil
+	}
 
-		this.state = SESSION_STATE_TERMINATED
-		this.err = fmt.Errorf("Invalid %x Control Packet Identifier Rejected\n", pkgconn.GetType())
-		return newEventSessionTerminated(this, this.Error(), nil)
+	if level == PROTOCOL_LEVEL_5 && properties.Has(PROPERTY_AUTHENTICATION_METHOD) {
+		this.authMethod = properties.GetString(PROPERTY_AUTHENTICATION_METHOD)
+		this.pendingConnect = pkgconn
+		return this.ProcessAuth(properties.GetBinary(PROPERTY_AUTHENTICATION_DATA))
+	}
+
+	return newEventConnect(this, pkgconn)
+}
+
+//refuseConnect answers the CONNECT with a CONNACK refusing it, with the
+//return code before MQTT 5 and the reason code since
+func (this *session) refuseConnect(returnCode CONNACK_RETURNCODE, reasonCode ReasonCode, reason error) Event {
+	pkgconnack := NewPacketConnack()
+	pkgconnack.SetSPFlag(false)
+	pkgconnack.SetReturnCode(returnCode)
+	pkgconnack.SetReasonCode(reasonCode)
+	if err := this.write(pkgconnack); err != nil {
+		log.Println(err.Error())
 	} else {
-		this.keepAlive = pkgconn.GetKeepAlive()
-		this.clientId = pkgconn.GetClientId()
+		log.Println("SENT CONNACK")
+	}
+
+	this.state = SESSION_STATE_TERMINATED
+	this.err = reason
+	return newEventSessionTerminated(this, reason.Error(), nil)
+}
 
-		connectFlags := pkgconn.GetConnectFlags()
-		willTopic := pkgconn.GetWillTopic()
-		willMessage := pkgconn.GetWillMessage()
+//ProcessAuth runs a step of the MQTT 5 enhanced authentication with the
+//provider's ExtendedAuthenticator, on CONNECT or on re-authentication
+func (this *session) ProcessAuth(data []byte) Event {
+	authenticator, ok := this.provider.GetAuthenticator().(ExtendedAuthenticator)
+	if !ok {
+		if this.state == SESSION_STATE_CREATED {
+			return this.refuseConnect(CONNACK_RETURNCODE_REFUSED_NOT_AUTHORIZED, REASON_BAD_AUTHENTICATION_METHOD,
+				fmt.Errorf("Authentication Method %s Not Supported\n", this.authMethod))
+		}
+		this.disconnect(REASON_BAD_AUTHENTICATION_METHOD)
+		return this.ProcessTerminate(fmt.Sprintf("Authentication Method %s Not Supported\n", this.authMethod), false)
+	}
 
-		if (connectFlags & CONNECT_FLAG_WILL_FLAG) != 0 {
-			var retain bool
-			if (connectFlags & CONNECT_FLAG_WILL_RETAIN) != 0 {
-				retain = true
-			} else {
-				retain = false
-			}
-			this.will = NewMessage(false,
-				QOS((connectFlags&(CONNECT_FLAG_WILL_QOS_BIT3|CONNECT_FLAG_WILL_QOS_BIT4))>>3),
-				retain,
-				willTopic,
-				willMessage)
-			//this.will.SetClientId(this.clientId)
+	reasonCode, data := authenticator.AuthenticateExtended(this, this.authMethod, data)
+	switch {
+	case reasonCode == REASON_CONTINUE_AUTHENTICATION || reasonCode == REASON_SUCCESS && this.state == SESSION_STATE_CONNECTED:
+		pktauth := NewPacketAuth()
+		pktauth.SetReasonCode(reasonCode)
+		pktauth.GetProperties().SetString(PROPERTY_AUTHENTICATION_METHOD, this.authMethod)
+		if data != nil {
+			pktauth.GetProperties().SetBinary(PROPERTY_AUTHENTICATION_DATA, data)
+		}
+		if err := this.write(pktauth); err != nil {
+			log.Println(err.Error())
 		} else {
-			this.will = nil
+			log.Println("SENT AUTH", reasonCode)
 		}
-
+		return nil
+	case reasonCode == REASON_SUCCESS:
+		//the CONNACK carries the last authentication data
+		this.authData = data
+		pkgconn := this.pendingConnect
+		this.pendingConnect = nil
 		return newEventConnect(this, pkgconn)
 	}
+
+	if reasonCode < 0x80 {
+		reasonCode = REASON_NOT_AUTHORIZED
+	}
+	if this.state == SESSION_STATE_CREATED {
+		return this.refuseConnect(connackReturnCode(reasonCode), reasonCode,
+			fmt.Errorf("Authentication Failed with Reason Code %x\n", reasonCode))
+	}
+	this.disconnect(reasonCode)
+	return this.ProcessTerminate(fmt.Sprintf("Re-authentication Failed with Reason Code %x\n", reasonCode), false)
 }
 
 func (this *session) ProcessPublish(pktpub PacketPublish) Event {
-	//pktpub.GetMessage().SetClientId(this.clientId)
-	qos := pktpub.GetMessage().GetQos()
+	msg := pktpub.GetMessage()
+	if m, ok := msg.(*message); ok {
+		m.clientId = this.clientId
+	}
+	if properties := msg.GetProperties(); this.protocolLevel == PROTOCOL_LEVEL_5 && properties != nil {
+		//no topic alias maximum is sent in CONNACK, so the client can't use any
+		if properties.Has(PROPERTY_TOPIC_ALIAS) {
+			this.disconnect(REASON_TOPIC_ALIAS_INVALID)
+			return this.ProcessTerminate("Invalid PUBLISH Topic Alias\n", false)
+		}
+		if properties.Has(PROPERTY_MESSAGE_EXPIRY_INTERVAL) {
+			msg.SetExpiry(time.Now().Add(time.Duration(properties.GetInt(PROPERTY_MESSAGE_EXPIRY_INTERVAL)) * time.Second))
+		}
+	}
+
+	//an unauthorized PUBLISH is acknowledged, with a failure reason code in
+	//MQTT 5, and dropped
+	reasonCode := REASON_SUCCESS
+	authorized := this.provider.Authorize(this, msg.GetTopic(), ACL_WRITE)
+	if !authorized {
+		log.Println("Publish Not Authorized", this.clientId, msg.GetTopic())
+		reasonCode = REASON_NOT_AUTHORIZED
+	}
+
+	qos := msg.GetQos()
 	if qos == QOS_TWO {
 		clientPacketId := pktpub.GetPacketId()
-		this.PacketIds[uint32(clientPacketId)<<16] = clientPacketId
+		_, received := this.PacketIds[uint32(clientPacketId)<<16]
+		//a PUBREC with a failure reason code ends the exchange
+		if authorized || this.protocolLevel != PROTOCOL_LEVEL_5 {
+			this.PacketIds[uint32(clientPacketId)<<16] = clientPacketId
+		}
 		pkgpubrec := NewPacketAcks(PACKET_PUBREC)
 		pkgpubrec.SetPacketId(clientPacketId)
-		if _, err := this.conn.Write(pkgpubrec.Bytes()); err != nil {
+		pkgpubrec.SetReasonCode(reasonCode)
+		if err := this.write(pkgpubrec); err != nil {
 			log.Println(err.Error())
 		} else {
 			log.Println("SENT PUBREC")
 		}
+		//the message has already been accepted until PUBREL is received
+		if received || !authorized {
+			return nil
+		}
+		if this.qos2Delivery == QOS2_DELIVERY_ON_PUBREL {
+			this.inbounds[clientPacketId] = msg
+			return nil
+		}
 	} else if qos == QOS_ONE {
 		pkgpuback := NewPacketAcks(PACKET_PUBACK)
 		pkgpuback.SetPacketId(pktpub.GetPacketId())
-		if _, err := this.conn.Write(pkgpuback.Bytes()); err != nil {
+		pkgpuback.SetReasonCode(reasonCode)
+		if err := this.write(pkgpuback); err != nil {
 			log.Println(err.Error())
 		} else {
 			log.Println("SENT PUBACK")
 		}
 	}
-	return newEventPublish(this, pktpub.GetMessage())
+	if !authorized {
+		return nil
+	}
+	return newEventPublish(this, msg)
 }
 
 func (this *session) ProcessSubscribe(pktsub PacketSubscribe) Event {
+	//no subscription identifier available is sent in CONNACK
+	if this.protocolLevel == PROTOCOL_LEVEL_5 && pktsub.GetProperties().Has(PROPERTY_SUBSCRIPTION_IDENTIFIER) {
+		this.disconnect(REASON_SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED)
+		return this.ProcessTerminate("Invalid SUBSCRIBE Subscription Identifier\n", false)
+	}
+
 	this.topicsToBeAdded = make([]string, len(pktsub.GetSubscribeTopics()))
 	copy(this.topicsToBeAdded, pktsub.GetSubscribeTopics())
 
 	this.qosToBeAdded = make([]QOS, len(pktsub.GetQoSs()))
 	copy(this.qosToBeAdded, pktsub.GetQoSs())
 
+	this.optionsToBeAdded = make([]byte, len(pktsub.GetOptions()))
+	copy(this.optionsToBeAdded, pktsub.GetOptions())
+
 	return newEventSubscribe(this, pktsub.GetPacketId(), pktsub.GetSubscribeTopics(), pktsub.GetQoSs())
 }
 
 func (this *session) ProcessUnsubscribe(pktunsub PacketUnsubscribe) Event {
 	topics := pktunsub.GetUnsubscribeTopics()
+	reasonCodes := make([]ReasonCode, len(topics))
 	for i := 0; i < len(topics); i++ {
+		if _, ok := this.topics[topics[i]]; !ok {
+			reasonCodes[i] = REASON_NO_SUBSCRIPTION_EXISTED
+		}
 		delete(this.topics, topics[i])
 		delete(this.qos, topics[i])
+		delete(this.options, topics[i])
+		this.provider.tree.Unsubscribe(this, topics[i])
+		if this.Persistent() {
+			this.provider.store.DeleteSubscription(this.clientId, topics[i])
+		}
 	}
 
 	pkgsuback := NewPacketAcks(PACKET_UNSUBACK)
 	pkgsuback.SetPacketId(pktunsub.GetPacketId())
-	if _, err := this.conn.Write(pkgsuback.Bytes()); err != nil {
+	pkgsuback.SetReasonCodes(reasonCodes)
+	if err := this.write(pkgsuback); err != nil {
 		log.Println(err.Error())
 	} else {
 		log.Println("SENT UNSUBACK")
@@ -398,64 +1287,5 @@ func (this *session) Will() Message {
 
 // Does a topic match a subscription?
 func (this *session) Match(sub, topic string) bool {
-	var slen, tlen int
-	var spos, tpos int
-	multilevel_wildcard := false
-
-	slen = len(sub)
-	tlen = len(topic)
-
-	if slen != 0 && tlen != 0 {
-		if sub[0] == '$' && topic[0] != '$' || (topic[0] == '$' && sub[0] != '$') {
-			return false
-		}
-	}
-
-	spos = 0
-	tpos = 0
-
-	for spos < slen && tpos < tlen {
-		if sub[spos] == topic[tpos] {
-			spos++
-			tpos++
-			if spos == slen && tpos == tlen {
-				return true
-			} else if tpos == tlen && spos == slen-1 && sub[spos] == '+' {
-				spos++
-				return true
-			}
-		} else {
-			if sub[spos] == '+' {
-				spos++
-				for tpos < tlen && topic[tpos] != '/' {
-					tpos++
-				}
-				if tpos == tlen && spos == slen {
-					return true
-				}
-			} else if sub[spos] == '#' {
-				multilevel_wildcard = true
-				if spos+1 != slen {
-					return false
-				} else {
-					return true
-				}
-			} else {
-				return false
-			}
-		}
-		if tpos == tlen-1 {
-			/* Check for e.g. foo matching foo/# */
-			if spos == slen-3 && sub[spos+1] == '/' && sub[spos+2] == '#' {
-				multilevel_wildcard = true
-				return true
-			}
-		}
-	}
-
-	if multilevel_wildcard == false && (tpos < tlen || spos < slen) {
-		return false
-	}
-
-	return true
+	return MatchTopic(sub, topic)
 }
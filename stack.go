@@ -1,7 +1,10 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"sync"
 )
 
 ////////////////////Interface//////////////////////////////
@@ -15,8 +18,13 @@ type Stack interface {
 	GetProviders() []Provider
 	DeleteProvider(p Provider)
 
+	CreateClient(t Transport, clientId string) Client
+	GetClients() []Client
+	DeleteClient(c Client)
+
 	Run()
-	Stop()
+	//Stop stops the providers concurrently, see Provider.Stop
+	Stop(ctx context.Context) error
 }
 
 ////////////////////Implementation////////////////////////
@@ -33,6 +41,7 @@ func GetStack() Stack {
 type stack struct {
 	transports map[Transport]*transport
 	providers  map[Provider]*provider
+	clients    map[Client]*client
 }
 
 func newStack() Stack {
@@ -40,6 +49,7 @@ func newStack() Stack {
 
 	this.transports = make(map[Transport]*transport)
 	this.providers = make(map[Provider]*provider)
+	this.clients = make(map[Client]*client)
 
 	return this
 }
@@ -92,14 +102,53 @@ func (this *stack) DeleteProvider(p Provider) {
 	delete(this.providers, p)
 }
 
+func (this *stack) CreateClient(t Transport, clientId string) Client {
+	c := newClient(t, clientId)
+
+	this.clients[c] = c
+
+	return c
+}
+
+func (this *stack) GetClients() []Client {
+	clients := make([]Client, len(this.clients))
+
+	l := 0
+	for _, value := range this.clients {
+		clients[l] = value
+		l++
+	}
+
+	return clients
+}
+
+func (this *stack) DeleteClient(c Client) {
+	delete(this.clients, c)
+}
+
 func (this *stack) Run() {
 	for _, p := range this.providers {
 		go p.Run()
 	}
 }
 
-func (this *stack) Stop() {
+func (this *stack) Stop(ctx context.Context) error {
+	var errs []error
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+
 	for _, p := range this.providers {
-		p.Stop()
+		waitGroup.Add(1)
+		go func(p *provider) {
+			defer waitGroup.Done()
+			if err := p.Stop(ctx); err != nil {
+				mutex.Lock()
+				errs = append(errs, err)
+				mutex.Unlock()
+			}
+		}(p)
 	}
+	waitGroup.Wait()
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,558 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+////////////////////Interface//////////////////////////////
+
+//Store keeps the state of sessions with CleanSession=0 and the retained
+//messages, so that they survive a broker restart
+type Store interface {
+	RetainedStore
+
+	//SaveSession stores a session kept for expiryInterval seconds after its
+	//disconnection, or updates it. disconnectTime is zero while connected
+	SaveSession(clientId string, expiryInterval uint32, disconnectTime time.Time)
+	DeleteSession(clientId string)
+	GetSessions() []string
+	GetSession(clientId string) (expiryInterval uint32, disconnectTime time.Time)
+
+	//options are the MQTT 5 subscription options
+	SaveSubscription(clientId string, filter string, qos QOS, options byte)
+	DeleteSubscription(clientId string, filter string)
+	GetSubscriptions(clientId string) map[string]QOS
+	GetSubscriptionOptions(clientId string) map[string]byte
+
+	//SaveInflight stores an outgoing QoS 1 or 2 message; a nil msg marks a
+	//QoS 2 message released by PUBREC and waiting for PUBCOMP
+	SaveInflight(clientId string, packetId uint16, msg Message)
+	DeleteInflight(clientId string, packetId uint16)
+	GetInflights(clientId string) map[uint16]Message
+
+	//the offline queue, PushQueued appends a message and PopQueued removes
+	//the oldest one
+	PushQueued(clientId string, msg Message)
+	PopQueued(clientId string)
+	GetQueued(clientId string) []Message
+
+	//Sync commits what has been saved so far to stable storage
+	Sync() error
+	Close() error
+}
+
+const (
+	STORE_COMPACT_MIN = 1000 //records appended before the log is compacted
+)
+
+////////////////////Implementation////////////////////////
+
+type stored_session struct {
+	expiryInterval uint32
+	disconnectTime time.Time
+	subscriptions  map[string]QOS
+	options        map[string]byte
+	inflights      map[uint16]Message
+	queued         []Message
+}
+
+type memory_store struct {
+	*retained_store
+
+	sessions map[string]*stored_session
+	mutex    sync.RWMutex
+}
+
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memory_store {
+	this := &memory_store{}
+
+	this.retained_store = NewRetainedStore().(*retained_store)
+	this.sessions = make(map[string]*stored_session)
+
+	return this
+}
+
+func (this *memory_store) SaveSession(clientId string, expiryInterval uint32, disconnectTime time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	s, ok := this.sessions[clientId]
+	if !ok {
+		s = &stored_session{
+			subscriptions: make(map[string]QOS),
+			options:       make(map[string]byte),
+			inflights:     make(map[uint16]Message)}
+		this.sessions[clientId] = s
+	}
+	s.expiryInterval = expiryInterval
+	s.disconnectTime = disconnectTime
+}
+
+func (this *memory_store) DeleteSession(clientId string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	delete(this.sessions, clientId)
+}
+
+func (this *memory_store) GetSessions() []string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	clientIds := make([]string, 0, len(this.sessions))
+	for clientId := range this.sessions {
+		clientIds = append(clientIds, clientId)
+	}
+
+	return clientIds
+}
+
+func (this *memory_store) GetSession(clientId string) (uint32, time.Time) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if s, ok := this.sessions[clientId]; ok {
+		return s.expiryInterval, s.disconnectTime
+	}
+	return 0, time.Time{}
+}
+
+func (this *memory_store) SaveSubscription(clientId string, filter string, qos QOS, options byte) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if s, ok := this.sessions[clientId]; ok {
+		s.subscriptions[filter] = qos
+		s.options[filter] = options
+	}
+}
+
+func (this *memory_store) DeleteSubscription(clientId string, filter string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if s, ok := this.sessions[clientId]; ok {
+		delete(s.subscriptions, filter)
+		delete(s.options, filter)
+	}
+}
+
+func (this *memory_store) GetSubscriptions(clientId string) map[string]QOS {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	subscriptions := make(map[string]QOS)
+	if s, ok := this.sessions[clientId]; ok {
+		for filter, qos := range s.subscriptions {
+			subscriptions[filter] = qos
+		}
+	}
+
+	return subscriptions
+}
+
+func (this *memory_store) GetSubscriptionOptions(clientId string) map[string]byte {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	options := make(map[string]byte)
+	if s, ok := this.sessions[clientId]; ok {
+		for filter, o := range s.options {
+			options[filter] = o
+		}
+	}
+
+	return options
+}
+
+func (this *memory_store) SaveInflight(clientId string, packetId uint16, msg Message) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if s, ok := this.sessions[clientId]; ok {
+		s.inflights[packetId] = msg
+	}
+}
+
+func (this *memory_store) DeleteInflight(clientId string, packetId uint16) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if s, ok := this.sessions[clientId]; ok {
+		delete(s.inflights, packetId)
+	}
+}
+
+func (this *memory_store) GetInflights(clientId string) map[uint16]Message {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	inflights := make(map[uint16]Message)
+	if s, ok := this.sessions[clientId]; ok {
+		for packetId, msg := range s.inflights {
+			inflights[packetId] = msg
+		}
+	}
+
+	return inflights
+}
+
+func (this *memory_store) PushQueued(clientId string, msg Message) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if s, ok := this.sessions[clientId]; ok {
+		s.queued = append(s.queued, msg)
+	}
+}
+
+func (this *memory_store) PopQueued(clientId string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if s, ok := this.sessions[clientId]; ok && len(s.queued) != 0 {
+		s.queued[0] = nil
+		s.queued = s.queued[1:]
+	}
+}
+
+func (this *memory_store) GetQueued(clientId string) []Message {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	var queued []Message
+	if s, ok := this.sessions[clientId]; ok {
+		queued = append(queued, s.queued...)
+	}
+
+	return queued
+}
+
+func (this *memory_store) Sync() error {
+	return nil
+}
+
+func (this *memory_store) Close() error {
+	return nil
+}
+
+/////////////////////
+type store_op byte
+
+const (
+	STORE_OP_SAVE_SESSION store_op = iota
+	STORE_OP_DELETE_SESSION
+	STORE_OP_SAVE_SUBSCRIPTION
+	STORE_OP_DELETE_SUBSCRIPTION
+	STORE_OP_SAVE_INFLIGHT
+	STORE_OP_DELETE_INFLIGHT
+	STORE_OP_SAVE_RETAINED
+	STORE_OP_DELETE_RETAINED
+	STORE_OP_PUSH_QUEUED
+	STORE_OP_POP_QUEUED
+)
+
+type store_message struct {
+	Qos        QOS    `json:"q"`
+	Retain     bool   `json:"r,omitempty"`
+	Topic      string `json:"t"`
+	Content    []byte `json:"c"`
+	Properties []byte `json:"p,omitempty"` //MQTT 5 encoded properties
+	Expiry     int64  `json:"x,omitempty"` //Unix nanoseconds
+}
+
+type store_record struct {
+	Op       store_op       `json:"op"`
+	ClientId string         `json:"id,omitempty"`
+	Filter   string         `json:"f,omitempty"`
+	Qos      QOS            `json:"q,omitempty"`
+	Options  byte           `json:"o,omitempty"`
+	PacketId uint16         `json:"p,omitempty"`
+	Topic    string         `json:"t,omitempty"`
+	Message  *store_message `json:"m,omitempty"`
+	Expiry   uint32         `json:"e,omitempty"` //session expiry interval
+	Time     int64          `json:"d,omitempty"` //Unix nanoseconds of the disconnection
+}
+
+func newStoreMessage(msg Message) *store_message {
+	if msg == nil {
+		return nil
+	}
+	this := &store_message{Qos: msg.GetQos(), Retain: msg.GetRetain(), Topic: msg.GetTopic(), Content: msg.GetPayload()}
+	if properties := msg.GetProperties(); properties != nil {
+		this.Properties = encodingProperties(properties)
+	}
+	if expiry := msg.GetExpiry(); !expiry.IsZero() {
+		this.Expiry = expiry.UnixNano()
+	}
+	return this
+}
+
+func (this *store_message) Message() Message {
+	if this == nil {
+		return nil
+	}
+	msg := NewMessagePayload(false, this.Qos, this.Retain, this.Topic, this.Content)
+	if this.Properties != nil {
+		if properties, _, err := decodingProperties(this.Properties); err == nil {
+			msg.SetProperties(properties)
+		}
+	}
+	if this.Expiry != 0 {
+		msg.SetExpiry(time.Unix(0, this.Expiry))
+	}
+	return msg
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+//file_store keeps the state in memory and appends every change to a log,
+//which is replayed when the store is opened and rewritten once it grows
+//larger than twice the live state
+type file_store struct {
+	*memory_store
+
+	path     string
+	file     *os.File
+	records  int
+	snapshot int
+	mutex    sync.Mutex
+}
+
+func NewFileStore(path string) (Store, error) {
+	this := &file_store{}
+
+	this.memory_store = newMemoryStore()
+	this.path = path
+
+	if err := this.replay(); err != nil {
+		return nil, err
+	}
+	if err := this.Compact(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *file_store) replay() error {
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 512*1024*1024)
+	for scanner.Scan() {
+		var r store_record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			//a torn last record from a crash is ignored
+			log.Println("Skipping Store Record", err)
+			continue
+		}
+		this.apply(&r)
+	}
+
+	return scanner.Err()
+}
+
+func (this *file_store) apply(r *store_record) {
+	switch r.Op {
+	case STORE_OP_SAVE_SESSION:
+		this.memory_store.SaveSession(r.ClientId, r.Expiry, fromUnixNano(r.Time))
+	case STORE_OP_DELETE_SESSION:
+		this.memory_store.DeleteSession(r.ClientId)
+	case STORE_OP_SAVE_SUBSCRIPTION:
+		this.memory_store.SaveSubscription(r.ClientId, r.Filter, r.Qos, r.Options)
+	case STORE_OP_DELETE_SUBSCRIPTION:
+		this.memory_store.DeleteSubscription(r.ClientId, r.Filter)
+	case STORE_OP_SAVE_INFLIGHT:
+		this.memory_store.SaveInflight(r.ClientId, r.PacketId, r.Message.Message())
+	case STORE_OP_DELETE_INFLIGHT:
+		this.memory_store.DeleteInflight(r.ClientId, r.PacketId)
+	case STORE_OP_SAVE_RETAINED:
+		this.memory_store.SaveRetained(r.Message.Message())
+	case STORE_OP_DELETE_RETAINED:
+		this.memory_store.DeleteRetained(r.Topic)
+	case STORE_OP_PUSH_QUEUED:
+		this.memory_store.PushQueued(r.ClientId, r.Message.Message())
+	case STORE_OP_POP_QUEUED:
+		this.memory_store.PopQueued(r.ClientId)
+	}
+}
+
+func (this *file_store) append(r *store_record) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.apply(r)
+	if this.file == nil {
+		log.Println("Appending Store Record to Closed Store")
+		return
+	}
+
+	buf, _ := json.Marshal(r)
+	if _, err := this.file.Write(append(buf, '\n')); err != nil {
+		log.Println("Appending Store Record", err)
+		return
+	}
+
+	if this.records++; this.records > STORE_COMPACT_MIN && this.records > 2*this.snapshot {
+		if err := this.compact(); err != nil {
+			log.Println("Compacting Store", err)
+		}
+	}
+}
+
+//Compact rewrites the log with only the records of the live state
+func (this *file_store) Compact() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.compact()
+}
+
+func (this *file_store) compact() error {
+	var records []*store_record
+	for _, clientId := range this.memory_store.GetSessions() {
+		expiryInterval, disconnectTime := this.memory_store.GetSession(clientId)
+		records = append(records, &store_record{Op: STORE_OP_SAVE_SESSION, ClientId: clientId, Expiry: expiryInterval, Time: unixNano(disconnectTime)})
+		options := this.memory_store.GetSubscriptionOptions(clientId)
+		for filter, qos := range this.memory_store.GetSubscriptions(clientId) {
+			records = append(records, &store_record{Op: STORE_OP_SAVE_SUBSCRIPTION, ClientId: clientId, Filter: filter, Qos: qos, Options: options[filter]})
+		}
+		for packetId, msg := range this.memory_store.GetInflights(clientId) {
+			records = append(records, &store_record{Op: STORE_OP_SAVE_INFLIGHT, ClientId: clientId, PacketId: packetId, Message: newStoreMessage(msg)})
+		}
+		for _, msg := range this.memory_store.GetQueued(clientId) {
+			records = append(records, &store_record{Op: STORE_OP_PUSH_QUEUED, ClientId: clientId, Message: newStoreMessage(msg)})
+		}
+	}
+	for _, msg := range this.memory_store.all() {
+		records = append(records, &store_record{Op: STORE_OP_SAVE_RETAINED, Message: newStoreMessage(msg)})
+	}
+
+	tmp, err := os.Create(this.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, r := range records {
+		buf, _ := json.Marshal(r)
+		writer.Write(append(buf, '\n'))
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), this.path); err != nil {
+		return err
+	}
+
+	if this.file != nil {
+		this.file.Close()
+	}
+	if this.file, err = os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	this.records = len(records)
+	this.snapshot = len(records)
+
+	return nil
+}
+
+func (this *file_store) SaveSession(clientId string, expiryInterval uint32, disconnectTime time.Time) {
+	this.append(&store_record{Op: STORE_OP_SAVE_SESSION, ClientId: clientId, Expiry: expiryInterval, Time: unixNano(disconnectTime)})
+}
+
+func (this *file_store) DeleteSession(clientId string) {
+	this.append(&store_record{Op: STORE_OP_DELETE_SESSION, ClientId: clientId})
+}
+
+func (this *file_store) SaveSubscription(clientId string, filter string, qos QOS, options byte) {
+	this.append(&store_record{Op: STORE_OP_SAVE_SUBSCRIPTION, ClientId: clientId, Filter: filter, Qos: qos, Options: options})
+}
+
+func (this *file_store) DeleteSubscription(clientId string, filter string) {
+	this.append(&store_record{Op: STORE_OP_DELETE_SUBSCRIPTION, ClientId: clientId, Filter: filter})
+}
+
+func (this *file_store) SaveInflight(clientId string, packetId uint16, msg Message) {
+	this.append(&store_record{Op: STORE_OP_SAVE_INFLIGHT, ClientId: clientId, PacketId: packetId, Message: newStoreMessage(msg)})
+}
+
+func (this *file_store) DeleteInflight(clientId string, packetId uint16) {
+	this.append(&store_record{Op: STORE_OP_DELETE_INFLIGHT, ClientId: clientId, PacketId: packetId})
+}
+
+func (this *file_store) PushQueued(clientId string, msg Message) {
+	this.append(&store_record{Op: STORE_OP_PUSH_QUEUED, ClientId: clientId, Message: newStoreMessage(msg)})
+}
+
+func (this *file_store) PopQueued(clientId string) {
+	this.append(&store_record{Op: STORE_OP_POP_QUEUED, ClientId: clientId})
+}
+
+func (this *file_store) SaveRetained(msg Message) {
+	this.append(&store_record{Op: STORE_OP_SAVE_RETAINED, Message: newStoreMessage(msg)})
+}
+
+func (this *file_store) DeleteRetained(topic string) {
+	this.append(&store_record{Op: STORE_OP_DELETE_RETAINED, Topic: topic})
+}
+
+func (this *file_store) Sync() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+	return this.file.Sync()
+}
+
+func (this *file_store) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Sync()
+	if cerr := this.file.Close(); err == nil {
+		err = cerr
+	}
+	this.file = nil
+
+	return err
+}
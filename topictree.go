@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+)
+
+////////////////////Interface//////////////////////////////
+
+// TopicTree indexes subscriptions by topic level, with '+' and '#' nodes for
+// the wildcards, so matching a topic doesn't walk every subscription
+type TopicTree interface {
+	Subscribe(s Session, filter string, qos QOS)
+	Unsubscribe(s Session, filter string)
+	Remove(s Session)
+
+	//Match returns the matching filters and their granted QoS per session
+	Match(topic string) map[Session]map[string]QOS
+}
+
+////////////////////Implementation////////////////////////
+
+// Does a topic match a subscription? They are compared level by level, as
+// in the topic tree, so retained messages and offline queues match the same
+// topics as the forwarded messages
+func MatchTopic(sub, topic string) bool {
+	filter := strings.Split(sub, "/")
+	levels := strings.Split(topic, "/")
+
+	for i, level := range filter {
+		//wildcards at the first level don't match topics beginning with '$'
+		wildcards := i != 0 || !strings.HasPrefix(levels[0], "$")
+		if level == "#" {
+			//"sport/#" also matches the parent level "sport"
+			return wildcards
+		}
+		if i == len(levels) {
+			return false
+		}
+		if level == "+" {
+			if !wildcards {
+				return false
+			}
+		} else if level != levels[i] {
+			return false
+		}
+	}
+
+	return len(filter) == len(levels)
+}
+
+type topic_node struct {
+	filter      string
+	children    map[string]*topic_node
+	subscribers map[Session]QOS
+}
+
+func newTopicNode(filter string) *topic_node {
+	this := &topic_node{}
+
+	this.filter = filter
+	this.children = make(map[string]*topic_node)
+	this.subscribers = make(map[Session]QOS)
+
+	return this
+}
+
+func (this *topic_node) collect(matches map[Session]map[string]QOS) {
+	for s, qos := range this.subscribers {
+		if _, ok := matches[s]; !ok {
+			matches[s] = make(map[string]QOS)
+		}
+		matches[s][this.filter] = qos
+	}
+}
+
+func (this *topic_node) match(levels []string, i int, matches map[Session]map[string]QOS) {
+	if i == len(levels) {
+		this.collect(matches)
+		//"sport/#" also matches the parent level "sport"
+		if child, ok := this.children["#"]; ok {
+			child.collect(matches)
+		}
+		return
+	}
+
+	//wildcards at the first level don't match topics beginning with '$'
+	wildcards := i != 0 || !strings.HasPrefix(levels[0], "$")
+	if child, ok := this.children["#"]; ok && wildcards {
+		child.collect(matches)
+	}
+	if child, ok := this.children["+"]; ok && wildcards {
+		child.match(levels, i+1, matches)
+	}
+	if child, ok := this.children[levels[i]]; ok {
+		child.match(levels, i+1, matches)
+	}
+}
+
+type topic_tree struct {
+	root    *topic_node
+	filters map[Session]map[string]bool
+	mutex   sync.RWMutex
+}
+
+func NewTopicTree() TopicTree {
+	this := &topic_tree{}
+
+	this.root = newTopicNode("")
+	this.filters = make(map[Session]map[string]bool)
+
+	return this
+}
+
+func (this *topic_tree) Subscribe(s Session, filter string, qos QOS) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	node := this.root
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode(strings.Join(levels[:i+1], "/"))
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers[s] = qos
+
+	if _, ok := this.filters[s]; !ok {
+		this.filters[s] = make(map[string]bool)
+	}
+	this.filters[s][filter] = true
+}
+
+func (this *topic_tree) Unsubscribe(s Session, filter string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.unsubscribe(s, filter)
+}
+
+func (this *topic_tree) Remove(s Session) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for filter := range this.filters[s] {
+		this.unsubscribe(s, filter)
+	}
+}
+
+func (this *topic_tree) unsubscribe(s Session, filter string) {
+	levels := strings.Split(filter, "/")
+	nodes := make([]*topic_node, 0, len(levels)+1)
+
+	node := this.root
+	nodes = append(nodes, node)
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return
+		}
+		node = child
+		nodes = append(nodes, node)
+	}
+	delete(node.subscribers, s)
+
+	//prune the nodes left without subscribers and children
+	for i := len(levels); i > 0; i-- {
+		if len(nodes[i].subscribers) != 0 || len(nodes[i].children) != 0 {
+			break
+		}
+		delete(nodes[i-1].children, levels[i-1])
+	}
+
+	if filters, ok := this.filters[s]; ok {
+		if delete(filters, filter); len(filters) == 0 {
+			delete(this.filters, s)
+		}
+	}
+}
+
+func (this *topic_tree) Match(topic string) map[Session]map[string]QOS {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	matches := make(map[Session]map[string]QOS)
+	this.root.match(strings.Split(topic, "/"), 0, matches)
+
+	return matches
+}
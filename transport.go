@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,19 +14,26 @@ import (
 const (
 	TCP  = "tcp"
 	WS   = "ws"
+	WSS  = "wss"
+	UNIX = "unix" //address is the socket path, port is unused
+	PIPE = "pipe" //in-memory, address and port only name the pipe
 	TLS  = "tls"
 	SSL  = "ssl"
 	TCPS = "tcps"
 
 	PORT_1883 = 1883 //Non-TLS
 	PORT_8883 = 8883 //TLS
+
+	TLS_HANDSHAKE_TIMEOUT = 10 //seconds
 )
 
 type Transport interface {
-	GetNetwork() string //"tcp", "tls", or "ws"...
+	GetNetwork() string //"tcp", "tls", "ws", "unix" or "pipe"...
 	GetAddress() string
 	GetPort() int
 	GetTLSConfig() *tls.Config
+	GetPath() string //websocket path, "/mqtt" by default
+	SetPath(path string)
 	
 	Dial() (net.Conn, error)
 	
@@ -41,10 +49,12 @@ type transport struct {
 	address string //for server, it is laddr; for client, it is raddr
 	port    int
 	tlsc    *tls.Config
+	path    string
 
 	//for server
-	lner net.Listener
-	quit chan bool
+	lner      net.Listener
+	quit      chan bool
+	closeOnce sync.Once
 }
 
 func newTransport(network string, address string, port int, tlsc *tls.Config) *transport {
@@ -54,6 +64,7 @@ func newTransport(network string, address string, port int, tlsc *tls.Config) *t
 	this.address = address
 	this.port = port
 	this.tlsc = tlsc
+	this.path = WS_PATH
 
 	this.lner = nil
 	this.quit = make(chan bool)
@@ -77,6 +88,14 @@ func (this *transport) GetTLSConfig() *tls.Config {
 	return this.tlsc
 }
 
+func (this *transport) GetPath() string {
+	return this.path
+}
+
+func (this *transport) SetPath(path string) {
+	this.path = path
+}
+
 //Client Transport
 func (this *transport) Dial() (net.Conn, error) {
 	var conn net.Conn
@@ -91,6 +110,23 @@ func (this *transport) Dial() (net.Conn, error) {
 		fallthrough
 	case TLS:
 		conn, err = tls.Dial("tcp", net.JoinHostPort(this.address, strconv.Itoa(this.port)), this.tlsc)
+	case WS:
+		conn, err = net.Dial("tcp", net.JoinHostPort(this.address, strconv.Itoa(this.port)))
+	case WSS:
+		conn, err = tls.Dial("tcp", net.JoinHostPort(this.address, strconv.Itoa(this.port)), this.tlsc)
+	case UNIX:
+		conn, err = net.Dial("unix", this.address)
+	case PIPE:
+		conn, err = dialPipe(net.JoinHostPort(this.address, strconv.Itoa(this.port)))
+	}
+
+	if err == nil && (this.network == WS || this.network == WSS) {
+		wsconn := newWsConn(conn, false, this.path)
+		if err = wsconn.dial(net.JoinHostPort(this.address, strconv.Itoa(this.port))); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = wsconn
 	}
 
 	return conn, err
@@ -102,13 +138,22 @@ func (this *transport) Listen() error {
 
 	switch this.network {
 	case TCP:
-		this.lner, err = net.Listen("tcp", net.JoinHostPort(this.address, strconv.Itoa(this.port)))
+		fallthrough
 	case SSL:
 		fallthrough
 	case TCPS:
 		fallthrough
 	case TLS:
-		this.lner, err = tls.Listen("tcp", net.JoinHostPort(this.address, strconv.Itoa(this.port)), this.tlsc)
+		fallthrough
+	case WS:
+		fallthrough
+	case WSS:
+		//TLS is started per connection, so the listener keeps SetDeadline
+		this.lner, err = net.Listen("tcp", net.JoinHostPort(this.address, strconv.Itoa(this.port)))
+	case UNIX:
+		this.lner, err = net.Listen("unix", this.address)
+	case PIPE:
+		this.lner, err = listenPipe(net.JoinHostPort(this.address, strconv.Itoa(this.port)))
 	}
 
 	return err
@@ -122,12 +167,26 @@ func (this *transport) Accept() (net.Conn, error) {
 		switch this.network {
 		case TCP:
 			fallthrough
+		case UNIX:
+			fallthrough
+		case PIPE:
+			conn, err = this.lner.Accept()
 		case SSL:
 			fallthrough
 		case TCPS:
 			fallthrough
 		case TLS:
-			conn, err = this.lner.Accept()
+			if conn, err = this.lner.Accept(); err == nil {
+				conn = tls.Server(conn, this.tlsc)
+			}
+		case WS:
+			if conn, err = this.lner.Accept(); err == nil {
+				conn = newWsConn(conn, true, this.path)
+			}
+		case WSS:
+			if conn, err = this.lner.Accept(); err == nil {
+				conn = newWsConn(tls.Server(conn, this.tlsc), true, this.path)
+			}
 		}
 
 		return conn, err
@@ -136,15 +195,19 @@ func (this *transport) Accept() (net.Conn, error) {
 	}
 }
 
+//Close stops listening, an Accept in progress returns at once
 func (this *transport) Close() {
 	if this.lner != nil {
-		close(this.quit)
+		this.closeOnce.Do(func() {
+			close(this.quit)
+			this.lner.Close()
+		})
 	}
 }
 
 func (this *transport) SetDeadline(t time.Time) error {
-	if tcpln, ok := this.lner.(*net.TCPListener); ok {
-		return tcpln.SetDeadline(t)
+	if ln, ok := this.lner.(interface{ SetDeadline(time.Time) error }); ok {
+		return ln.SetDeadline(t)
 	} else {
 		return errors.New("Listener doesn't support SetDeadline\n")
 	}
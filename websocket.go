@@ -0,0 +1,412 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////Interface//////////////////////////////
+
+const (
+	WS_PATH              = "/mqtt"
+	WS_SUBPROTOCOL       = "mqtt"
+	WS_HANDSHAKE_TIMEOUT = 10      //seconds
+	WS_HANDSHAKE_MAX     = 8 << 10 //bytes read for the handshake request or response
+
+	WS_OPCODE_CONTINUATION byte = 0x0
+	WS_OPCODE_TEXT         byte = 0x1
+	WS_OPCODE_BINARY       byte = 0x2
+	WS_OPCODE_CLOSE        byte = 0x8
+	WS_OPCODE_PING         byte = 0x9
+	WS_OPCODE_PONG         byte = 0xA
+)
+
+////////////////////Implementation////////////////////////
+
+const ws_guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ws_conn carries the MQTT byte stream in binary websocket frames. On the
+// server side the handshake is done lazily by the first Read or Write, so
+// Accept doesn't block on a slow peer
+type ws_conn struct {
+	net.Conn
+
+	server bool
+	path   string
+	limit  *io.LimitedReader //bounds the handshake, lifted once it is done
+	reader *bufio.Reader
+
+	handshake     sync.Once
+	handshakeErr  error
+	open          bool //handshake completed, guarded by writeMutex
+	readDeadline  time.Time
+	deadlineMutex sync.Mutex
+
+	header    []byte //partially read frame header
+	remaining uint64 //payload bytes left in the current frame
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+
+	writeMutex sync.Mutex
+	closing    bool //close frame sent, guarded by writeMutex
+	closeOnce  sync.Once
+}
+
+func newWsConn(conn net.Conn, server bool, path string) *ws_conn {
+	this := &ws_conn{}
+
+	this.Conn = conn
+	this.server = server
+	this.path = path
+	this.limit = &io.LimitedReader{R: conn, N: WS_HANDSHAKE_MAX}
+	this.reader = bufio.NewReader(this.limit)
+
+	return this
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + ws_guid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func wsHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Dial side of the handshake, done before the connection is returned
+func (this *ws_conn) dial(host string) error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	this.Conn.SetDeadline(time.Now().Add(WS_HANDSHAKE_TIMEOUT * time.Second))
+	defer this.Conn.SetDeadline(time.Time{})
+
+	req := "GET " + this.path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: " + WS_SUBPROTOCOL + "\r\n\r\n"
+	if _, err := this.Conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(this.reader, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("WebSocket Handshake Failed with Status %s\n", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return errors.New("Invalid Sec-WebSocket-Accept in WebSocket Handshake\n")
+	}
+	if !wsHasToken(resp.Header, "Sec-WebSocket-Protocol", WS_SUBPROTOCOL) {
+		return errors.New("WebSocket Subprotocol mqtt Not Negotiated\n")
+	}
+	this.opened()
+
+	return nil
+}
+
+// opened lifts the handshake limit, the frames are read after the handshake
+// completed so the limit isn't shared with another goroutine
+func (this *ws_conn) opened() {
+	this.limit.N = math.MaxInt64
+
+	this.writeMutex.Lock()
+	this.open = true
+	this.writeMutex.Unlock()
+}
+
+// Accept side of the handshake
+func (this *ws_conn) accept() error {
+	this.Conn.SetReadDeadline(time.Now().Add(WS_HANDSHAKE_TIMEOUT * time.Second))
+	defer func() {
+		this.deadlineMutex.Lock()
+		this.Conn.SetReadDeadline(this.readDeadline)
+		this.deadlineMutex.Unlock()
+	}()
+
+	req, err := http.ReadRequest(this.reader)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+
+	reject := func(status int, reason string) error {
+		this.Conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nConnection: close\r\n\r\n", status, http.StatusText(status))))
+		return errors.New(reason)
+	}
+	if req.URL.Path != this.path {
+		return reject(http.StatusNotFound, fmt.Sprintf("WebSocket Path %s Not Found\n", req.URL.Path))
+	}
+	if req.Method != "GET" || !wsHasToken(req.Header, "Upgrade", "websocket") || !wsHasToken(req.Header, "Connection", "upgrade") {
+		return reject(http.StatusBadRequest, "Invalid WebSocket Upgrade Request\n")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return reject(http.StatusBadRequest, "Unsupported WebSocket Version\n")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return reject(http.StatusBadRequest, "Missing Sec-WebSocket-Key\n")
+	}
+	if !wsHasToken(req.Header, "Sec-WebSocket-Protocol", WS_SUBPROTOCOL) {
+		return reject(http.StatusBadRequest, "WebSocket Subprotocol mqtt Not Requested\n")
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + WS_SUBPROTOCOL + "\r\n\r\n"
+	if _, err = this.Conn.Write([]byte(resp)); err != nil {
+		return err
+	}
+	this.opened()
+
+	return nil
+}
+
+func (this *ws_conn) handshaked() error {
+	if this.server {
+		this.handshake.Do(func() {
+			this.handshakeErr = this.accept()
+		})
+	}
+	return this.handshakeErr
+}
+
+func wsHeaderLength(header []byte) int {
+	if len(header) < 2 {
+		return 2
+	}
+	n := 2
+	switch header[1] & 0x7F {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if header[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (this *ws_conn) Read(b []byte) (int, error) {
+	if err := this.handshaked(); err != nil {
+		return 0, err
+	}
+
+	for this.remaining == 0 {
+		//the header is kept across calls, so a read timeout never loses a frame
+		for n := wsHeaderLength(this.header); len(this.header) < n; n = wsHeaderLength(this.header) {
+			c, err := this.reader.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			this.header = append(this.header, c)
+		}
+		header := this.header
+		this.header = nil
+
+		opcode := header[0] & 0x0F
+		length := uint64(header[1] & 0x7F)
+		pos := 2
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(header[2:4]))
+			pos = 4
+		case 127:
+			length = binary.BigEndian.Uint64(header[2:10])
+			pos = 10
+		}
+		this.masked = header[1]&0x80 != 0
+		if this.masked {
+			copy(this.maskKey[:], header[pos:pos+4])
+		}
+		this.maskPos = 0
+
+		//frames from the client are masked, frames from the server are not
+		if this.masked != this.server {
+			this.writeFrame(WS_OPCODE_CLOSE, []byte{0x03, 0xEA}) //1002 protocol error
+			return 0, errors.New("Invalid WebSocket Frame Masking\n")
+		}
+
+		switch opcode {
+		case WS_OPCODE_CONTINUATION, WS_OPCODE_BINARY:
+			this.remaining = length
+		case WS_OPCODE_CLOSE, WS_OPCODE_PING, WS_OPCODE_PONG:
+			if length > 125 {
+				return 0, errors.New("Invalid WebSocket Control Frame Length\n")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(this.reader, payload); err != nil {
+				return 0, err
+			}
+			this.unmask(payload)
+			switch opcode {
+			case WS_OPCODE_CLOSE:
+				//the close is answered with its status code
+				if len(payload) == 1 {
+					this.writeFrame(WS_OPCODE_CLOSE, []byte{0x03, 0xEA}) //1002 protocol error
+					return 0, errors.New("Invalid WebSocket Close Frame\n")
+				}
+				if len(payload) > 2 {
+					payload = payload[:2]
+				}
+				this.writeFrame(WS_OPCODE_CLOSE, payload)
+				return 0, io.EOF
+			case WS_OPCODE_PING:
+				this.writeFrame(WS_OPCODE_PONG, payload)
+			}
+		default:
+			//MQTT is only carried in binary frames
+			this.writeFrame(WS_OPCODE_CLOSE, []byte{0x03, 0xEB}) //1003 unsupported data
+			return 0, fmt.Errorf("Unsupported WebSocket Opcode %x\n", opcode)
+		}
+	}
+
+	if uint64(len(b)) > this.remaining {
+		b = b[:this.remaining]
+	}
+	n, err := this.reader.Read(b)
+	this.unmask(b[:n])
+	this.remaining -= uint64(n)
+
+	return n, err
+}
+
+func (this *ws_conn) unmask(b []byte) {
+	if !this.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= this.maskKey[this.maskPos&3]
+		this.maskPos++
+	}
+}
+
+func (this *ws_conn) Write(b []byte) (int, error) {
+	if err := this.handshaked(); err != nil {
+		return 0, err
+	}
+	if err := this.writeFrame(WS_OPCODE_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (this *ws_conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	//frames from the client are masked
+	var mask byte
+	if !this.server {
+		mask = 0x80
+	}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, mask|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, mask|126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, mask|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(length))
+	}
+
+	if this.server {
+		frame = append(frame, payload...)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		for i, c := range payload {
+			frame = append(frame, c^key[i&3])
+		}
+	}
+
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+
+	//nothing is sent after a close frame
+	if this.closing {
+		return errors.New("WebSocket Closing\n")
+	}
+	if opcode == WS_OPCODE_CLOSE {
+		this.closing = true
+	}
+
+	_, err := this.Conn.Write(frame)
+	return err
+}
+
+// ConnectionState of wss, so the peer certificate is reachable through the
+// websocket layer
+func (this *ws_conn) ConnectionState() tls.ConnectionState {
+	if c, ok := this.Conn.(*tls.Conn); ok {
+		return c.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+func (this *ws_conn) SetDeadline(t time.Time) error {
+	this.deadlineMutex.Lock()
+	this.readDeadline = t
+	this.deadlineMutex.Unlock()
+
+	return this.Conn.SetDeadline(t)
+}
+
+func (this *ws_conn) SetReadDeadline(t time.Time) error {
+	this.deadlineMutex.Lock()
+	this.readDeadline = t
+	this.deadlineMutex.Unlock()
+
+	return this.Conn.SetReadDeadline(t)
+}
+
+func (this *ws_conn) Close() error {
+	this.closeOnce.Do(func() {
+		this.writeMutex.Lock()
+		open := this.open
+		this.writeMutex.Unlock()
+		if open {
+			this.Conn.SetWriteDeadline(time.Now().Add(1e9))
+			this.writeFrame(WS_OPCODE_CLOSE, []byte{0x03, 0xE8}) //1000 normal closure
+		}
+	})
+	return this.Conn.Close()
+}